@@ -0,0 +1,182 @@
+// Package blobcompress provides the compression of file content blobs.
+//
+// A compressed blob consists of independently compressed frames, so that a range of
+// the content can be read by decompressing only the frames that contain the range.
+// Gzip frames are gzip members, and zstd frames are zstd frames.
+//
+// The compression map records the compressed blobs for the digests of the contents,
+// so that the digests of both the compressed and the uncompressed forms are known.
+package blobcompress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/AkihiroSuda/filegrain/layerutil"
+)
+
+const (
+	// Annotation is the annotation of a continuity manifest layer descriptor.
+	// The value is the digest of the compression map blob.
+	Annotation = "filegrain.compression"
+
+	// MediaType is the media type of the compression map blob.
+	MediaType = "application/vnd.filegrain.compression.v1+json"
+
+	// MediaTypeGzip and MediaTypeZstd are the media types of the compressed blobs.
+	MediaTypeGzip = "application/vnd.filegrain.blob.v1+gzip"
+	MediaTypeZstd = "application/vnd.filegrain.blob.v1+zstd"
+
+	Version = 1
+
+	// DefaultFrameSize is the default size of the uncompressed content of a frame.
+	DefaultFrameSize = 1 << 20
+)
+
+// Blob is a compressed blob.
+type Blob struct {
+	MediaType string        `json:"mediaType"`
+	Digest    digest.Digest `json:"digest"`
+	Size      int64         `json:"size"`
+	// FrameSize is the size of the uncompressed content of each frame, except the last one.
+	FrameSize int64 `json:"frameSize"`
+	// Frames is the list of the compressed sizes of the frames.
+	Frames []int64 `json:"frames"`
+}
+
+// Compression returns the compression of the blob.
+func (b *Blob) Compression() (layerutil.Compression, error) {
+	switch b.MediaType {
+	case MediaTypeGzip:
+		return layerutil.Gzip, nil
+	case MediaTypeZstd:
+		return layerutil.Zstd, nil
+	}
+	return layerutil.Uncompressed, fmt.Errorf("unsupported compressed blob mediaType: %s", b.MediaType)
+}
+
+// Frame returns the index of the frame that contains the uncompressed offset off,
+// the offset of the frame in the compressed blob, and the offset of off in the frame.
+func (b *Blob) Frame(off int64) (int, int64, int64, error) {
+	if b.FrameSize <= 0 || off < 0 {
+		return 0, 0, 0, fmt.Errorf("invalid offset %d for %s", off, b.Digest)
+	}
+	i := off / b.FrameSize
+	if i >= int64(len(b.Frames)) {
+		return 0, 0, 0, io.EOF
+	}
+	var compressedOff int64
+	for _, n := range b.Frames[:i] {
+		compressedOff += n
+	}
+	return int(i), compressedOff, off - i*b.FrameSize, nil
+}
+
+// Map is the compression map.
+type Map struct {
+	Version int `json:"version"`
+	// Blobs is keyed by the digest of the uncompressed content.
+	Blobs map[digest.Digest]Blob `json:"blobs"`
+}
+
+// NewMap returns an empty compression map.
+func NewMap() *Map {
+	return &Map{
+		Version: Version,
+		Blobs:   make(map[digest.Digest]Blob, 0),
+	}
+}
+
+// Unmarshal decodes the compression map.
+func Unmarshal(b []byte) (*Map, error) {
+	var m Map
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	if m.Version != Version {
+		return nil, fmt.Errorf("unsupported compression map version: %d", m.Version)
+	}
+	return &m, nil
+}
+
+// Lookup returns the compressed blob for the content.
+// Returns nil if the content is not compressed, or if m is nil.
+func (m *Map) Lookup(d digest.Digest) *Blob {
+	if m == nil {
+		return nil
+	}
+	b, ok := m.Blobs[d]
+	if !ok {
+		return nil
+	}
+	return &b
+}
+
+// MediaTypeForCompression returns the media type of the blobs compressed with c.
+func MediaTypeForCompression(c layerutil.Compression) (string, error) {
+	switch c {
+	case layerutil.Gzip:
+		return MediaTypeGzip, nil
+	case layerutil.Zstd:
+		return MediaTypeZstd, nil
+	}
+	return "", fmt.Errorf("unsupported compression: %v", c)
+}
+
+// Compress compresses r into w, in the frames of frameSize bytes.
+// Returns the list of the compressed sizes of the frames.
+func Compress(w io.Writer, r io.Reader, c layerutil.Compression, frameSize int64) ([]int64, error) {
+	if frameSize <= 0 {
+		frameSize = DefaultFrameSize
+	}
+	var enc *zstd.Encoder
+	if c == layerutil.Zstd {
+		var err error
+		if enc, err = zstd.NewWriter(nil); err != nil {
+			return nil, err
+		}
+		defer enc.Close()
+	}
+	var (
+		frames []int64
+		in     = make([]byte, frameSize)
+		out    bytes.Buffer
+	)
+	for {
+		n, err := io.ReadFull(r, in)
+		if n == 0 && err == io.EOF {
+			return frames, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		out.Reset()
+		switch c {
+		case layerutil.Gzip:
+			zw := gzip.NewWriter(&out)
+			if _, err := zw.Write(in[:n]); err != nil {
+				return nil, err
+			}
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+		case layerutil.Zstd:
+			out.Write(enc.EncodeAll(in[:n], nil))
+		default:
+			return nil, fmt.Errorf("unsupported compression: %v", c)
+		}
+		if _, err := w.Write(out.Bytes()); err != nil {
+			return nil, err
+		}
+		frames = append(frames, int64(out.Len()))
+		if int64(n) < frameSize {
+			return frames, nil
+		}
+	}
+}
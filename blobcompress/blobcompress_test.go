@@ -0,0 +1,51 @@
+package blobcompress
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/AkihiroSuda/filegrain/layerutil"
+)
+
+func TestCompress(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	for _, c := range []layerutil.Compression{layerutil.Gzip, layerutil.Zstd} {
+		var buf bytes.Buffer
+		frames, err := Compress(&buf, bytes.NewReader(content), c, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(frames) != 16 {
+			t.Fatalf("%v: expected 16 frames, got %d", c, len(frames))
+		}
+		mediaType, err := MediaTypeForCompression(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := &Blob{MediaType: mediaType, Size: int64(buf.Len()), FrameSize: 1000, Frames: frames}
+		for _, off := range []int64{0, 999, 1000, 12345} {
+			i, compressedOff, frameOff, err := b.Frame(off)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := io.NewSectionReader(bytes.NewReader(buf.Bytes()), compressedOff, frames[i])
+			dr, err := layerutil.Decompress(c, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(dr)
+			dr.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got[frameOff:], content[off:int64(i+1)*1000]) {
+				t.Fatalf("%v: unexpected content at %d", c, off)
+			}
+		}
+		if _, _, _, err := b.Frame(16000); err != io.EOF {
+			t.Fatalf("%v: expected EOF, got %v", c, err)
+		}
+	}
+}
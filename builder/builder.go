@@ -1,5 +1,37 @@
 package builder
 
+import (
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/layerutil"
+)
+
 type Builder interface {
 	Build(img, refName string) error
 }
+
+// Options configures how the files are stored as blobs.
+type Options struct {
+	// ChunkThreshold enables content-defined chunking of the regular files larger than ChunkThreshold bytes.
+	// The chunks of a file are stored as separate blobs, so that the unchanged parts of a modified file
+	// can be shared across the versions of the image.
+	// Zero disables chunking.
+	ChunkThreshold int64
+	// ChunkAvgSize is the average size of the chunks.
+	// Defaults to cdc.DefaultAvgSize.
+	ChunkAvgSize int
+	// Compression compresses the blobs of the files, unless the compression does not reduce the size.
+	// The compressed blobs are recorded in the compression map, keyed by the digests of the contents.
+	Compression layerutil.Compression
+	// PackThreshold packs the regular files not larger than PackThreshold bytes into tar layers,
+	// so that a lot of small files can be pulled in batch.
+	// Zero disables packing by the size.
+	PackThreshold int64
+	// PackDirs packs the regular files under the directories (e.g. "/usr/share/locale") into tar layers,
+	// regardless of PackThreshold.
+	PackDirs []string
+	// BlobsLayout is the layout of the blobs directory of the image.
+	BlobsLayout image.BlobsLayout
+	// Jobs is the number of the files ingested concurrently.
+	// Defaults to DefaultJobs.
+	Jobs int
+}
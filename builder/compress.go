@@ -0,0 +1,54 @@
+package builder
+
+import (
+	"io"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/AkihiroSuda/filegrain/blobcompress"
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/layerutil"
+)
+
+// putCompressedBlob compresses the content and puts it as a blob.
+// Returns nil without putting the blob, if the compression does not reduce the size.
+func putCompressedBlob(img string, r io.Reader, size int64, c layerutil.Compression) (*blobcompress.Blob, error) {
+	mediaType, err := blobcompress.MediaTypeForCompression(c)
+	if err != nil {
+		return nil, err
+	}
+	bw, err := image.NewBlobWriter(img, digest.Canonical)
+	if err != nil {
+		return nil, err
+	}
+	defer bw.Abort()
+	cw := &countingWriter{w: bw}
+	frames, err := blobcompress.Compress(cw, r, c, blobcompress.DefaultFrameSize)
+	if err != nil {
+		return nil, err
+	}
+	if cw.n >= size {
+		return nil, nil
+	}
+	if err := bw.Close(); err != nil {
+		return nil, err
+	}
+	return &blobcompress.Blob{
+		MediaType: mediaType,
+		Digest:    *bw.Digest(),
+		Size:      cw.n,
+		FrameSize: blobcompress.DefaultFrameSize,
+		Frames:    frames,
+	}, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
@@ -15,11 +15,13 @@ import (
 
 type fromDockerImageBuilder struct {
 	source string
+	opts   Options
 }
 
-func NewBuilderWithDockerImage(source string) (Builder, error) {
+func NewBuilderWithDockerImage(source string, opts Options) (Builder, error) {
 	return &fromDockerImageBuilder{
 		source: source,
+		opts:   opts,
 	}, nil
 }
 
@@ -41,9 +43,10 @@ func (b *fromDockerImageBuilder) Build(img, refName string) error {
 	if err = convertDockerImageToRootFS(rootfs, b.source); err != nil {
 		return err
 	}
-	rb, err := NewBuilderWithRootFS(rootfs)
-	if err != nil {
-		return err
+	rb := &fromRootFSBuilder{
+		source:     rootfs,
+		opts:       b.opts,
+		ownsSource: true,
 	}
 	return rb.Build(img, refName)
 }
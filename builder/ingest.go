@@ -0,0 +1,197 @@
+package builder
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	progressbar "github.com/cheggaaa/pb"
+	"github.com/opencontainers/go-digest"
+
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/layerutil"
+)
+
+// DefaultJobs is the default number of the concurrent ingestion jobs.
+var DefaultJobs = runtime.NumCPU()
+
+func (opts Options) jobs() int {
+	if opts.Jobs <= 0 {
+		return DefaultJobs
+	}
+	return opts.Jobs
+}
+
+// storesWholeFile returns true if the regular file is stored as a single uncompressed blob,
+// i.e. neither chunked, compressed, nor packed.
+func (opts Options) storesWholeFile(p string, size int64) bool {
+	if opts.ChunkThreshold > 0 && size > opts.ChunkThreshold {
+		return false
+	}
+	return opts.Compression == layerutil.Uncompressed && !opts.isPackedPath(p, size)
+}
+
+type ingestedFile struct {
+	digest  digest.Digest
+	size    int64
+	modTime time.Time
+}
+
+// ingester ingests the regular files of the source into the blobs directory in parallel,
+// and implements continuity.Digester so that continuity does not hash the files again.
+type ingester struct {
+	mu sync.Mutex
+	// files is keyed by the absolute paths
+	files map[string]ingestedFile
+}
+
+// ingestItem is a set of the hardlinks to a regular file.
+type ingestItem struct {
+	// paths are the absolute paths, sorted
+	paths []string
+	// path is the path of paths[0] in the source, e.g. "/etc/hostname"
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// ingestFiles puts the regular files of source that are stored as single blobs (see storesWholeFile),
+// and hashes the other regular files.
+// If link is true, the files are hardlinked into the blobs directory, so source must not be modified
+// until img is built.
+func ingestFiles(img, source string, opts Options, link bool) (*ingester, error) {
+	source, err := filepath.Abs(filepath.Clean(source))
+	if err != nil {
+		return nil, err
+	}
+	type inode struct {
+		dev, ino uint64
+	}
+	var (
+		items  []*ingestItem
+		inodes = make(map[inode]*ingestItem, 0)
+	)
+	// the trailing separator is needed for walking a symlink to the directory
+	if err := filepath.Walk(source+string(filepath.Separator), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		var k *inode
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			k = &inode{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+			if item, ok := inodes[*k]; ok {
+				item.paths = append(item.paths, p)
+				return nil
+			}
+		}
+		item := &ingestItem{
+			paths:   []string{p},
+			size:    fi.Size(),
+			modTime: fi.ModTime(),
+		}
+		items = append(items, item)
+		if k != nil {
+			inodes[*k] = item
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		sort.Strings(item.paths)
+		rel, err := filepath.Rel(source, item.paths[0])
+		if err != nil {
+			return nil, err
+		}
+		item.path = "/" + filepath.ToSlash(rel)
+	}
+	ing := &ingester{files: make(map[string]ingestedFile, len(items))}
+	bar := progressbar.StartNew(len(items))
+	ch := make(chan *ingestItem)
+	var (
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	for i := 0; i < opts.jobs(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range ch {
+				err := ing.ingest(img, item, opts, link)
+				bar.Increment()
+				ing.mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				ing.mu.Unlock()
+			}
+		}()
+	}
+	for _, item := range items {
+		ing.mu.Lock()
+		failed := firstErr != nil
+		ing.mu.Unlock()
+		if failed {
+			break
+		}
+		ch <- item
+	}
+	close(ch)
+	wg.Wait()
+	bar.Finish()
+	return ing, firstErr
+}
+
+func (ing *ingester) ingest(img string, item *ingestItem, opts Options, link bool) error {
+	var (
+		d   digest.Digest
+		err error
+	)
+	if opts.storesWholeFile(item.path, item.size) {
+		d, err = image.IngestFile(img, item.paths[0], link)
+	} else {
+		d, err = hashFile(item.paths[0])
+	}
+	if err != nil {
+		return err
+	}
+	ing.mu.Lock()
+	for _, p := range item.paths {
+		ing.files[p] = ingestedFile{digest: d, size: item.size, modTime: item.modTime}
+	}
+	ing.mu.Unlock()
+	return nil
+}
+
+// Digest implements continuity.Digester.
+// The files modified after the ingestion are hashed again.
+func (ing *ingester) Digest(r io.Reader) (digest.Digest, error) {
+	if f, ok := r.(*os.File); ok {
+		if fi, err := f.Stat(); err == nil {
+			ing.mu.Lock()
+			x, ok := ing.files[f.Name()]
+			ing.mu.Unlock()
+			if ok && x.size == fi.Size() && x.modTime.Equal(fi.ModTime()) {
+				return x.digest, nil
+			}
+		}
+	}
+	return digest.Canonical.FromReader(r)
+}
+
+func hashFile(path string) (digest.Digest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return digest.Canonical.FromReader(f)
+}
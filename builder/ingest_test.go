@@ -0,0 +1,92 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/AkihiroSuda/filegrain/image"
+)
+
+func TestIngestFiles(t *testing.T) {
+	for _, link := range []bool{false, true} {
+		testIngestFiles(t, link)
+	}
+}
+
+func testIngestFiles(t *testing.T, link bool) {
+	tmpDir, err := ioutil.TempDir("", "filegrain-test-ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	rootfs, img := filepath.Join(tmpDir, "rootfs"), filepath.Join(tmpDir, "img")
+	files := map[string]string{
+		"/etc/hostname":     "host",
+		"/etc/large":        "this file is larger than the threshold",
+		"/usr/bin/foo":      "foo",
+		"/usr/bin/foo-copy": "foo",
+	}
+	for p, content := range files {
+		if err := os.MkdirAll(filepath.Join(rootfs, filepath.Dir(p)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(rootfs, p), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Link(filepath.Join(rootfs, "/usr/bin/foo"), filepath.Join(rootfs, "/usr/bin/foo-link")); err != nil {
+		t.Fatal(err)
+	}
+	files["/usr/bin/foo-link"] = files["/usr/bin/foo"]
+	// only the files with the same mode as blobs can be hardlinked
+	if err := os.Chmod(filepath.Join(rootfs, "/etc/hostname"), 0444); err != nil {
+		t.Fatal(err)
+	}
+	if err := image.Init(img); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{ChunkThreshold: 16, Jobs: 2}
+	ing, err := ingestFiles(img, rootfs, opts, link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, content := range files {
+		d := digest.FromString(content)
+		if x := ing.files[filepath.Join(rootfs, p)]; x.digest != d {
+			t.Errorf("%s: expected %s, got %s", p, d, x.digest)
+		}
+		// large files are chunked, so the whole content should not be stored
+		if stored := image.BlobExists(img, d); stored == (p == "/etc/large") {
+			t.Errorf("%s: unexpected existence of blob: %v", p, stored)
+		}
+		if p == "/etc/large" {
+			continue
+		}
+		blobFi, err := image.StatBlob(img, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := blobFi.Mode(); mode != 0444 {
+			t.Errorf("%s: expected blob mode 0444, got %v", p, mode)
+		}
+		fi, err := os.Stat(filepath.Join(rootfs, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if linked := os.SameFile(fi, blobFi); linked != (link && p == "/etc/hostname") {
+			t.Errorf("%s: unexpected hardlinking: %v", p, linked)
+		}
+	}
+	f, err := os.Open(filepath.Join(rootfs, "/usr/bin/foo-link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if d, err := ing.Digest(f); err != nil || d != digest.FromString("foo") {
+		t.Fatalf("unexpected digest %s: %v", d, err)
+	}
+}
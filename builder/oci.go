@@ -1,19 +1,132 @@
 package builder
 
 import (
-	"errors"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/layerutil"
 )
 
 type fromOCIImageBuilder struct {
-	source string
+	source        string
+	sourceRefName string
+	opts          Options
 }
 
-func NewBuilderWithOCIImage(source string) (Builder, error) {
+// NewBuilderWithOCIImage returns a builder that converts the OCI image at source.
+// sourceRefName specifies the manifest in the source index.
+// If sourceRefName is empty, the ref name passed to Build is used.
+func NewBuilderWithOCIImage(source, sourceRefName string, opts Options) (Builder, error) {
+	if _, err := image.ReadImageLayout(source); err != nil {
+		return nil, fmt.Errorf("source %q does not seem an OCI image: %v", source, err)
+	}
 	return &fromOCIImageBuilder{
-		source: source,
+		source:        source,
+		sourceRefName: sourceRefName,
+		opts:          opts,
 	}, nil
 }
 
+// Build builds the FILEgrain image from b.source.
+// Current implementation applies the tar layers to a raw rootfs,
+// and internally uses fromRootFSBuilder.
 func (b *fromOCIImageBuilder) Build(img, refName string) error {
-	return errors.New("fromOCIImageBuilder: not implemented yet")
+	sourceRefName := b.sourceRefName
+	if sourceRefName == "" {
+		sourceRefName = refName
+	}
+	manifest, err := readSourceManifest(b.source, sourceRefName)
+	if err != nil {
+		return err
+	}
+	var config spec.Image
+	if err := readSourceJSONBlob(b.source, &manifest.Config, &config); err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir("", "filegrain-fromOCIImageBuilder")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	rootfs := filepath.Join(tmpDir, "rootfs")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		return err
+	}
+	for i, layer := range manifest.Layers {
+		logrus.Infof("Applying layer %d/%d %s to %s", i+1, len(manifest.Layers), layer.Digest, rootfs)
+		if err := applySourceLayer(rootfs, b.source, &layer); err != nil {
+			return err
+		}
+	}
+	rb := &fromRootFSBuilder{
+		source:     rootfs,
+		config:     &config,
+		opts:       b.opts,
+		ownsSource: true,
+	}
+	return rb.Build(img, refName)
+}
+
+// readSourceManifest reads the manifest specified by refName.
+// If refName is not found and the index has only one manifest, the manifest is returned.
+func readSourceManifest(source, refName string) (*spec.Manifest, error) {
+	idx, err := image.ReadIndex(source)
+	if err != nil {
+		return nil, err
+	}
+	var desc *spec.Descriptor
+	for i, m := range idx.Manifests {
+		if mRefName, ok := m.Annotations[image.RefNameAnnotation]; ok && mRefName == refName {
+			desc = &idx.Manifests[i]
+			break
+		}
+	}
+	if desc == nil {
+		if len(idx.Manifests) != 1 {
+			return nil, fmt.Errorf("unknown reference name in %s: %q", source, refName)
+		}
+		logrus.Warnf("Reference name %q not found in %s, using the only manifest %s", refName, source, idx.Manifests[0].Digest)
+		desc = &idx.Manifests[0]
+	}
+	if desc.MediaType != spec.MediaTypeImageManifest {
+		return nil, fmt.Errorf("unsupported manifest mediaType: %s", desc.MediaType)
+	}
+	var manifest spec.Manifest
+	if err := readSourceJSONBlob(source, desc, &manifest); err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func readSourceJSONBlob(source string, desc *spec.Descriptor, x interface{}) error {
+	b, err := image.ReadBlob(source, desc.Digest)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, x)
+}
+
+func applySourceLayer(rootfs, source string, desc *spec.Descriptor) error {
+	compression, err := layerutil.LayerCompression(desc.MediaType)
+	if err != nil {
+		return err
+	}
+	r, err := image.GetBlobReader(source, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	dr, err := layerutil.Decompress(compression, r)
+	if err != nil {
+		return err
+	}
+	defer dr.Close()
+	return applyTarLayer(rootfs, dr)
 }
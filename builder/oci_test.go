@@ -0,0 +1,191 @@
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	pb "github.com/containerd/continuity/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/opencontainers/image-spec/specs-go"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/image/imageutil"
+)
+
+type testTarEntry struct {
+	name     string
+	typeflag byte
+	content  string
+}
+
+func testTarLayer(t *testing.T, gz bool, entries []testTarEntry) []byte {
+	var (
+		buf bytes.Buffer
+		w   io.Writer = &buf
+		gw  *gzip.Writer
+	)
+	if gz {
+		gw = gzip.NewWriter(&buf)
+		w = gw
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Mode:     0644,
+			Size:     int64(len(e.content)),
+		}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestOCIImageBuilder(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filegrain-test-oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	source := filepath.Join(tmpDir, "source")
+	if err := image.Init(source); err != nil {
+		t.Fatal(err)
+	}
+	layers := []struct {
+		mediaType string
+		blob      []byte
+	}{
+		{spec.MediaTypeImageLayerGzip, testTarLayer(t, true, []testTarEntry{
+			{"etc/", tar.TypeDir, ""},
+			{"etc/hostname", tar.TypeReg, "foo"},
+			{"etc/passwd", tar.TypeReg, "root"},
+			{"opt/", tar.TypeDir, ""},
+			{"opt/old", tar.TypeReg, "old"},
+			{"opt/sub/", tar.TypeDir, ""},
+			{"opt/sub/old", tar.TypeReg, "old"},
+		})},
+		{spec.MediaTypeImageLayer, testTarLayer(t, false, []testTarEntry{
+			{"etc/.wh.hostname", tar.TypeReg, ""},
+			{"opt/new", tar.TypeReg, "new"},
+			// the lower children of the directories recreated before the opaque whiteout are hidden as well
+			{"opt/sub/", tar.TypeDir, ""},
+			{"opt/sub/new", tar.TypeReg, "new"},
+			{"opt/.wh..wh..opq", tar.TypeReg, ""},
+		})},
+	}
+	manifest := spec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+	}
+	for _, l := range layers {
+		d, err := image.WriteBlob(source, l.blob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest.Layers = append(manifest.Layers, spec.Descriptor{
+			MediaType: l.mediaType,
+			Digest:    d,
+			Size:      int64(len(l.blob)),
+		})
+	}
+	configDesc, err := imageutil.WriteJSONBlob(source, &spec.Image{Architecture: "arm64", OS: "linux"}, spec.MediaTypeImageConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Config = *configDesc
+	manifestDesc, err := imageutil.WriteJSONBlob(source, &manifest, spec.MediaTypeImageManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDesc.Annotations = map[string]string{image.RefNameAnnotation: "foo"}
+	if err := image.PutManifestDescriptorToIndex(source, manifestDesc); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := NewBuilderWithOCIImage(source, "foo", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(tmpDir, "target")
+	if err := b.Build(target, "bar"); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := image.ReadIndex(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Manifests) != 1 || idx.Manifests[0].Annotations[image.RefNameAnnotation] != "bar" {
+		t.Fatalf("unexpected index: %+v", idx)
+	}
+	var targetManifest spec.Manifest
+	if err := readSourceJSONBlob(target, &idx.Manifests[0], &targetManifest); err != nil {
+		t.Fatal(err)
+	}
+	var targetConfig spec.Image
+	if err := readSourceJSONBlob(target, &targetManifest.Config, &targetConfig); err != nil {
+		t.Fatal(err)
+	}
+	if targetConfig.Architecture != "arm64" {
+		t.Fatalf("expected the source config to be inherited, got %+v", targetConfig)
+	}
+	contMBlob, err := image.ReadBlob(target, targetManifest.Layers[0].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contM pb.Manifest
+	if err := proto.Unmarshal(contMBlob, &contM); err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, r := range contM.Resource {
+		paths = append(paths, r.Path...)
+		for _, d := range r.Digest {
+			if _, err := os.Stat(blobPath(target, d)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	sort.Strings(paths)
+	expected := []string{"/etc", "/etc/passwd", "/opt", "/opt/new", "/opt/sub", "/opt/sub/new"}
+	if b1, b2 := mustMarshal(t, paths), mustMarshal(t, expected); !bytes.Equal(b1, b2) {
+		t.Fatalf("expected %s, got %s", b2, b1)
+	}
+}
+
+func blobPath(img, d string) string {
+	return filepath.Join(img, "blobs", "sha256", d[len("sha256:"):])
+}
+
+func mustMarshal(t *testing.T, x interface{}) []byte {
+	b, err := json.Marshal(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,276 @@
+package builder
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	pb "github.com/containerd/continuity/proto"
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/gzindex"
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/image/imageutil"
+	"github.com/AkihiroSuda/filegrain/layerutil"
+	"github.com/AkihiroSuda/filegrain/tartoc"
+)
+
+// maxPackLayerSize is the approximate limit of the uncompressed size of a pack layer.
+const maxPackLayerSize = 64 << 20
+
+// packLayer is a tar layer that contains the small files.
+type packLayer struct {
+	desc spec.Descriptor
+	// diffID is the digest of the uncompressed tar.
+	diffID digest.Digest
+}
+
+// isPacked returns true if the resource should be packed into a tar layer.
+func (opts Options) isPacked(r *pb.Resource) bool {
+	if os.FileMode(r.Mode)&os.ModeType != 0 || len(r.Path) == 0 || len(r.Digest) == 0 {
+		return false
+	}
+	return opts.isPackedPath(r.Path[0], int64(r.Size))
+}
+
+// isPackedPath returns true if the regular file at p (e.g. "/etc/hostname") should be packed into a tar layer.
+func (opts Options) isPackedPath(p string, size int64) bool {
+	if opts.PackThreshold > 0 && size <= opts.PackThreshold {
+		return true
+	}
+	for _, dir := range opts.PackDirs {
+		dir = filepath.Clean("/" + dir)
+		if strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// packFiles puts the small files into tar layers, and removes them from the continuity manifest.
+// The directories are kept in the continuity manifest.
+func packFiles(img, source string, pbManifest *pb.Manifest, opts Options) ([]packLayer, error) {
+	var (
+		rest   []*pb.Resource
+		layers []packLayer
+		pw     *packWriter
+		nFiles int
+	)
+	for _, r := range pbManifest.Resource {
+		if !opts.isPacked(r) {
+			rest = append(rest, r)
+			continue
+		}
+		if pw == nil {
+			var err error
+			if pw, err = newPackWriter(img, opts.Compression); err != nil {
+				return nil, err
+			}
+		}
+		if err := pw.add(source, r); err != nil {
+			pw.abort()
+			return nil, err
+		}
+		nFiles++
+		if pw.size >= maxPackLayerSize {
+			layer, err := pw.close()
+			if err != nil {
+				return nil, err
+			}
+			layers = append(layers, *layer)
+			pw = nil
+		}
+	}
+	if pw != nil {
+		layer, err := pw.close()
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, *layer)
+	}
+	if nFiles > 0 {
+		logrus.Infof("Packed %d files into %d tar layers", nFiles, len(layers))
+	}
+	pbManifest.Resource = rest
+	return layers, nil
+}
+
+type packWriter struct {
+	img         string
+	compression layerutil.Compression
+	bw          *image.BlobWriter
+	// cw is the compressor, or nil for uncompressed layers.
+	cw       io.WriteCloser
+	diffID   digest.Digester
+	tw       *tar.Writer
+	compSize countingWriter
+	// tarSize counts the uncompressed tar stream, for recording the offsets in toc.
+	tarSize countingWriter
+	toc     *tartoc.TOC
+	// size is the uncompressed size of the contents written so far.
+	size int64
+}
+
+func newPackWriter(img string, compression layerutil.Compression) (*packWriter, error) {
+	bw, err := image.NewBlobWriter(img, digest.Canonical)
+	if err != nil {
+		return nil, err
+	}
+	pw := &packWriter{
+		img:         img,
+		compression: compression,
+		bw:          bw,
+		diffID:      digest.Canonical.Digester(),
+		toc:         tartoc.NewTOC(),
+	}
+	pw.compSize.w = bw
+	var w io.Writer = &pw.compSize
+	switch compression {
+	case layerutil.Gzip:
+		pw.cw = gzip.NewWriter(w)
+	case layerutil.Zstd:
+		if pw.cw, err = zstd.NewWriter(w); err != nil {
+			bw.Abort()
+			return nil, err
+		}
+	}
+	if pw.cw != nil {
+		w = pw.cw
+	}
+	pw.tarSize.w = io.MultiWriter(w, pw.diffID.Hash())
+	pw.tw = tar.NewWriter(&pw.tarSize)
+	return pw, nil
+}
+
+// add adds the regular file to the tar.
+// The additional paths of the file are added as hardlinks.
+func (pw *packWriter) add(source string, r *pb.Resource) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     strings.TrimPrefix(r.Path[0], "/"),
+		Mode:     int64(os.FileMode(r.Mode).Perm()),
+		Uid:      int(r.Uid),
+		Gid:      int(r.Gid),
+		Size:     int64(r.Size),
+	}
+	if r.Mode&uint32(os.ModeSetuid) != 0 {
+		hdr.Mode |= 04000
+	}
+	if r.Mode&uint32(os.ModeSetgid) != 0 {
+		hdr.Mode |= 02000
+	}
+	if r.Mode&uint32(os.ModeSticky) != 0 {
+		hdr.Mode |= 01000
+	}
+	for _, x := range r.Xattr {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string, 0)
+		}
+		hdr.PAXRecords[layerutil.PAXSchilyXattr+x.Name] = string(x.Data)
+	}
+	if hdr.PAXRecords != nil {
+		hdr.Format = tar.FormatPAX
+	}
+	f, err := os.Open(filepath.Join(source, r.Path[0]))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr.ModTime = fi.ModTime()
+	if err := pw.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// tar.Writer does not buffer the header, so tarSize points to the beginning of the content
+	pw.toc.Add(hdr, pw.tarSize.n)
+	if _, err := io.CopyN(pw.tw, f, hdr.Size); err != nil {
+		return err
+	}
+	for _, p := range r.Path[1:] {
+		linkHdr := &tar.Header{
+			Typeflag: tar.TypeLink,
+			Name:     strings.TrimPrefix(p, "/"),
+			Linkname: hdr.Name,
+		}
+		if err := pw.tw.WriteHeader(linkHdr); err != nil {
+			return err
+		}
+		pw.toc.Add(linkHdr, pw.tarSize.n)
+	}
+	// headers and paddings are not counted
+	pw.size += hdr.Size
+	return nil
+}
+
+func (pw *packWriter) abort() {
+	pw.bw.Abort()
+}
+
+// close finishes the layer, and puts the TOC and the gzip index (for gzip layers).
+func (pw *packWriter) close() (*packLayer, error) {
+	defer pw.abort()
+	if err := pw.tw.Close(); err != nil {
+		return nil, err
+	}
+	if pw.cw != nil {
+		if err := pw.cw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := pw.bw.Close(); err != nil {
+		return nil, err
+	}
+	layer := &packLayer{
+		desc: spec.Descriptor{
+			Digest: *pw.bw.Digest(),
+			Size:   pw.compSize.n,
+		},
+		diffID: pw.diffID.Digest(),
+	}
+	tocDesc, err := imageutil.WriteJSONBlob(pw.img, pw.toc, tartoc.MediaType)
+	if err != nil {
+		return nil, err
+	}
+	layer.desc.Annotations = map[string]string{tartoc.Annotation: tocDesc.Digest.String()}
+	switch pw.compression {
+	case layerutil.Gzip:
+		layer.desc.MediaType = spec.MediaTypeImageLayerGzip
+		idxDigest, err := putGzipIndex(pw.img, layer.desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		layer.desc.Annotations[gzindex.IndexAnnotation] = idxDigest.String()
+	case layerutil.Zstd:
+		layer.desc.MediaType = layerutil.MediaTypeImageLayerZstd
+	default:
+		layer.desc.MediaType = spec.MediaTypeImageLayer
+	}
+	return layer, nil
+}
+
+// putGzipIndex builds the gzip index of the blob, and puts the index as a blob.
+func putGzipIndex(img string, d digest.Digest) (digest.Digest, error) {
+	r, err := image.GetBlobReader(img, d)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	idx, err := gzindex.BuildIndex(r, 0, nil)
+	if err != nil {
+		return "", err
+	}
+	b, err := idx.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	return image.WriteBlob(img, b)
+}
@@ -0,0 +1,128 @@
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/blobcompress"
+	"github.com/AkihiroSuda/filegrain/cdc"
+	"github.com/AkihiroSuda/filegrain/continuityutil"
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/layerutil"
+)
+
+// reusableMaps are the chunk maps and the compression maps of the images already in the layout.
+// They are used for skipping chunking and compressing the files that are already stored.
+type reusableMaps struct {
+	chunkMap       *cdc.Map
+	compressionMap *blobcompress.Map
+}
+
+// loadReusableMaps merges the sidecar maps of the continuity layers of the manifests in the index of img.
+// Broken maps are ignored with warnings, as they are just used as hints.
+func loadReusableMaps(img string) (*reusableMaps, error) {
+	idx, err := image.ReadIndex(img)
+	if err != nil {
+		return nil, err
+	}
+	maps := &reusableMaps{
+		chunkMap:       cdc.NewMap(),
+		compressionMap: blobcompress.NewMap(),
+	}
+	for _, desc := range idx.Manifests {
+		if desc.MediaType != spec.MediaTypeImageManifest {
+			continue
+		}
+		b, err := image.ReadBlob(img, desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+		var m spec.Manifest
+		if err := json.Unmarshal(b, &m); err != nil {
+			logrus.Warnf("Ignoring manifest %s: %v", desc.Digest, err)
+			continue
+		}
+		for _, l := range m.Layers {
+			if l.MediaType != continuityutil.MediaTypeManifestV0Protobuf {
+				continue
+			}
+			if err := maps.load(img, l); err != nil {
+				logrus.Warnf("Ignoring the sidecar maps of %s: %v", l.Digest, err)
+			}
+		}
+	}
+	return maps, nil
+}
+
+func (maps *reusableMaps) load(img string, desc spec.Descriptor) error {
+	if s, ok := desc.Annotations[cdc.Annotation]; ok {
+		b, err := readAnnotatedBlob(img, cdc.Annotation, s)
+		if err != nil {
+			return err
+		}
+		m, err := cdc.Unmarshal(b)
+		if err != nil {
+			return err
+		}
+		for d, chunks := range m.Files {
+			maps.chunkMap.Files[d] = chunks
+		}
+	}
+	if s, ok := desc.Annotations[blobcompress.Annotation]; ok {
+		b, err := readAnnotatedBlob(img, blobcompress.Annotation, s)
+		if err != nil {
+			return err
+		}
+		m, err := blobcompress.Unmarshal(b)
+		if err != nil {
+			return err
+		}
+		for d, cb := range m.Blobs {
+			maps.compressionMap.Blobs[d] = cb
+		}
+	}
+	return nil
+}
+
+func readAnnotatedBlob(img, annotation, s string) ([]byte, error) {
+	d, err := digest.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest %q for annotation %s: %v", s, annotation, err)
+	}
+	return image.ReadBlob(img, d)
+}
+
+// compressed returns the existing blob of the content d compressed with c, or nil.
+func (maps *reusableMaps) compressed(img string, d digest.Digest, c layerutil.Compression) *blobcompress.Blob {
+	b := maps.compressionMap.Lookup(d)
+	if b == nil {
+		return nil
+	}
+	if bc, err := b.Compression(); err != nil || bc != c || !image.BlobExists(img, b.Digest) {
+		return nil
+	}
+	return b
+}
+
+// chunks returns the chunks of the file d, if all the chunks exist as uncompressed blobs
+// or as blobs compressed with c.
+// Returns nil otherwise.
+func (maps *reusableMaps) chunks(img string, d digest.Digest, c layerutil.Compression) []cdc.Chunk {
+	chunks, ok := maps.chunkMap.Files[d]
+	if !ok {
+		return nil
+	}
+	for _, chunk := range chunks {
+		if c != layerutil.Uncompressed && maps.compressed(img, chunk.Digest, c) != nil {
+			continue
+		}
+		if !image.BlobExists(img, chunk.Digest) {
+			return nil
+		}
+	}
+	return chunks
+}
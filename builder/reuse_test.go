@@ -0,0 +1,132 @@
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/layerutil"
+)
+
+func TestIncrementalBuild(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filegrain-test-reuse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	rootfs, img := filepath.Join(tmpDir, "rootfs"), filepath.Join(tmpDir, "img")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	unchanged := strings.Repeat("unchanged ", 1000)
+	if err := ioutil.WriteFile(filepath.Join(rootfs, "unchanged"), []byte(unchanged), 0644); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Compression: layerutil.Zstd}
+	var blobs []digest.Digest
+	for _, tag := range []string{"v1", "v2"} {
+		if err := ioutil.WriteFile(filepath.Join(rootfs, "version"), []byte(tag), 0644); err != nil {
+			t.Fatal(err)
+		}
+		b, err := NewBuilderWithRootFS(rootfs, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Build(img, tag); err != nil {
+			t.Fatal(err)
+		}
+		if tag == "v1" {
+			if blobs, err = image.ListBlobs(img); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	idx, err := image.ReadIndex(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Manifests) != 2 {
+		t.Fatalf("expected the manifests of v1 and v2, got %+v", idx.Manifests)
+	}
+	for _, d := range blobs {
+		if !image.BlobExists(img, d) {
+			t.Errorf("blob %s of v1 was removed", d)
+		}
+	}
+	reusable, err := loadReusableMaps(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := reusable.compressed(img, digest.FromString(unchanged), layerutil.Zstd); b == nil {
+		t.Fatal("the compressed blob of the unchanged file should be reusable")
+	}
+}
+
+func TestRebuildUnchanged(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filegrain-test-rebuild")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	rootfs, img := filepath.Join(tmpDir, "rootfs"), filepath.Join(tmpDir, "img")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"large": strings.Repeat("large ", 1000),
+		"small": "small",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(rootfs, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// covers the manifests, the sidecars, the packed layer and its gzip index
+	opts := Options{Compression: layerutil.Gzip, PackThreshold: 16}
+	var stats map[digest.Digest]os.FileInfo
+	for i := 0; i < 2; i++ {
+		b, err := NewBuilderWithRootFS(rootfs, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the existing blobs are read-only, so they must not be rewritten
+		if err := b.Build(img, "latest"); err != nil {
+			t.Fatalf("build #%d: %v", i, err)
+		}
+		blobs, err := image.ListBlobs(img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats == nil {
+			stats = make(map[digest.Digest]os.FileInfo, len(blobs))
+			for _, d := range blobs {
+				fi, err := image.StatBlob(img, d)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if mode := fi.Mode(); mode != 0444 {
+					t.Errorf("blob %s: expected mode 0444, got %v", d, mode)
+				}
+				stats[d] = fi
+			}
+			continue
+		}
+		if len(blobs) != len(stats) {
+			t.Errorf("expected %d blobs, got %d", len(stats), len(blobs))
+		}
+		for _, d := range blobs {
+			fi, err := image.StatBlob(img, d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if old, ok := stats[d]; !ok || !os.SameFile(old, fi) {
+				t.Errorf("blob %s was rewritten", d)
+			}
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package builder
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	progressbar "github.com/cheggaaa/pb"
@@ -15,42 +17,65 @@ import (
 	"github.com/containerd/continuity"
 	pb "github.com/containerd/continuity/proto"
 
+	"github.com/AkihiroSuda/filegrain/blobcompress"
+	"github.com/AkihiroSuda/filegrain/cdc"
 	"github.com/AkihiroSuda/filegrain/continuityutil"
 	"github.com/AkihiroSuda/filegrain/image"
 	"github.com/AkihiroSuda/filegrain/image/imageutil"
+	"github.com/AkihiroSuda/filegrain/layerutil"
+	"github.com/AkihiroSuda/filegrain/mtime"
 	"github.com/AkihiroSuda/filegrain/version"
 )
 
 type fromRootFSBuilder struct {
 	source string
+	// config is used as the base of the image config if non-nil.
+	config *spec.Image
+	opts   Options
+	// ownsSource is true if source is a temporary directory created by the builder.
+	// The files in such a source are hardlinked into the blobs directory rather than being copied.
+	ownsSource bool
 }
 
-func NewBuilderWithRootFS(source string) (Builder, error) {
+func NewBuilderWithRootFS(source string, opts Options) (Builder, error) {
 	_, err := image.ReadImageLayout(source)
 	if err == nil {
 		return nil, fmt.Errorf("source %q seems an OCI image, please specify a valid rootfs instead", source)
 	}
 	return &fromRootFSBuilder{
 		source: source,
+		opts:   opts,
 	}, nil
 }
 
 func (b *fromRootFSBuilder) Build(img, refName string) error {
 	logrus.Infof("Initializing %s as a FILEgrain image (Compatible to OCI Image Spec %s)", img, specs.Version)
-	if err := image.Init(img); err != nil {
+	if err := image.InitIfNotExistWithBlobsLayout(img, b.opts.BlobsLayout); err != nil {
+		return err
+	}
+	l, err := image.GetBlobsLayout(img)
+	if err != nil {
+		return err
+	}
+	if l != b.opts.BlobsLayout {
+		logrus.Warnf("Keeping the %s blobs layout of the existing image %s, use `filegrain convert` to change the layout", l, img)
+	}
+	logrus.Infof("Ingesting files in %s", b.source)
+	ing, err := ingestFiles(img, b.source, b.opts, b.ownsSource)
+	if err != nil {
 		return err
 	}
 	logrus.Infof("Building a continuity manifest against %s", b.source)
-	contM, err := buildContinuityManifest(b.source)
+	contM, err := buildContinuityManifest(b.source, ing)
 	if err != nil {
 		return err
 	}
-	logrus.Infof("Copying blobs")
-	contMDesc, err := putContinuityManifestBlobs(img, b.source, contM)
+	logrus.Infof("Putting blobs")
+	contMDesc, packLayers, err := putContinuityManifestBlobs(img, b.source, contM, b.opts)
 	if err != nil {
 		return err
 	}
-	imageMDesc, err := putImageManifestBlobs(img, contMDesc)
+	imageMDesc, err := putImageManifestBlobs(img, contMDesc, packLayers, b.config)
 	if err != nil {
 		return err
 	}
@@ -68,8 +93,10 @@ func (b *fromRootFSBuilder) Build(img, refName string) error {
 	return nil
 }
 
-func buildContinuityManifest(source string) (*continuity.Manifest, error) {
-	ctx, err := continuity.NewContext(source)
+// buildContinuityManifest builds the continuity manifest.
+// digester can be nil.
+func buildContinuityManifest(source string, digester continuity.Digester) (*continuity.Manifest, error) {
+	ctx, err := continuity.NewContextWithOptions(source, continuity.ContextOptions{Digester: digester})
 	if err != nil {
 		return nil, err
 	}
@@ -90,80 +117,291 @@ func continuityManifestToPB(m *continuity.Manifest) (*pb.Manifest, error) {
 }
 
 // puts rootfs blobs and continuity manifest blob.
-// returns the descriptor of the continuity manifest blob.
-func putContinuityManifestBlobs(img, source string, manifest *continuity.Manifest) (*spec.Descriptor, error) {
+// returns the descriptor of the continuity manifest blob, and the tar layers that contain the packed files.
+func putContinuityManifestBlobs(img, source string, manifest *continuity.Manifest, opts Options) (*spec.Descriptor, []packLayer, error) {
 	pbManifest, err := continuityManifestToPB(manifest)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	packLayers, err := packFiles(img, source, pbManifest, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	mtimeMap, err := buildMtimeMap(source, pbManifest)
+	if err != nil {
+		return nil, nil, err
+	}
+	reusable, err := loadReusableMaps(img)
+	if err != nil {
+		return nil, nil, err
+	}
+	maps := &blobMaps{reusable: reusable}
+	if opts.ChunkThreshold > 0 {
+		maps.chunkMap = cdc.NewMap()
+	}
+	if opts.Compression != layerutil.Uncompressed {
+		maps.compressionMap = blobcompress.NewMap()
 	}
 	bar := progressbar.StartNew(len(pbManifest.Resource))
-	for _, r := range pbManifest.Resource {
-		bar.Increment()
-		for _, ds := range r.Digest {
-			d, err := digest.Parse(ds)
-			if err != nil {
-				return nil, err // FIXME: can be skipped, generally
-			}
-			blobPath := filepath.Join(img, "blobs", string(d.Algorithm()), d.Hex())
-			if len(r.Path) == 0 {
-				return nil, fmt.Errorf("no path for %s", d)
-			}
-			blobSourcePath := filepath.Join(source, r.Path[0])
-			if err := copyFile(blobPath, blobSourcePath); err != nil {
-				return nil, err
+	ch := make(chan *pb.Resource)
+	var (
+		wg       sync.WaitGroup
+		firstErr error
+	)
+	for i := 0; i < opts.jobs(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range ch {
+				err := putResourceBlobs(img, source, r, opts, maps)
+				bar.Increment()
+				maps.mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				maps.mu.Unlock()
 			}
+		}()
+	}
+	for _, r := range pbManifest.Resource {
+		maps.mu.Lock()
+		failed := firstErr != nil
+		maps.mu.Unlock()
+		if failed {
+			break
 		}
+		ch <- r
 	}
+	close(ch)
+	wg.Wait()
 	bar.Finish()
+	if firstErr != nil {
+		return nil, nil, firstErr
+	}
+	chunkMap, compressionMap := maps.chunkMap, maps.compressionMap
 	manifestBytes, err := proto.Marshal(pbManifest)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	d, err := image.WriteBlob(img, manifestBytes)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return &spec.Descriptor{
+	desc := &spec.Descriptor{
 		MediaType: continuityutil.MediaTypeManifestV0Protobuf, // TODO: JSON
 		Digest:    d,
 		Size:      int64(len(manifestBytes)),
-	}, nil
+	}
+	desc.Annotations = make(map[string]string, 0)
+	if chunkMap != nil && len(chunkMap.Files) > 0 {
+		chunkMapDesc, err := imageutil.WriteJSONBlob(img, chunkMap, cdc.MediaType)
+		if err != nil {
+			return nil, nil, err
+		}
+		logrus.Infof("Chunk map: %s (%d files)", chunkMapDesc.Digest, len(chunkMap.Files))
+		desc.Annotations[cdc.Annotation] = chunkMapDesc.Digest.String()
+	}
+	if len(mtimeMap.Files) > 0 {
+		mtimeMapDesc, err := imageutil.WriteJSONBlob(img, mtimeMap, mtime.MediaType)
+		if err != nil {
+			return nil, nil, err
+		}
+		desc.Annotations[mtime.Annotation] = mtimeMapDesc.Digest.String()
+	}
+	if compressionMap != nil && len(compressionMap.Blobs) > 0 {
+		compressionMapDesc, err := imageutil.WriteJSONBlob(img, compressionMap, blobcompress.MediaType)
+		if err != nil {
+			return nil, nil, err
+		}
+		logrus.Infof("Compression map: %s (%d blobs)", compressionMapDesc.Digest, len(compressionMap.Blobs))
+		desc.Annotations[blobcompress.Annotation] = compressionMapDesc.Digest.String()
+	}
+	if len(desc.Annotations) == 0 {
+		desc.Annotations = nil
+	}
+	return desc, packLayers, nil
 }
 
-func copyFile(dst, src string) error {
-	r, err := os.Open(src)
+// buildMtimeMap records the mtimes of the resources, as continuity manifests lack the times.
+func buildMtimeMap(source string, pbManifest *pb.Manifest) (*mtime.Map, error) {
+	m := mtime.NewMap()
+	for _, r := range pbManifest.Resource {
+		if len(r.Path) == 0 {
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(source, r.Path[0]))
+		if err != nil {
+			return nil, err
+		}
+		m.Set(r.Path[0], fi.ModTime())
+	}
+	return m, nil
+}
+
+// blobMaps are the sidecar maps filled by the concurrent putResourceBlobs calls.
+type blobMaps struct {
+	mu sync.Mutex
+	// chunkMap is nil if chunking is disabled
+	chunkMap *cdc.Map
+	// compressionMap is nil if compression is disabled
+	compressionMap *blobcompress.Map
+	// reusable are the maps of the images already in the layout
+	reusable *reusableMaps
+}
+
+func (maps *blobMaps) addChunks(d digest.Digest, chunks []cdc.Chunk) {
+	maps.mu.Lock()
+	maps.chunkMap.Files[d] = chunks
+	maps.mu.Unlock()
+}
+
+func (maps *blobMaps) addCompressed(d digest.Digest, b blobcompress.Blob) {
+	maps.mu.Lock()
+	maps.compressionMap.Blobs[d] = b
+	maps.mu.Unlock()
+}
+
+// putResourceBlobs puts the blobs of the resource.
+// The blobs that already exist, e.g. ingested by ingestFiles, are skipped.
+func putResourceBlobs(img, source string, r *pb.Resource, opts Options, maps *blobMaps) error {
+	for _, ds := range r.Digest {
+		d, err := digest.Parse(ds)
+		if err != nil {
+			return err // FIXME: can be skipped, generally
+		}
+		if len(r.Path) == 0 {
+			return fmt.Errorf("no path for %s", d)
+		}
+		blobSourcePath := filepath.Join(source, r.Path[0])
+		if maps.chunkMap != nil && int64(r.Size) > opts.ChunkThreshold {
+			if chunks := maps.reusable.chunks(img, d, opts.Compression); chunks != nil {
+				for _, c := range chunks {
+					if cb := maps.reusable.compressed(img, c.Digest, opts.Compression); cb != nil {
+						maps.addCompressed(c.Digest, *cb)
+					}
+				}
+				maps.addChunks(d, chunks)
+				continue
+			}
+			chunks, err := putChunkBlobs(img, blobSourcePath, opts, maps)
+			if err != nil {
+				return err
+			}
+			maps.addChunks(d, chunks)
+			continue
+		}
+		if maps.compressionMap != nil {
+			if b := maps.reusable.compressed(img, d, opts.Compression); b != nil {
+				maps.addCompressed(d, *b)
+				continue
+			}
+			b, err := putCompressedFile(img, blobSourcePath, int64(r.Size), opts.Compression)
+			if err != nil {
+				return err
+			}
+			if b != nil {
+				maps.addCompressed(d, *b)
+				continue
+			}
+		}
+		if image.BlobExists(img, d) {
+			continue
+		}
+		ingested, err := image.IngestFile(img, blobSourcePath, false)
+		if err != nil {
+			return err
+		}
+		if ingested != d {
+			return fmt.Errorf("%s was modified during the build: expected %s, got %s", blobSourcePath, d, ingested)
+		}
+	}
+	return nil
+}
+
+// putChunkBlobs splits the file into content-defined chunks, and puts the chunks as blobs.
+// The chunks are compressed if maps.compressionMap is non-nil.
+func putChunkBlobs(img, path string, opts Options, maps *blobMaps) ([]cdc.Chunk, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer r.Close()
-	w, err := os.Create(dst)
+	defer f.Close()
+	chunker, err := cdc.NewChunker(f, opts.ChunkAvgSize)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	_, err = io.Copy(w, r)
-	closeErr := w.Close()
+	var chunks []cdc.Chunk
+	for {
+		b, err := chunker.Next()
+		if err == io.EOF {
+			return chunks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		d := digest.FromBytes(b)
+		chunks = append(chunks, cdc.Chunk{Digest: d, Size: int64(len(b))})
+		if maps.compressionMap != nil {
+			if cb := maps.reusable.compressed(img, d, opts.Compression); cb != nil {
+				maps.addCompressed(d, *cb)
+				continue
+			}
+			cb, err := putCompressedBlob(img, bytes.NewReader(b), int64(len(b)), opts.Compression)
+			if err != nil {
+				return nil, err
+			}
+			if cb != nil {
+				maps.addCompressed(d, *cb)
+				continue
+			}
+		}
+		if image.BlobExists(img, d) {
+			continue
+		}
+		if _, err := image.WriteBlob(img, b); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// putCompressedFile is similar to putCompressedBlob but reads the file at path.
+func putCompressedFile(img, path string, size int64, c layerutil.Compression) (*blobcompress.Blob, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return closeErr
+	defer f.Close()
+	return putCompressedBlob(img, f, size, c)
 }
 
 // puts image manifest blob and its deps (e.g. config).
+// baseConfig can be nil.
 // returns the descriptor of the image manifest blob.
-func putImageManifestBlobs(img string, continuityManifest *spec.Descriptor) (*spec.Descriptor, error) {
-	arch, os := "amd64", "linux" // FIXME
-	logrus.Warnf("Assuming OS/architecture to be %s/%s.", os, arch)
-	config := &spec.Image{
-		Architecture: arch,
-		OS:           os,
-		RootFS: spec.RootFS{
-			Type: "layers",
-			DiffIDs: []digest.Digest{
-				continuityManifest.Digest, // FIXME: ensure uncompressed
-			},
+func putImageManifestBlobs(img string, continuityManifest *spec.Descriptor, packLayers []packLayer, baseConfig *spec.Image) (*spec.Descriptor, error) {
+	var config spec.Image
+	if baseConfig != nil {
+		config = *baseConfig
+		// history entries refer to the layers of the source image
+		config.History = nil
+	} else {
+		arch, os := "amd64", "linux" // FIXME
+		logrus.Warnf("Assuming OS/architecture to be %s/%s.", os, arch)
+		config.Architecture = arch
+		config.OS = os
+	}
+	config.RootFS = spec.RootFS{
+		Type: "layers",
+		DiffIDs: []digest.Digest{
+			continuityManifest.Digest, // FIXME: ensure uncompressed
 		},
 	}
-	configDesc, err := imageutil.WriteJSONBlob(img, config, spec.MediaTypeImageConfig)
+	layers := []spec.Descriptor{*continuityManifest}
+	// packed files are applied on top of the directories in the continuity manifest
+	for _, l := range packLayers {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, l.diffID)
+		layers = append(layers, l.desc)
+	}
+	configDesc, err := imageutil.WriteJSONBlob(img, &config, spec.MediaTypeImageConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -172,9 +410,7 @@ func putImageManifestBlobs(img string, continuityManifest *spec.Descriptor) (*sp
 			SchemaVersion: 2,
 		},
 		Config: *configDesc,
-		Layers: []spec.Descriptor{
-			*continuityManifest,
-		},
+		Layers: layers,
 		Annotations: map[string]string{
 			version.VersionAnnotation: version.Version,
 		},
@@ -0,0 +1,242 @@
+package builder
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/AkihiroSuda/filegrain/layerutil"
+)
+
+// applyTarLayer applies the (uncompressed) tar layer to the rootfs directory.
+// Whiteouts are processed as specified in the OCI Image Spec.
+func applyTarLayer(rootfs string, r io.Reader) error {
+	tr := tar.NewReader(r)
+	// created contains the cleaned names of the entries extracted from this layer,
+	// so that opaque whiteouts do not remove them.
+	created := make(map[string]struct{}, 0)
+	var dirs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		dir, base := filepath.Split(name)
+		if base == layerutil.WhiteoutOpaqueDir {
+			if err := applyOpaqueWhiteout(rootfs, filepath.Clean(dir), created); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(base, layerutil.WhiteoutPrefix) {
+			p, err := securePath(rootfs, filepath.Join(dir, strings.TrimPrefix(base, layerutil.WhiteoutPrefix)))
+			if err != nil {
+				return err
+			}
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+			continue
+		}
+		p, err := securePath(rootfs, name)
+		if err != nil {
+			return err
+		}
+		extracted, err := extractTarEntry(rootfs, p, hdr, tr)
+		if err != nil {
+			return err
+		}
+		if !extracted {
+			continue
+		}
+		created[name] = struct{}{}
+		if hdr.Typeflag == tar.TypeDir {
+			// times of directories are set after extracting the children
+			dirs = append(dirs, hdr)
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		p, err := securePath(rootfs, filepath.Clean("/"+dirs[i].Name))
+		if err != nil {
+			return err
+		}
+		if err := setTimes(p, dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyOpaqueWhiteout removes the children of dir that were not created in the current layer.
+// The directories created in the current layer are processed recursively, as they may contain
+// the entries of the lower layers too.
+func applyOpaqueWhiteout(rootfs, dir string, created map[string]struct{}) error {
+	p, err := securePath(rootfs, dir)
+	if err != nil {
+		return err
+	}
+	fis, err := ioutil.ReadDir(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, fi := range fis {
+		child := filepath.Join(dir, fi.Name())
+		if _, ok := created[child]; ok {
+			if fi.IsDir() {
+				if err := applyOpaqueWhiteout(rootfs, child, created); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(p, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// securePath returns the path of name (cleaned, and relative to rootfs) on the host.
+// An error is returned if any parent of name is a symbolic link, so that
+// a malicious layer cannot write files outside of rootfs.
+func securePath(rootfs, name string) (string, error) {
+	p := rootfs
+	elems := strings.Split(strings.TrimPrefix(filepath.Clean("/"+name), "/"), "/")
+	for i, e := range elems {
+		p = filepath.Join(p, e)
+		if i == len(elems)-1 {
+			break
+		}
+		fi, err := os.Lstat(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to traverse symbolic link %s for %q", p, name)
+		}
+	}
+	return p, nil
+}
+
+// extractTarEntry extracts hdr to p.
+// Returns false if the entry was skipped.
+func extractTarEntry(rootfs, p string, hdr *tar.Header, r io.Reader) (bool, error) {
+	fi, err := os.Lstat(p)
+	if err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(p); err != nil {
+			return false, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return false, err
+	}
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(p, 0755); err != nil && !os.IsExist(err) {
+			return false, err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return false, err
+		}
+		_, err = io.Copy(f, r)
+		closeErr := f.Close()
+		if err != nil {
+			return false, err
+		}
+		if closeErr != nil {
+			return false, closeErr
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, p); err != nil {
+			return false, err
+		}
+	case tar.TypeLink:
+		target, err := securePath(rootfs, hdr.Linkname)
+		if err != nil {
+			return false, err
+		}
+		if err := os.Link(target, p); err != nil {
+			return false, err
+		}
+		// the metadata is shared with the target
+		return true, nil
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devMode := uint32(unix.S_IFIFO)
+		if hdr.Typeflag == tar.TypeChar {
+			devMode = unix.S_IFCHR
+		} else if hdr.Typeflag == tar.TypeBlock {
+			devMode = unix.S_IFBLK
+		}
+		dev := int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))
+		if err := unix.Mknod(p, devMode|uint32(mode.Perm()), dev); err != nil {
+			if os.Geteuid() != 0 {
+				logrus.Warnf("Skipping %q: mknod failed (running without root?): %v", hdr.Name, err)
+				return false, nil
+			}
+			return false, err
+		}
+	default:
+		logrus.Warnf("Skipping %q: unsupported tar entry type %q", hdr.Name, hdr.Typeflag)
+		return false, nil
+	}
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(p, hdr.Uid, hdr.Gid); err != nil {
+			return false, err
+		}
+	}
+	if hdr.Typeflag != tar.TypeSymlink {
+		// chmod after chown, as chown clears setuid bits
+		if err := os.Chmod(p, mode); err != nil {
+			return false, err
+		}
+	}
+	for k, v := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, layerutil.PAXSchilyXattr) {
+			continue
+		}
+		if err := unix.Lsetxattr(p, strings.TrimPrefix(k, layerutil.PAXSchilyXattr), []byte(v), 0); err != nil {
+			logrus.Warnf("Failed to set xattr %q on %q: %v", k, hdr.Name, err)
+		}
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		if err := setTimes(p, hdr); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func setTimes(p string, hdr *tar.Header) error {
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(atime.UnixNano()),
+		unix.NsecToTimespec(hdr.ModTime.UnixNano()),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, p, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,139 @@
+// Package cdc provides content-defined chunking of files, and the chunk map
+// that records the chunks of the files in a continuity manifest.
+//
+// The chunking algorithm is FastCDC (Xia, Wen, et al. USENIX ATC 2016) with normalized chunking.
+// As the cut points only depend on the content around them, inserting or removing bytes
+// in a file changes only the chunks around the modification, and the other chunks can be
+// shared across the versions of the file.
+package cdc
+
+import (
+	"errors"
+	"io"
+)
+
+const (
+	// DefaultAvgSize is the default average size of the chunks.
+	DefaultAvgSize = 1 << 20
+
+	minAvgSize = 256
+)
+
+// gear is the table for the gear hash.
+// The table must not be changed, as the cut points depend on it.
+var gear [256]uint64
+
+func init() {
+	// splitmix64 with a fixed seed
+	x := uint64(0x66696c656772616e) // "filegran"
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker splits a stream into content-defined chunks.
+// The chunks are between avg/4 and avg*8 bytes, except the last one.
+type Chunker struct {
+	r                io.Reader
+	minSize, avgSize int
+	maxSize          int
+	maskS, maskL     uint64
+	buf              []byte
+	start, end       int
+	eof              bool
+}
+
+// NewChunker returns a chunker for r.
+// avg is the average size of the chunks, and is rounded down to a power of two.
+// If avg is zero, DefaultAvgSize is used.
+func NewChunker(r io.Reader, avg int) (*Chunker, error) {
+	if avg == 0 {
+		avg = DefaultAvgSize
+	}
+	if avg < minAvgSize {
+		return nil, errors.New("cdc: average chunk size too small")
+	}
+	bits := uint(0)
+	for 1<<(bits+1) <= avg {
+		bits++
+	}
+	avg = 1 << bits
+	return &Chunker{
+		r:       r,
+		minSize: avg / 4,
+		avgSize: avg,
+		maxSize: avg * 8,
+		// more bits are checked before the average size, so that the chunks are unlikely to be small,
+		// and less bits are checked after the average size, so that the chunks are unlikely to be large.
+		maskS: topBits(bits + 2),
+		maskL: topBits(bits - 2),
+		buf:   make([]byte, avg*8),
+	}, nil
+}
+
+// topBits returns the mask of the n most significant bits.
+// The most significant bits of the gear hash depend on the preceding 64 bytes.
+func topBits(n uint) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// Next returns the next chunk.
+// The returned slice is valid only until the next call of Next.
+// Returns io.EOF after the last chunk.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.end-c.start < c.maxSize && !c.eof {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			c.eof = true
+		default:
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// cut returns the size of the chunk at the head of b.
+func (c *Chunker) cut(b []byte) int {
+	n := len(b)
+	if n <= c.minSize {
+		return n
+	}
+	if n > c.maxSize {
+		n = c.maxSize
+	}
+	normal := c.avgSize
+	if normal > n {
+		normal = n
+	}
+	var h uint64
+	i := c.minSize
+	for ; i < normal; i++ {
+		h = (h << 1) + gear[b[i]]
+		if h&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gear[b[i]]
+		if h&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,62 @@
+package cdc
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func testChunks(t *testing.T, b []byte, avg int) [][]byte {
+	c, err := NewChunker(bytes.NewReader(b), avg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var chunks [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+	return chunks
+}
+
+func TestChunker(t *testing.T) {
+	const avg = 4096
+	b := make([]byte, 1<<20)
+	rand.New(rand.NewSource(42)).Read(b)
+	chunks := testChunks(t, b, avg)
+	if !bytes.Equal(bytes.Join(chunks, nil), b) {
+		t.Fatal("chunks do not reassemble the content")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > avg*8 || (len(chunk) < avg/4 && i != len(chunks)-1) {
+			t.Errorf("chunk %d has unexpected size %d", i, len(chunk))
+		}
+	}
+	if n := len(b) / avg; len(chunks) < n/2 || len(chunks) > n*2 {
+		t.Errorf("expected about %d chunks, got %d", n, len(chunks))
+	}
+
+	// insert some bytes in the middle
+	modified := append(append(append([]byte(nil), b[:len(b)/2]...), "inserted"...), b[len(b)/2:]...)
+	seen := make(map[string]struct{}, 0)
+	for _, chunk := range chunks {
+		seen[string(chunk)] = struct{}{}
+	}
+	modifiedChunks := testChunks(t, modified, avg)
+	shared := 0
+	for _, chunk := range modifiedChunks {
+		if _, ok := seen[string(chunk)]; ok {
+			shared++
+		}
+	}
+	if shared < len(modifiedChunks)-3 {
+		t.Errorf("expected most chunks to be shared, got %d/%d", shared, len(modifiedChunks))
+	}
+}
@@ -0,0 +1,52 @@
+package cdc
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// Annotation is the annotation of a continuity manifest layer descriptor.
+	// The value is the digest of the chunk map blob.
+	Annotation = "filegrain.chunks"
+
+	// MediaType is the media type of the chunk map blob.
+	MediaType = "application/vnd.filegrain.chunks.v1+json"
+
+	Version = 1
+)
+
+type Chunk struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+}
+
+// Map is the chunk map.
+// The files in the map are stored as the chunk blobs, rather than the blobs of the whole contents.
+type Map struct {
+	Version int `json:"version"`
+	// Files is keyed by the digest of the whole content of a file.
+	Files map[digest.Digest][]Chunk `json:"files"`
+}
+
+// NewMap returns an empty chunk map.
+func NewMap() *Map {
+	return &Map{
+		Version: Version,
+		Files:   make(map[digest.Digest][]Chunk, 0),
+	}
+}
+
+// Unmarshal decodes the chunk map.
+func Unmarshal(b []byte) (*Map, error) {
+	var m Map
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	if m.Version != Version {
+		return nil, fmt.Errorf("unsupported chunk map version: %d", m.Version)
+	}
+	return &m, nil
+}
@@ -7,16 +7,31 @@ import (
 	"path/filepath"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-units"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/spf13/cobra"
 
 	"github.com/AkihiroSuda/filegrain/builder"
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/image/imageutil"
+	"github.com/AkihiroSuda/filegrain/layerutil"
+	"github.com/AkihiroSuda/filegrain/profile"
 )
 
 var (
 	buildCmdConfig struct {
-		refName    string
-		sourceType string
-		target     string
+		refName        string
+		sourceType     string
+		sourceRefName  string
+		target         string
+		profile        string
+		chunkThreshold string
+		chunkSize      string
+		compress       string
+		packThreshold  string
+		packDirs       []string
+		layout         string
+		jobs           int
 	}
 
 	BuildCmd = &cobra.Command{
@@ -30,13 +45,22 @@ var (
 				return errors.New("must specify source")
 			}
 			source := args[0]
-			b, err := newBuilder(buildCmdConfig.sourceType, source)
+			opts, err := builderOptions()
+			if err != nil {
+				return err
+			}
+			b, err := newBuilder(buildCmdConfig.sourceType, source, opts)
 			if err != nil {
 				return err
 			}
 			if err := b.Build(buildCmdConfig.target, buildCmdConfig.refName); err != nil {
 				return err
 			}
+			if buildCmdConfig.profile != "" {
+				if err := putPrefetchProfile(buildCmdConfig.target, buildCmdConfig.refName, buildCmdConfig.profile); err != nil {
+					return err
+				}
+			}
 			logrus.Info("Done")
 			return nil
 		},
@@ -47,9 +71,55 @@ func init() {
 	BuildCmd.Flags().StringVarP(&buildCmdConfig.target, "output", "o", "", "target output path")
 	BuildCmd.Flags().StringVar(&buildCmdConfig.refName, "tag", "latest", "tag (aka reference name)")
 	BuildCmd.Flags().StringVar(&buildCmdConfig.sourceType, "source-type", "auto", "source type (auto, oci-image, docker-image, rootfs)")
+	BuildCmd.Flags().StringVar(&buildCmdConfig.profile, "prefetch-profile", "", "prefetch profile recorded with filegrain mount --record-profile")
+	BuildCmd.Flags().StringVar(&buildCmdConfig.sourceRefName, "source-tag", "", "tag of the source OCI image (defaults to --tag)")
+	BuildCmd.Flags().StringVar(&buildCmdConfig.chunkThreshold, "chunk-threshold", "", "split the files larger than the threshold into content-defined chunks, e.g. 4M (defaults to disabled)")
+	BuildCmd.Flags().StringVar(&buildCmdConfig.chunkSize, "chunk-size", "1M", "average size of the content-defined chunks")
+	BuildCmd.Flags().StringVar(&buildCmdConfig.packThreshold, "pack-threshold", "", "pack the files not larger than the threshold into tar layers, e.g. 16K (defaults to disabled)")
+	BuildCmd.Flags().StringSliceVar(&buildCmdConfig.packDirs, "pack-dir", nil, "pack the files under the directory into tar layers, e.g. /usr/share/locale")
+	BuildCmd.Flags().StringVar(&buildCmdConfig.layout, "blobs-layout", "flat", "blobs layout (flat, sharded)")
+	BuildCmd.Flags().IntVarP(&buildCmdConfig.jobs, "jobs", "j", builder.DefaultJobs, "number of the files ingested concurrently")
+	BuildCmd.Flags().StringVar(&buildCmdConfig.compress, "compress", "", "compress the blobs of the files (gzip, zstd)")
 }
 
-func newBuilder(sourceType, source string) (builder.Builder, error) {
+func builderOptions() (builder.Options, error) {
+	var (
+		opts builder.Options
+		err  error
+	)
+	if buildCmdConfig.chunkThreshold != "" {
+		if opts.ChunkThreshold, err = units.RAMInBytes(buildCmdConfig.chunkThreshold); err != nil {
+			return opts, err
+		}
+		chunkSize, err := units.RAMInBytes(buildCmdConfig.chunkSize)
+		if err != nil {
+			return opts, err
+		}
+		opts.ChunkAvgSize = int(chunkSize)
+	}
+	if buildCmdConfig.packThreshold != "" {
+		if opts.PackThreshold, err = units.RAMInBytes(buildCmdConfig.packThreshold); err != nil {
+			return opts, err
+		}
+	}
+	opts.PackDirs = buildCmdConfig.packDirs
+	opts.Jobs = buildCmdConfig.jobs
+	if opts.BlobsLayout, err = image.ParseBlobsLayout(buildCmdConfig.layout); err != nil {
+		return opts, err
+	}
+	switch buildCmdConfig.compress {
+	case "", "none":
+	case "gzip":
+		opts.Compression = layerutil.Gzip
+	case "zstd":
+		opts.Compression = layerutil.Zstd
+	default:
+		return opts, fmt.Errorf("unknown compression: %s", buildCmdConfig.compress)
+	}
+	return opts, nil
+}
+
+func newBuilder(sourceType, source string, opts builder.Options) (builder.Builder, error) {
 	if sourceType == "auto" || sourceType == "" {
 		sourceType = guessSourceType(source)
 		if sourceType != "" {
@@ -60,11 +130,11 @@ func newBuilder(sourceType, source string) (builder.Builder, error) {
 	}
 	switch sourceType {
 	case "oci-image":
-		return builder.NewBuilderWithOCIImage(source)
+		return builder.NewBuilderWithOCIImage(source, buildCmdConfig.sourceRefName, opts)
 	case "docker-image":
-		return builder.NewBuilderWithDockerImage(source)
+		return builder.NewBuilderWithDockerImage(source, opts)
 	case "rootfs":
-		return builder.NewBuilderWithRootFS(source)
+		return builder.NewBuilderWithRootFS(source, opts)
 	}
 	return nil, fmt.Errorf("unknown source type: %s", sourceType)
 }
@@ -81,3 +151,28 @@ func guessSourceType(source string) string {
 	// FIXME: not accurate
 	return "docker-image"
 }
+
+// putPrefetchProfile stores the profile as a blob, and annotates the image manifest with the digest.
+func putPrefetchProfile(img, refName, profilePath string) error {
+	prof, err := profile.ReadFile(profilePath)
+	if err != nil {
+		return err
+	}
+	desc, err := imageutil.WriteJSONBlob(img, prof, profile.MediaType)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Prefetch profile: %s (%d entries)", desc.Digest, len(prof.Entries))
+	imageMDesc, err := imageutil.UpdateManifest(img, refName, func(m *spec.Manifest) error {
+		if m.Annotations == nil {
+			m.Annotations = make(map[string]string, 0)
+		}
+		m.Annotations[profile.Annotation] = desc.Digest.String()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Updated image manifest %s", imageMDesc.Digest)
+	return nil
+}
@@ -0,0 +1,46 @@
+package commands
+
+import (
+	"errors"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/AkihiroSuda/filegrain/image"
+)
+
+var (
+	convertCmdConfig struct {
+		layout string
+	}
+
+	ConvertCmd = &cobra.Command{
+		Use:   "convert --blobs-layout <layout> <image>",
+		Short: "Convert the blobs layout of a local OCI image layout",
+		Long: `Convert the blobs layout of a local OCI image layout.
+<layout> is either "flat" (blobs/sha256/deadbeef..) or "sharded" (blobs/sha256/de/deadbeef..).
+Interrupted conversions can be resumed by running the command again.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("must specify image")
+			}
+			img := args[0]
+			if !cmd.Flags().Changed("blobs-layout") {
+				return errors.New("must specify --blobs-layout")
+			}
+			l, err := image.ParseBlobsLayout(convertCmdConfig.layout)
+			if err != nil {
+				return err
+			}
+			if _, err := image.ReadImageLayout(img); err != nil {
+				return err
+			}
+			logrus.Infof("Converting the blobs layout of %s to %s", img, l)
+			return image.ConvertBlobsLayout(img, l)
+		},
+	}
+)
+
+func init() {
+	ConvertCmd.Flags().StringVar(&convertCmdConfig.layout, "blobs-layout", "", "blobs layout (flat, sharded)")
+}
@@ -0,0 +1,56 @@
+package commands
+
+import (
+	"errors"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+
+	"github.com/AkihiroSuda/filegrain/gc"
+	"github.com/AkihiroSuda/filegrain/image"
+)
+
+var (
+	gcCmdConfig struct {
+		dryRun bool
+	}
+
+	GCCmd = &cobra.Command{
+		Use:   "gc [--dry-run] <image>",
+		Short: "Delete the unreferenced blobs of a local OCI image layout",
+		Long: `Delete the blobs that are not referenced from the manifests in index.json of a local OCI image layout,
+and the temporary files left by interrupted builds.
+Do not run the command during building images into the layout.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("must specify image")
+			}
+			img := args[0]
+			if _, err := image.ReadImageLayout(img); err != nil {
+				return err
+			}
+			res, err := gc.Collect(img, gc.Options{DryRun: gcCmdConfig.dryRun})
+			if err != nil {
+				return err
+			}
+			verb := "Deleted"
+			if gcCmdConfig.dryRun {
+				verb = "Would delete"
+				for _, d := range res.Blobs {
+					logrus.Infof("Would delete blob %s", d)
+				}
+				for _, f := range res.TempFiles {
+					logrus.Infof("Would delete temporary file %s", f)
+				}
+			}
+			logrus.Infof("%s %d blobs and %d temporary files, reclaiming %s",
+				verb, len(res.Blobs), len(res.TempFiles), units.HumanSize(float64(res.Reclaimed)))
+			return nil
+		},
+	}
+)
+
+func init() {
+	GCCmd.Flags().BoolVar(&gcCmdConfig.dryRun, "dry-run", false, "report the blobs to be deleted without deleting them")
+}
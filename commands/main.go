@@ -30,4 +30,9 @@ func init() {
 	MainCmd.PersistentFlags().BoolVar(&mainCmdConfig.debug, "debug", false, "debug")
 	MainCmd.AddCommand(MountCmd)
 	MainCmd.AddCommand(BuildCmd)
+	MainCmd.AddCommand(PullCmd)
+	MainCmd.AddCommand(PushCmd)
+	MainCmd.AddCommand(ConvertCmd)
+	MainCmd.AddCommand(GCCmd)
+	MainCmd.AddCommand(VerifyCmd)
 }
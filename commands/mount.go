@@ -5,36 +5,90 @@ import (
 	"io/ioutil"
 	"os"
 	"os/signal"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-units"
 	"github.com/spf13/cobra"
 
+	"github.com/AkihiroSuda/filegrain/image"
 	"github.com/AkihiroSuda/filegrain/lazyfs"
+	"github.com/AkihiroSuda/filegrain/profile"
 	"github.com/AkihiroSuda/filegrain/puller"
+	"github.com/AkihiroSuda/filegrain/registry"
 )
 
 var (
 	mountCmdConfig struct {
 		debugFUSE bool
 		refName   string
+		plainHTTP bool
+		cacheDir  string
+		cacheSize string
+		verify    bool
+		retries   int
+		profile   string
+		prefetch  []string
+		workers   int
+		chunkSize string
+		layout    string
+		allowDev  bool
+		allowSUID bool
 	}
 
 	MountCmd = &cobra.Command{
 		Use:   "mount <image> <mountpoint>",
 		Short: "Mount with lazy fs",
+		Long: `Mount with lazy fs.
+<image> is either a local OCI image layout directory, an HTTP(S) URL of an OCI image layout
+like "https://example.com/images/foo", or a registry reference like "registry.example.com/foo:tag".`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			if len(args) != 2 {
 				return errors.New("must specify image and mountpoint")
 			}
 			img, mountpoint := args[0], args[1]
-			cachePath, err := ioutil.TempDir("", "filegrain-blobcache")
+			cachePath := mountCmdConfig.cacheDir
+			if cachePath == "" {
+				tmp, err := ioutil.TempDir("", "filegrain-blobcache")
+				if err != nil {
+					return err
+				}
+				logrus.Infof("Blob cache (ephemeral): %s", tmp)
+				defer os.RemoveAll(tmp) // FIXME
+				cachePath = tmp
+			} else {
+				if err := os.MkdirAll(cachePath, 0700); err != nil {
+					return err
+				}
+				logrus.Infof("Blob cache: %s", cachePath)
+			}
+			upstream, ref, err := newPuller(img, mountCmdConfig.plainHTTP)
 			if err != nil {
 				return err
 			}
-			logrus.Infof("Blob cache (ephemeral): %s", cachePath)
-			defer os.RemoveAll(cachePath) // FIXME
-			pvller, err := puller.NewBlobCacher(cachePath,
-				puller.NewLocalPuller())
+			refName := mountCmdConfig.refName
+			if ref != nil && !cmd.Flags().Changed("tag") {
+				refName = ref.Object()
+			}
+			cacherOpts := puller.BlobCacherOptions{
+				VerifyOnLoad:        mountCmdConfig.verify,
+				Retries:             mountCmdConfig.retries,
+				PrefetchConcurrency: mountCmdConfig.workers,
+			}
+			if mountCmdConfig.cacheSize != "" {
+				if cacherOpts.MaxBytes, err = units.RAMInBytes(mountCmdConfig.cacheSize); err != nil {
+					return err
+				}
+			}
+			if cacherOpts.BlobsLayout, err = image.ParseBlobsLayout(mountCmdConfig.layout); err != nil {
+				return err
+			}
+			if mountCmdConfig.chunkSize != "" {
+				if cacherOpts.ChunkSize, err = units.RAMInBytes(mountCmdConfig.chunkSize); err != nil {
+					return err
+				}
+			}
+			pvller, err := puller.NewBlobCacher(cachePath, upstream, cacherOpts)
 			if err != nil {
 				return err
 			}
@@ -42,9 +96,24 @@ var (
 				Mountpoint: mountpoint,
 				Puller:     pvller,
 				Image:      img,
-				RefName:    mountCmdConfig.refName,
+				RefName:    refName,
+				// files larger than a chunk are read by chunks
+				RangeThreshold: cacherOpts.ChunkSize,
+				AllowDev:       mountCmdConfig.allowDev,
+				AllowSUID:      mountCmdConfig.allowSUID,
+			}
+			if mountCmdConfig.profile != "" {
+				opts.Recorder = profile.NewRecorder()
+			}
+			if err := serve(opts); err != nil {
+				return err
 			}
-			return serve(opts)
+			if opts.Recorder != nil {
+				prof := opts.Recorder.Profile()
+				logrus.Infof("Writing the profile (%d entries) to %s", len(prof.Entries), mountCmdConfig.profile)
+				return prof.WriteFile(mountCmdConfig.profile)
+			}
+			return nil
 		},
 	}
 )
@@ -52,6 +121,38 @@ var (
 func init() {
 	MountCmd.Flags().StringVar(&mountCmdConfig.refName, "tag", "latest", "tag (aka reference name)")
 	MountCmd.Flags().BoolVar(&mountCmdConfig.debugFUSE, "debug-fuse", false, "debug FUSE")
+	MountCmd.Flags().StringVar(&mountCmdConfig.cacheDir, "cache-dir", "", "persistent blob cache directory (defaults to an ephemeral directory)")
+	MountCmd.Flags().StringVar(&mountCmdConfig.cacheSize, "cache-size", "", "soft limit of the blob cache size, e.g. 10G (defaults to unlimited)")
+	MountCmd.Flags().StringVar(&mountCmdConfig.chunkSize, "chunk-size", "1M", "size of the chunks for reading large files partially")
+	MountCmd.Flags().StringVar(&mountCmdConfig.layout, "cache-blobs-layout", "flat", "layout of the blobs in --cache-dir (flat, sharded)")
+	MountCmd.Flags().BoolVar(&mountCmdConfig.verify, "cache-verify", false, "verify the digests of the blobs in --cache-dir on startup")
+	MountCmd.Flags().IntVar(&mountCmdConfig.retries, "retries", 3, "number of retries on blob pull failures")
+	MountCmd.Flags().StringVar(&mountCmdConfig.profile, "record-profile", "", "record the accesses to the file on unmounting, for filegrain build --prefetch-profile")
+	MountCmd.Flags().StringSliceVar(&mountCmdConfig.prefetch, "prefetch", nil, "prefetch the files under the paths in background (e.g. \"/\" for the whole image)")
+	MountCmd.Flags().IntVar(&mountCmdConfig.workers, "prefetch-workers", puller.DefaultPrefetchConcurrency, "number of the workers for prefetching")
+	MountCmd.Flags().BoolVar(&mountCmdConfig.allowDev, "allow-dev", false, "allow opening the device nodes in the image (requires root)")
+	MountCmd.Flags().BoolVar(&mountCmdConfig.allowSUID, "allow-suid", false, "honor the setuid and setgid bits in the image (requires root)")
+	MountCmd.Flags().BoolVar(&mountCmdConfig.plainHTTP, "plain-http", false, "use plain HTTP rather than HTTPS for the registry")
+}
+
+// newPuller returns LocalPuller if img is an existing directory, HTTPPuller if img is
+// an HTTP(S) URL, otherwise RegistryPuller.
+// The parsed reference is also returned for RegistryPuller.
+func newPuller(img string, plainHTTP bool) (puller.Puller, *registry.Reference, error) {
+	if st, err := os.Stat(img); err == nil && st.IsDir() {
+		return puller.NewLocalPuller(), nil, nil
+	}
+	if strings.HasPrefix(img, "http://") || strings.HasPrefix(img, "https://") {
+		return puller.NewHTTPPuller(nil), nil, nil
+	}
+	ref, err := registry.ParseReference(img)
+	if err != nil {
+		return nil, nil, err
+	}
+	logrus.Infof("Pulling %s from the registry", ref)
+	client := registry.NewClient()
+	client.PlainHTTP = plainHTTP
+	return puller.NewRegistryPuller(client), ref, nil
 }
 
 func serve(opts lazyfs.Options) error {
@@ -59,6 +160,11 @@ func serve(opts lazyfs.Options) error {
 	if err != nil {
 		return err
 	}
+	for _, p := range mountCmdConfig.prefetch {
+		if err := fs.Prefetch(p); err != nil {
+			return err
+		}
+	}
 	sv, err := lazyfs.NewServer(fs)
 	if err != nil {
 		return err
@@ -0,0 +1,189 @@
+package commands
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	progressbar "github.com/cheggaaa/pb"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/puller"
+	"github.com/AkihiroSuda/filegrain/walker"
+)
+
+var (
+	pullCmdConfig struct {
+		refName   string
+		jobs      int
+		plainHTTP bool
+	}
+
+	PullCmd = &cobra.Command{
+		Use:   "pull <source> <target>",
+		Short: "Pull all the blobs of an image into a local OCI image layout",
+		Long: `Pull all the blobs of an image into a local OCI image layout.
+<source> is either a local OCI image layout directory, an HTTP(S) URL of an OCI image layout
+like "https://example.com/images/foo", or a registry reference like "registry.example.com/foo:tag".
+<target> is created if it does not exist.
+Interrupted pulls can be resumed by running the command again, as existing blobs in <target> are skipped.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return errors.New("must specify source and target")
+			}
+			src, dst := args[0], args[1]
+			p, _, err := newPuller(src, pullCmdConfig.plainHTTP)
+			if err != nil {
+				return err
+			}
+			return pull(p, src, dst, pullCmdConfig.refName, pullCmdConfig.jobs)
+		},
+	}
+)
+
+func init() {
+	PullCmd.Flags().StringVar(&pullCmdConfig.refName, "tag", "", "tag (aka reference name) to pull (defaults to all the tags)")
+	PullCmd.Flags().IntVarP(&pullCmdConfig.jobs, "jobs", "j", 4, "number of the concurrent pulls")
+	PullCmd.Flags().BoolVar(&pullCmdConfig.plainHTTP, "plain-http", false, "use plain HTTP rather than HTTPS for the registry")
+}
+
+func pull(p puller.Puller, src, dst, refName string, jobs int) error {
+	idx, err := p.PullIndex(src)
+	if err != nil {
+		return err
+	}
+	var manifests []spec.Descriptor
+	for _, m := range idx.Manifests {
+		if refName == "" || m.Annotations[image.RefNameAnnotation] == refName {
+			manifests = append(manifests, m)
+		}
+	}
+	if len(manifests) == 0 {
+		return fmt.Errorf("unknown reference name: %q", refName)
+	}
+	if err := image.InitIfNotExist(dst); err != nil {
+		return err
+	}
+	// remove the garbage of the previous interrupted pull
+	if err := image.RemoveTempBlobs(dst); err != nil {
+		return err
+	}
+	logrus.Infof("Walking %s", src)
+	var descs []spec.Descriptor
+	// the manifests and the sidecars are verified before being parsed
+	if err := walker.Walk(puller.NewVerifyingPuller(p, 0), src, manifests, func(desc spec.Descriptor) error {
+		descs = append(descs, desc)
+		return nil
+	}); err != nil {
+		return err
+	}
+	logrus.Infof("Pulling %d blobs", len(descs))
+	if err := pullBlobs(p, src, dst, descs, jobs); err != nil {
+		return err
+	}
+	// update the index after pulling all the blobs, so that the index never refers to missing blobs
+	for _, m := range manifests {
+		if err := image.PutManifestDescriptorToIndex(dst, &m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func pullBlobs(p puller.Puller, src, dst string, descs []spec.Descriptor, jobs int) error {
+	if jobs <= 0 {
+		jobs = 1
+	}
+	bar := progressbar.StartNew(len(descs))
+	ch := make(chan spec.Descriptor)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		skipped  int
+	)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for desc := range ch {
+				pulled, err := pullBlob(p, src, dst, desc)
+				bar.Increment()
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if !pulled {
+					skipped++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, desc := range descs {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		ch <- desc
+	}
+	close(ch)
+	wg.Wait()
+	bar.Finish()
+	if firstErr != nil {
+		return firstErr
+	}
+	logrus.Infof("Pulled %d blobs (skipped %d existing blobs)", len(descs)-skipped, skipped)
+	return nil
+}
+
+// pullBlob pulls the blob unless dst already has the blob.
+// Returns false if the blob is skipped.
+func pullBlob(p puller.Puller, src, dst string, desc spec.Descriptor) (bool, error) {
+	if err := image.VerifyBlob(dst, desc.Digest); err == nil {
+		return false, nil
+	}
+	r, err := p.PullBlob(src, desc.Digest)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	w, err := image.NewBlobWriter(dst, desc.Digest.Algorithm())
+	if err != nil {
+		return false, err
+	}
+	// the sidecars referenced from the annotations lack the sizes
+	limit := desc.Size
+	if limit <= 0 {
+		limit = puller.DefaultMaxSize
+	}
+	// read an extra byte to detect the excess, without filling the disk
+	n, err := io.Copy(w, io.LimitReader(r, limit+1))
+	if err != nil {
+		w.Abort()
+		return false, fmt.Errorf("error while pulling %s: %v", desc.Digest, err)
+	}
+	if n > limit {
+		w.Abort()
+		return false, fmt.Errorf("blob %s exceeds the size limit %d", desc.Digest, limit)
+	}
+	if d := w.WrittenDigest(); d != desc.Digest {
+		w.Abort()
+		return false, fmt.Errorf("expected %s, got %s", desc.Digest, d)
+	}
+	if desc.Size > 0 && n != desc.Size {
+		w.Abort()
+		return false, fmt.Errorf("expected %d bytes for %s, got %d", desc.Size, desc.Digest, n)
+	}
+	if err := w.Close(); err != nil {
+		w.Abort()
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,73 @@
+package commands
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+
+	"github.com/AkihiroSuda/filegrain/pusher"
+	"github.com/AkihiroSuda/filegrain/registry"
+)
+
+var (
+	pushCmdConfig struct {
+		jobs      int
+		chunkSize string
+		mountFrom []string
+		plainHTTP bool
+	}
+
+	PushCmd = &cobra.Command{
+		Use:   "push <image>[:<tag>] <registry-ref>",
+		Short: "Push an image to a registry",
+		Long: `Push an image in a local OCI image layout to a registry, e.g. "filegrain push /tmp/filegrain-image:latest registry.example.com/foo:tag".
+All the blobs, including the file blobs referenced from the continuity manifests, are uploaded, unless the registry already has them.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 2 {
+				return errors.New("must specify image and registry reference")
+			}
+			img, refName := splitImageTag(args[0])
+			ref, err := registry.ParseReference(args[1])
+			if err != nil {
+				return err
+			}
+			chunkSize, err := units.RAMInBytes(pushCmdConfig.chunkSize)
+			if err != nil {
+				return err
+			}
+			client := registry.NewClient()
+			client.PlainHTTP = pushCmdConfig.plainHTTP
+			opts := pusher.Options{
+				Client:    client,
+				Jobs:      pushCmdConfig.jobs,
+				ChunkSize: chunkSize,
+				MountFrom: pushCmdConfig.mountFrom,
+				Progress:  true,
+			}
+			if err := pusher.Push(img, refName, ref, opts); err != nil {
+				return err
+			}
+			logrus.Info("Done")
+			return nil
+		},
+	}
+)
+
+func init() {
+	PushCmd.Flags().IntVarP(&pushCmdConfig.jobs, "jobs", "j", pusher.DefaultJobs, "number of the concurrent uploads")
+	PushCmd.Flags().StringVar(&pushCmdConfig.chunkSize, "chunk-size", "32M", "upload blobs larger than this size in chunks")
+	PushCmd.Flags().StringSliceVar(&pushCmdConfig.mountFrom, "mount-from", nil, "repositories on the same registry to mount blobs from")
+	PushCmd.Flags().BoolVar(&pushCmdConfig.plainHTTP, "plain-http", false, "use plain HTTP rather than HTTPS for the registry")
+}
+
+// splitImageTag splits "/tmp/filegrain-image:latest" into "/tmp/filegrain-image" and "latest".
+// The tag defaults to "latest".
+func splitImageTag(s string) (string, string) {
+	if i := strings.LastIndex(s, ":"); i > strings.LastIndex(s, "/") {
+		return s[:i], s[i+1:]
+	}
+	return s, "latest"
+}
@@ -0,0 +1,66 @@
+package commands
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/verify"
+)
+
+var (
+	verifyCmdConfig struct {
+		refName string
+		json    bool
+	}
+
+	VerifyCmd = &cobra.Command{
+		Use:     "verify [--tag <tag>] [--json] <image>",
+		Aliases: []string{"fsck"},
+		Short:   "Verify the integrity of a local OCI image layout",
+		Long: `Verify the integrity of a local OCI image layout.
+The blobs referenced from index.json are re-hashed, and the sizes and the media types are checked.
+Missing, corrupt, and orphaned blobs are reported, and the command exits with non-zero status.
+Orphaned blobs are not reported when --tag is specified.`,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) != 1 {
+				return errors.New("must specify image")
+			}
+			img := args[0]
+			if _, err := image.ReadImageLayout(img); err != nil {
+				return err
+			}
+			report, err := verify.Verify(img, verify.Options{RefName: verifyCmdConfig.refName})
+			if err != nil {
+				return err
+			}
+			if verifyCmdConfig.json {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(report); err != nil {
+					return err
+				}
+			} else {
+				for _, p := range report.Problems {
+					fmt.Println(p)
+				}
+			}
+			logrus.Infof("Verified %d blobs, found %d problems", report.Verified, len(report.Problems))
+			if len(report.Problems) > 0 {
+				return fmt.Errorf("found %d problems in %s", len(report.Problems), img)
+			}
+			return nil
+		},
+	}
+)
+
+func init() {
+	VerifyCmd.Flags().StringVar(&verifyCmdConfig.refName, "tag", "", "verify only the image with the tag (aka reference name)")
+	VerifyCmd.Flags().BoolVar(&verifyCmdConfig.json, "json", false, "print the report in JSON")
+}
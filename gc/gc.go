@@ -0,0 +1,88 @@
+// Package gc implements the mark-and-sweep garbage collection of the blobs of a local image.
+package gc
+
+import (
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/puller"
+	"github.com/AkihiroSuda/filegrain/walker"
+)
+
+type Options struct {
+	// DryRun reports the garbage without deleting.
+	DryRun bool
+}
+
+// Result is the result of Collect.
+type Result struct {
+	// Blobs are the blobs not referenced from the index.
+	Blobs []digest.Digest
+	// TempFiles are the temporary files left by image.BlobWriter.
+	TempFiles []string
+	// Reclaimed is the total size of Blobs and TempFiles in bytes.
+	Reclaimed int64
+}
+
+// Collect deletes the blobs that are not reachable from the manifests in the index of img,
+// and the temporary files left by image.BlobWriter.
+// Collect must not be executed during building images into img, as the blobs being written are deleted.
+func Collect(img string, opts Options) (*Result, error) {
+	idx, err := image.ReadIndex(img)
+	if err != nil {
+		return nil, err
+	}
+	// mark
+	marked := make(map[digest.Digest]struct{}, 0)
+	if err := walker.Walk(puller.NewLocalPuller(), img, idx.Manifests, func(desc spec.Descriptor) error {
+		marked[desc.Digest] = struct{}{}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	logrus.Debugf("Marked %d blobs", len(marked))
+	// sweep
+	blobs, err := image.ListBlobs(img)
+	if err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	for _, d := range blobs {
+		if _, ok := marked[d]; ok {
+			continue
+		}
+		fi, err := image.StatBlob(img, d)
+		if err != nil {
+			return nil, err
+		}
+		if !opts.DryRun {
+			if err := image.DeleteBlob(img, d); err != nil {
+				return nil, err
+			}
+		}
+		res.Blobs = append(res.Blobs, d)
+		res.Reclaimed += fi.Size()
+	}
+	tempFiles, err := image.ListTempBlobs(img)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range tempFiles {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		if !opts.DryRun {
+			if err := os.Remove(f); err != nil {
+				return nil, err
+			}
+		}
+		res.TempFiles = append(res.TempFiles, f)
+		res.Reclaimed += fi.Size()
+	}
+	return res, nil
+}
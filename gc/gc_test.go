@@ -0,0 +1,81 @@
+package gc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/AkihiroSuda/filegrain/builder"
+	"github.com/AkihiroSuda/filegrain/image"
+)
+
+func TestCollect(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filegrain-test-gc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	rootfs, img := filepath.Join(tmpDir, "rootfs"), filepath.Join(tmpDir, "img")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// build "old" twice, so that the first one becomes garbage
+	for i, content := range []string{"old1", "old2"} {
+		if err := ioutil.WriteFile(filepath.Join(rootfs, "file"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// make sure that the mtime map differs
+		mt := time.Unix(int64(i), 0)
+		if err := os.Chtimes(filepath.Join(rootfs, "file"), mt, mt); err != nil {
+			t.Fatal(err)
+		}
+		b, err := builder.NewBuilderWithRootFS(rootfs, builder.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := b.Build(img, "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bw, err := image.NewBlobWriter(img, digest.Canonical)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bw.Write([]byte("interrupted")); err != nil {
+		t.Fatal(err)
+	}
+	garbage, live := digest.FromString("old1"), digest.FromString("old2")
+
+	res, err := Collect(img, Options{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the file, the mtime map, the continuity manifest, the config, and the manifest
+	if len(res.Blobs) != 5 || len(res.TempFiles) != 1 || res.Reclaimed == 0 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+	if !image.BlobExists(img, garbage) {
+		t.Fatal("dry run should not delete blobs")
+	}
+
+	if _, err := Collect(img, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if image.BlobExists(img, garbage) || !image.BlobExists(img, live) {
+		t.Fatal("unexpected blobs after gc")
+	}
+	if tempFiles, _ := image.ListTempBlobs(img); len(tempFiles) != 0 {
+		t.Fatalf("unexpected temporary files: %v", tempFiles)
+	}
+	res, err = Collect(img, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Blobs) != 0 || len(res.TempFiles) != 0 {
+		t.Fatalf("unexpected result: %+v", res)
+	}
+}
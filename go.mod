@@ -9,11 +9,12 @@ require (
 	github.com/docker/go-units v0.3.2
 	github.com/golang/protobuf v0.0.0-20170427213220-18c9bb326172
 	github.com/hanwen/go-fuse v0.0.0-20170424203904-5404bf0e372d
+	github.com/klauspost/compress v1.11.13
 	github.com/mattn/go-runewidth v0.0.2
 	github.com/opencontainers/go-digest v1.0.0-rc0
 	github.com/opencontainers/image-spec v0.0.0-20170501194034-c87455c1b399
 	github.com/pkg/errors v0.8.0
 	github.com/spf13/cobra v0.0.0-20170501210834-69f86e6d5d7a
 	github.com/spf13/pflag v0.0.0-20170427125145-f1d95a35e132
-	golang.org/x/sys v0.0.0-20190606203320-7fc4e5ec1444 // indirect
+	golang.org/x/sys v0.0.0-20190606203320-7fc4e5ec1444
 )
@@ -0,0 +1,206 @@
+// Package gzindex provides random access to gzip streams, using the
+// access points recorded while decompressing the whole stream once.
+//
+// The design follows zran.c from the zlib distribution: an access point
+// holds the position of a deflate block boundary and the preceding 32KiB
+// of the uncompressed data, so that decompression can be resumed from there.
+package gzindex
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+const (
+	// IndexAnnotation is the annotation of a gzip layer descriptor.
+	// The value is the digest of the sidecar blob that contains the marshalled Index.
+	IndexAnnotation = "filegrain.gzip.index"
+
+	// DefaultSpan is the default distance between the access points in the uncompressed stream.
+	DefaultSpan = 1 << 20
+
+	magic = "filegrain.gzindex.v1"
+)
+
+type AccessPoint struct {
+	// UncompressedOffset is the offset in the uncompressed stream.
+	UncompressedOffset int64
+	// CompressedOffset is the offset of the byte that contains the first bit of the deflate block.
+	CompressedOffset int64
+	// Bits is the number of bits to skip in the byte at CompressedOffset.
+	Bits uint8
+	// Window is the uncompressed data preceding the access point in the same gzip member.
+	// Up to 32KiB.
+	Window []byte
+}
+
+type Index struct {
+	// Points are sorted by UncompressedOffset.
+	// The start of each gzip member is always recorded as an access point.
+	Points           []AccessPoint
+	UncompressedSize int64
+}
+
+// BuildIndex decompresses r and returns the index with the access points
+// at every span bytes in the uncompressed stream.
+// The uncompressed stream is written to w, if w is non-nil.
+func BuildIndex(r io.Reader, span int64, w io.Writer) (*Index, error) {
+	if span <= 0 {
+		span = DefaultSpan
+	}
+	f := &inflater{
+		r:    bufio.NewReader(r),
+		w:    w,
+		span: span,
+	}
+	if err := f.run(false); err != nil {
+		return nil, err
+	}
+	return &Index{
+		Points:           f.points,
+		UncompressedSize: f.total,
+	}, nil
+}
+
+// NewReader returns the uncompressed stream from the offset off.
+// r is the compressed stream, and must not be used until the returned reader is closed.
+// At most the span bytes are decompressed and discarded for seeking to off.
+func (idx *Index) NewReader(r io.ReadSeeker, off int64) (io.ReadCloser, error) {
+	if off < 0 || off > idx.UncompressedSize {
+		return nil, fmt.Errorf("gzindex: offset %d out of range", off)
+	}
+	if len(idx.Points) == 0 {
+		return nil, errors.New("gzindex: no access point")
+	}
+	i := sort.Search(len(idx.Points), func(i int) bool {
+		return idx.Points[i].UncompressedOffset > off
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+	p := idx.Points[i]
+	if _, err := r.Seek(p.CompressedOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	f := &inflater{
+		r:           bufio.NewReader(r),
+		pos:         p.CompressedOffset,
+		w:           pw,
+		out:         append(make([]byte, 0, flushSize), p.Window...),
+		total:       p.UncompressedOffset,
+		memberStart: p.UncompressedOffset - int64(len(p.Window)),
+		partial:     true,
+		discard:     off - p.UncompressedOffset,
+	}
+	f.wpos = len(f.out)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := f.bits(uint(p.Bits)); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(f.run(true))
+	}()
+	return &reader{PipeReader: pr, done: done}, nil
+}
+
+type reader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// Close closes the reader and waits for the inflater to stop reading the compressed stream.
+func (r *reader) Close() error {
+	err := r.PipeReader.Close()
+	<-r.done
+	return err
+}
+
+// MarshalBinary encodes the index as a gzip-compressed binary.
+func (idx *Index) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	w := bufio.NewWriter(zw)
+	var tmp [binary.MaxVarintLen64]byte
+	putUvarint := func(x uint64) {
+		n := binary.PutUvarint(tmp[:], x)
+		w.Write(tmp[:n])
+	}
+	w.WriteString(magic)
+	putUvarint(uint64(idx.UncompressedSize))
+	putUvarint(uint64(len(idx.Points)))
+	for _, p := range idx.Points {
+		putUvarint(uint64(p.UncompressedOffset))
+		putUvarint(uint64(p.CompressedOffset))
+		w.WriteByte(p.Bits)
+		putUvarint(uint64(len(p.Window)))
+		w.Write(p.Window)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes the index encoded by MarshalBinary.
+func (idx *Index) UnmarshalBinary(b []byte) error {
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(zr)
+	m := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, m); err != nil || string(m) != magic {
+		return errors.New("gzindex: invalid index")
+	}
+	var x [2]uint64
+	readUvarints := func(n int) error {
+		for i := 0; i < n; i++ {
+			v, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			x[i] = v
+		}
+		return nil
+	}
+	if err := readUvarints(2); err != nil {
+		return err
+	}
+	idx.UncompressedSize = int64(x[0])
+	n := x[1]
+	idx.Points = nil
+	for i := uint64(0); i < n; i++ {
+		var p AccessPoint
+		if err := readUvarints(2); err != nil {
+			return err
+		}
+		p.UncompressedOffset, p.CompressedOffset = int64(x[0]), int64(x[1])
+		if p.Bits, err = r.ReadByte(); err != nil {
+			return err
+		}
+		if err := readUvarints(1); err != nil {
+			return err
+		}
+		if x[0] > windowSize {
+			return errors.New("gzindex: invalid window size")
+		}
+		p.Window = make([]byte, x[0])
+		if _, err := io.ReadFull(r, p.Window); err != nil {
+			return err
+		}
+		idx.Points = append(idx.Points, p)
+	}
+	return nil
+}
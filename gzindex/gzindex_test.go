@@ -0,0 +1,99 @@
+package gzindex
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func testData(size int) []byte {
+	rnd := rand.New(rand.NewSource(42))
+	words := []string{"foo", "bar", "baz", "filegrain", "continuity", "\n", " ", "\x00"}
+	var buf bytes.Buffer
+	for buf.Len() < size {
+		if rnd.Intn(10) == 0 {
+			b := make([]byte, rnd.Intn(512))
+			rnd.Read(b)
+			buf.Write(b)
+			continue
+		}
+		buf.WriteString(words[rnd.Intn(len(words))])
+	}
+	return buf.Bytes()[:size]
+}
+
+func testGzip(t *testing.T, level int, members ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, m := range members {
+		zw, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zw.Name = "test"
+		if _, err := zw.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestIndex(t *testing.T) {
+	data := testData(3 << 20)
+	cases := map[string][]byte{
+		"default":     testGzip(t, gzip.DefaultCompression, data),
+		"best-speed":  testGzip(t, gzip.BestSpeed, data),
+		"huffman":     testGzip(t, gzip.HuffmanOnly, data),
+		"stored":      testGzip(t, gzip.NoCompression, data),
+		"multimember": testGzip(t, gzip.DefaultCompression, data[:1<<20], data[1<<20:1<<20], data[1<<20:]),
+	}
+	for name, gz := range cases {
+		var out bytes.Buffer
+		idx, err := BuildIndex(bytes.NewReader(gz), 1<<16, &out)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Fatalf("%s: unexpected output", name)
+		}
+		if len(idx.Points) < 2 {
+			t.Fatalf("%s: expected multiple access points, got %d", name, len(idx.Points))
+		}
+		b, err := idx.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var idx2 Index
+		if err := idx2.UnmarshalBinary(b); err != nil {
+			t.Fatal(err)
+		}
+		for _, off := range []int64{0, 1, 1 << 16, 1<<20 - 1, 1 << 20, 1<<20 + 12345, int64(len(data)) - 10} {
+			r, err := idx2.NewReader(bytes.NewReader(gz), off)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, data[off:]) {
+				t.Fatalf("%s: unexpected data at %d", name, off)
+			}
+		}
+	}
+}
+
+func TestIndexCorrupted(t *testing.T) {
+	gz := testGzip(t, gzip.DefaultCompression, testData(1<<16))
+	gz[len(gz)-5] ^= 0xff // corrupt the trailer
+	if _, err := BuildIndex(bytes.NewReader(gz), 0, nil); err == nil {
+		t.Fatal("expected an error")
+	}
+}
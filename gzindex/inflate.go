@@ -0,0 +1,546 @@
+package gzindex
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	windowSize = 1 << 15
+	// flushSize is the size of the output buffer that triggers flushing to the writer.
+	flushSize = 1 << 18
+)
+
+var (
+	errInvalidHeader = errors.New("gzindex: invalid gzip header")
+	errInvalidCode   = errors.New("gzindex: invalid huffman code")
+	errChecksum      = errors.New("gzindex: checksum mismatch")
+)
+
+var (
+	codeLengthOrder = [19]int{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+	lengthBase      = [29]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra     = [29]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase        = [30]int{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra       = [30]uint{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+)
+
+// huffman is a lookup table indexed by the next maxLen bits (LSB first).
+// Each entry is (symbol << 4 | code length), or 0 for invalid codes.
+type huffman struct {
+	table  []uint32
+	maxLen uint
+}
+
+func newHuffman(lengths []uint8) (*huffman, error) {
+	var count [16]int
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var maxLen uint
+	left := 1
+	for l := 1; l < 16; l++ {
+		left <<= 1
+		left -= count[l]
+		if left < 0 {
+			return nil, errors.New("gzindex: over-subscribed huffman code")
+		}
+		if count[l] > 0 {
+			maxLen = uint(l)
+		}
+	}
+	var next [16]uint32
+	code := uint32(0)
+	for l := 1; l < 16; l++ {
+		code = (code + uint32(count[l-1])) << 1
+		next[l] = code
+	}
+	h := &huffman{
+		table:  make([]uint32, 1<<maxLen),
+		maxLen: maxLen,
+	}
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		// huffman codes are packed MSB first
+		r := uint32(0)
+		for i := uint8(0); i < l; i++ {
+			r = r<<1 | (c>>i)&1
+		}
+		for i := r; i < uint32(len(h.table)); i += 1 << l {
+			h.table[i] = uint32(sym)<<4 | uint32(l)
+		}
+	}
+	return h, nil
+}
+
+var fixedLitLen, fixedDist *huffman
+
+func init() {
+	var lengths [288]uint8
+	for i := range lengths {
+		switch {
+		case i < 144:
+			lengths[i] = 8
+		case i < 256:
+			lengths[i] = 9
+		case i < 280:
+			lengths[i] = 7
+		default:
+			lengths[i] = 8
+		}
+	}
+	var err error
+	if fixedLitLen, err = newHuffman(lengths[:]); err != nil {
+		panic(err)
+	}
+	var distLengths [30]uint8
+	for i := range distLengths {
+		distLengths[i] = 5
+	}
+	if fixedDist, err = newHuffman(distLengths[:]); err != nil {
+		panic(err)
+	}
+}
+
+// inflater decompresses a gzip stream while recording the access points.
+type inflater struct {
+	r      *bufio.Reader
+	pos    int64 // bytes consumed from r
+	bitBuf uint64
+	nbits  uint
+
+	w   io.Writer
+	out []byte // history and pending output
+	// wpos is the position in out that has not been written to w yet
+	wpos  int
+	total int64 // uncompressed bytes so far
+	crc   uint32
+
+	// span is the distance between the access points to record.
+	// No access point is recorded if span is zero.
+	span        int64
+	memberStart int64 // uncompressed offset of the current member
+	points      []AccessPoint
+	// partial is true if the current member was resumed from an access point
+	partial bool
+	// discard is the number of bytes to discard before writing to w
+	discard int64
+}
+
+func (f *inflater) fill(n uint) error {
+	for f.nbits < n {
+		b, err := f.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		f.pos++
+		f.bitBuf |= uint64(b) << f.nbits
+		f.nbits += 8
+	}
+	return nil
+}
+
+func (f *inflater) bits(n uint) (int, error) {
+	if err := f.fill(n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	v := int(f.bitBuf & (1<<n - 1))
+	f.bitBuf >>= n
+	f.nbits -= n
+	return v, nil
+}
+
+func (f *inflater) decode(h *huffman) (int, error) {
+	if err := f.fill(h.maxLen); err != nil && err != io.EOF {
+		return 0, err
+	}
+	v := h.table[f.bitBuf&(1<<h.maxLen-1)]
+	l := uint(v & 15)
+	if l == 0 {
+		return 0, errInvalidCode
+	}
+	if l > f.nbits {
+		return 0, io.ErrUnexpectedEOF
+	}
+	f.bitBuf >>= l
+	f.nbits -= l
+	return int(v >> 4), nil
+}
+
+// bitPos returns the position of the next bit in the compressed stream.
+func (f *inflater) bitPos() int64 {
+	return f.pos*8 - int64(f.nbits)
+}
+
+func (f *inflater) emit() error {
+	b := f.out[f.wpos:]
+	f.crc = crc32.Update(f.crc, crc32.IEEETable, b)
+	f.wpos = len(f.out)
+	if f.discard > 0 {
+		n := f.discard
+		if n > int64(len(b)) {
+			n = int64(len(b))
+		}
+		b = b[n:]
+		f.discard -= n
+	}
+	if f.w == nil || len(b) == 0 {
+		return nil
+	}
+	_, err := f.w.Write(b)
+	return err
+}
+
+func (f *inflater) flushIfNeeded() error {
+	if len(f.out) < flushSize {
+		return nil
+	}
+	if err := f.emit(); err != nil {
+		return err
+	}
+	n := copy(f.out, f.out[len(f.out)-windowSize:])
+	f.out = f.out[:n]
+	f.wpos = n
+	return nil
+}
+
+func (f *inflater) addPoint(window bool) {
+	if f.span == 0 {
+		return
+	}
+	p := AccessPoint{
+		UncompressedOffset: f.total,
+		CompressedOffset:   f.bitPos() / 8,
+		Bits:               uint8(f.bitPos() % 8),
+	}
+	if window {
+		n := int64(windowSize)
+		if member := f.total - f.memberStart; member < n {
+			n = member
+		}
+		p.Window = make([]byte, n)
+		copy(p.Window, f.out[int64(len(f.out))-n:])
+	}
+	f.points = append(f.points, p)
+}
+
+// run inflates the gzip members until EOF.
+// If resume is true, the inflater starts in the middle of a member.
+func (f *inflater) run(resume bool) error {
+	for i := 0; ; i++ {
+		if !resume || i > 0 {
+			if err := f.header(); err != nil {
+				if err == io.EOF {
+					if i > 0 {
+						return nil
+					}
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			f.memberStart = f.total
+			f.crc = 0
+			f.partial = false
+			f.addPoint(false)
+		}
+		if err := f.member(); err != nil {
+			return err
+		}
+	}
+}
+
+// member inflates the blocks and the trailer of a gzip member.
+func (f *inflater) member() error {
+	for {
+		if f.span > 0 && f.total-f.points[len(f.points)-1].UncompressedOffset >= f.span {
+			f.addPoint(true)
+		}
+		final, err := f.bits(1)
+		if err != nil {
+			return err
+		}
+		typ, err := f.bits(2)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 0:
+			err = f.stored()
+		case 1:
+			err = f.codes(fixedLitLen, fixedDist)
+		case 2:
+			err = f.dynamic()
+		default:
+			err = fmt.Errorf("gzindex: invalid block type %d", typ)
+		}
+		if err != nil {
+			return err
+		}
+		if final == 1 {
+			break
+		}
+	}
+	if err := f.emit(); err != nil {
+		return err
+	}
+	// trailer
+	f.bitBuf >>= f.nbits % 8
+	f.nbits -= f.nbits % 8
+	var trailer [8]byte
+	for i := range trailer {
+		b, err := f.bits(8)
+		if err != nil {
+			return err
+		}
+		trailer[i] = byte(b)
+	}
+	if f.partial {
+		// the checksum cannot be verified when resumed from an access point
+		return nil
+	}
+	crc := uint32(trailer[0]) | uint32(trailer[1])<<8 | uint32(trailer[2])<<16 | uint32(trailer[3])<<24
+	size := uint32(trailer[4]) | uint32(trailer[5])<<8 | uint32(trailer[6])<<16 | uint32(trailer[7])<<24
+	if crc != f.crc || size != uint32(f.total-f.memberStart) {
+		return errChecksum
+	}
+	return nil
+}
+
+func (f *inflater) header() error {
+	var hdr [10]byte
+	for i := range hdr {
+		if err := f.fill(8); err != nil {
+			if err == io.EOF && i == 0 {
+				return io.EOF
+			}
+			return errInvalidHeader
+		}
+		b, _ := f.bits(8)
+		hdr[i] = byte(b)
+	}
+	if hdr[0] != 0x1f || hdr[1] != 0x8b || hdr[2] != 8 {
+		return errInvalidHeader
+	}
+	flags := hdr[3]
+	if flags&0x04 != 0 { // FEXTRA
+		lo, err := f.bits(8)
+		if err != nil {
+			return err
+		}
+		hi, err := f.bits(8)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < lo|hi<<8; i++ {
+			if _, err := f.bits(8); err != nil {
+				return err
+			}
+		}
+	}
+	for _, flag := range []byte{0x08, 0x10} { // FNAME, FCOMMENT
+		if flags&flag == 0 {
+			continue
+		}
+		for {
+			b, err := f.bits(8)
+			if err != nil {
+				return err
+			}
+			if b == 0 {
+				break
+			}
+		}
+	}
+	if flags&0x02 != 0 { // FHCRC
+		if _, err := f.bits(16); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *inflater) stored() error {
+	f.bitBuf >>= f.nbits % 8
+	f.nbits -= f.nbits % 8
+	n, err := f.bits(16)
+	if err != nil {
+		return err
+	}
+	nn, err := f.bits(16)
+	if err != nil {
+		return err
+	}
+	if n != ^nn&0xffff {
+		return errors.New("gzindex: invalid stored block length")
+	}
+	for ; n > 0 && f.nbits > 0; n-- {
+		b, _ := f.bits(8)
+		f.out = append(f.out, byte(b))
+		f.total++
+	}
+	for n > 0 {
+		if err := f.flushIfNeeded(); err != nil {
+			return err
+		}
+		l := len(f.out)
+		chunk := n
+		if chunk > flushSize {
+			chunk = flushSize
+		}
+		f.out = append(f.out, make([]byte, chunk)...)
+		if _, err := io.ReadFull(f.r, f.out[l:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		f.pos += int64(chunk)
+		f.total += int64(chunk)
+		n -= chunk
+	}
+	return nil
+}
+
+func (f *inflater) dynamic() error {
+	hlit, err := f.bits(5)
+	if err != nil {
+		return err
+	}
+	hdist, err := f.bits(5)
+	if err != nil {
+		return err
+	}
+	hclen, err := f.bits(4)
+	if err != nil {
+		return err
+	}
+	nlen, ndist, ncode := hlit+257, hdist+1, hclen+4
+	if nlen > 286 || ndist > 30 {
+		return errors.New("gzindex: invalid code counts")
+	}
+	var codeLengths [19]uint8
+	for i := 0; i < ncode; i++ {
+		l, err := f.bits(3)
+		if err != nil {
+			return err
+		}
+		codeLengths[codeLengthOrder[i]] = uint8(l)
+	}
+	ch, err := newHuffman(codeLengths[:])
+	if err != nil {
+		return err
+	}
+	lengths := make([]uint8, nlen+ndist)
+	for i := 0; i < len(lengths); {
+		sym, err := f.decode(ch)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[i] = uint8(sym)
+			i++
+			continue
+		}
+		var (
+			rep  int
+			prev uint8
+		)
+		switch sym {
+		case 16:
+			if i == 0 {
+				return errors.New("gzindex: repeat with no previous length")
+			}
+			prev = lengths[i-1]
+			rep, err = f.bits(2)
+			rep += 3
+		case 17:
+			rep, err = f.bits(3)
+			rep += 3
+		default:
+			rep, err = f.bits(7)
+			rep += 11
+		}
+		if err != nil {
+			return err
+		}
+		if i+rep > len(lengths) {
+			return errors.New("gzindex: too many code lengths")
+		}
+		for ; rep > 0; rep-- {
+			lengths[i] = prev
+			i++
+		}
+	}
+	if lengths[256] == 0 {
+		return errors.New("gzindex: no end-of-block code")
+	}
+	lh, err := newHuffman(lengths[:nlen])
+	if err != nil {
+		return err
+	}
+	dh, err := newHuffman(lengths[nlen:])
+	if err != nil {
+		return err
+	}
+	return f.codes(lh, dh)
+}
+
+func (f *inflater) codes(lh, dh *huffman) error {
+	for {
+		sym, err := f.decode(lh)
+		if err != nil {
+			return err
+		}
+		if sym < 256 {
+			f.out = append(f.out, byte(sym))
+			f.total++
+			continue
+		}
+		if sym == 256 {
+			return f.flushIfNeeded()
+		}
+		sym -= 257
+		if sym >= len(lengthBase) {
+			return errInvalidCode
+		}
+		extra, err := f.bits(lengthExtra[sym])
+		if err != nil {
+			return err
+		}
+		length := lengthBase[sym] + extra
+		dsym, err := f.decode(dh)
+		if err != nil {
+			return err
+		}
+		if dsym >= len(distBase) {
+			return errInvalidCode
+		}
+		extra, err = f.bits(distExtra[dsym])
+		if err != nil {
+			return err
+		}
+		dist := distBase[dsym] + extra
+		if int64(dist) > f.total-f.memberStart || dist > len(f.out) {
+			return errors.New("gzindex: distance too far back")
+		}
+		start := len(f.out) - dist
+		for i := 0; i < length; i++ {
+			f.out = append(f.out, f.out[start+i])
+		}
+		f.total += int64(length)
+		if err := f.flushIfNeeded(); err != nil {
+			return err
+		}
+	}
+}
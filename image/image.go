@@ -3,6 +3,7 @@ package image
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -17,7 +18,14 @@ const (
 	RefNameAnnotation = "org.opencontainers.image.ref.name" // should it be defined in image-spec?
 )
 
+// Init initializes img as an empty image, removing the existing contents of img.
+// Use InitIfNotExist to add images to an existing one.
 func Init(img string) error {
+	return InitWithBlobsLayout(img, FlatBlobsLayout)
+}
+
+// InitWithBlobsLayout is similar to Init but records the blobs layout in the oci-layout file.
+func InitWithBlobsLayout(img string, l BlobsLayout) error {
 	// Create the directory
 	if err := os.RemoveAll(img); err != nil {
 		return err
@@ -32,15 +40,34 @@ func Init(img string) error {
 		return nil
 	}
 	// Create oci-layout
-	if err := WriteImageLayout(img, &spec.ImageLayout{Version: spec.ImageLayoutVersion}); err != nil {
+	if err := writeBlobsLayout(img, l); err != nil {
 		return err
 	}
 	// Create index.json
 	return WriteIndex(img, &spec.Index{Versioned: specs.Versioned{SchemaVersion: 2}})
 }
 
-func blobPath(img string, d digest.Digest) string {
-	return filepath.Join(img, "blobs", d.Algorithm().String(), d.Hex())
+// InitIfNotExist initializes the image if img does not exist yet, or is an empty directory.
+// If img already exists, img must be an OCI image layout.
+func InitIfNotExist(img string) error {
+	return InitIfNotExistWithBlobsLayout(img, FlatBlobsLayout)
+}
+
+// InitIfNotExistWithBlobsLayout is similar to InitIfNotExist but records the blobs layout for the new image.
+// The blobs layout of the existing image is kept.
+func InitIfNotExistWithBlobsLayout(img string, l BlobsLayout) error {
+	files, err := ioutil.ReadDir(img)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return InitWithBlobsLayout(img, l)
+		}
+		return err
+	}
+	if len(files) == 0 {
+		return InitWithBlobsLayout(img, l)
+	}
+	_, err = ReadImageLayout(img)
+	return err
 }
 
 func indexPath(img string) string {
@@ -53,7 +80,14 @@ type BlobReader interface {
 }
 
 func GetBlobReader(img string, d digest.Digest) (BlobReader, error) {
-	return os.Open(blobPath(img, d))
+	f, err := os.Open(BlobPath(img, d))
+	if os.IsNotExist(err) {
+		// the blob may not be converted to the current layout yet
+		if f2, err2 := os.Open(otherBlobPath(img, d)); err2 == nil {
+			return f2, nil
+		}
+	}
+	return f, err
 }
 
 func ReadBlob(img string, d digest.Digest) ([]byte, error) {
@@ -64,9 +98,22 @@ func ReadBlob(img string, d digest.Digest) ([]byte, error) {
 	return ioutil.ReadAll(r)
 }
 
+// WriteBlob writes b as a blob, unless the blob already exists.
+// The blob is written to a temporary file and then renamed, as the existing blob files are read-only.
 func WriteBlob(img string, b []byte) (digest.Digest, error) {
 	d := digest.FromBytes(b)
-	return d, ioutil.WriteFile(blobPath(img, d), b, 0444)
+	if BlobExists(img, d) {
+		return d, nil
+	}
+	bw, err := NewBlobWriter(img, d.Algorithm())
+	if err != nil {
+		return d, err
+	}
+	defer bw.Abort()
+	if _, err := bw.Write(b); err != nil {
+		return d, err
+	}
+	return d, bw.Close()
 }
 
 type BlobWriter struct {
@@ -76,9 +123,15 @@ type BlobWriter struct {
 	closed   bool
 }
 
+// tempBlobPrefix is the prefix of the temporary files created by BlobWriter.
+const tempBlobPrefix = "tmp.blobwriter"
+
+// blobMode is the permission of the blob files.
+const blobMode = 0444
+
 func NewBlobWriter(img string, algo digest.Algorithm) (*BlobWriter, error) {
 	// use img rather than the default tmp, so as to make sure rename(2) can be applied
-	f, err := ioutil.TempFile(img, "tmp.blobwriter")
+	f, err := ioutil.TempFile(img, tempBlobPrefix)
 	if err != nil {
 		return nil, err
 	}
@@ -99,10 +152,24 @@ func (bw *BlobWriter) Write(b []byte) (int, error) {
 
 func (bw *BlobWriter) Close() error {
 	oldPath := bw.f.Name()
+	// blobs are read-only, and readable by other users (e.g. an HTTP server)
+	if err := bw.f.Chmod(blobMode); err != nil {
+		bw.f.Close()
+		return err
+	}
 	if err := bw.f.Close(); err != nil {
 		return err
 	}
-	newPath := blobPath(bw.img, bw.digester.Digest())
+	d := bw.digester.Digest()
+	if BlobExists(bw.img, d) {
+		// keep the existing blob, which may be hardlinked or being read
+		if err := os.Remove(oldPath); err != nil {
+			return err
+		}
+		bw.closed = true
+		return nil
+	}
+	newPath := BlobPath(bw.img, d)
 	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
 		return err
 	}
@@ -113,6 +180,20 @@ func (bw *BlobWriter) Close() error {
 	return nil
 }
 
+// Abort removes the temporary file. No-op if already closed.
+func (bw *BlobWriter) Abort() error {
+	if bw.closed {
+		return nil
+	}
+	bw.f.Close()
+	return os.Remove(bw.f.Name())
+}
+
+// WrittenDigest returns the digest of the data written so far.
+func (bw *BlobWriter) WrittenDigest() digest.Digest {
+	return bw.digester.Digest()
+}
+
 // Digest returns nil if unclosed
 func (bw *BlobWriter) Digest() *digest.Digest {
 	if !bw.closed {
@@ -123,7 +204,126 @@ func (bw *BlobWriter) Digest() *digest.Digest {
 }
 
 func DeleteBlob(img string, d digest.Digest) error {
-	return os.Remove(blobPath(img, d))
+	err := os.Remove(BlobPath(img, d))
+	if os.IsNotExist(err) {
+		if err2 := os.Remove(otherBlobPath(img, d)); err2 == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// BlobExists returns true if the blob exists in img.
+// The content is not verified.
+func BlobExists(img string, d digest.Digest) bool {
+	_, err := StatBlob(img, d)
+	return err == nil
+}
+
+// StatBlob returns the os.FileInfo of the blob file.
+func StatBlob(img string, d digest.Digest) (os.FileInfo, error) {
+	fi, err := os.Stat(BlobPath(img, d))
+	if os.IsNotExist(err) {
+		// the blob may not be converted to the current layout yet
+		if fi2, err2 := os.Stat(otherBlobPath(img, d)); err2 == nil {
+			return fi2, nil
+		}
+	}
+	return fi, err
+}
+
+// PutBlobFile moves the file to the blob path for the digest.
+// The content of the file must have been verified by the caller.
+func PutBlobFile(img string, d digest.Digest, path string) error {
+	if err := os.Chmod(path, blobMode); err != nil {
+		return err
+	}
+	newPath := BlobPath(img, d)
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+	return os.Rename(path, newPath)
+}
+
+// VerifyBlob returns an error if the blob does not exist or does not match the digest.
+func VerifyBlob(img string, d digest.Digest) error {
+	r, err := GetBlobReader(img, d)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	verifier := d.Verifier()
+	if _, err := io.Copy(verifier, r); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("digest mismatch for %s", d)
+	}
+	return nil
+}
+
+// ListBlobs returns the digests of the blobs in the image.
+// Files with invalid names are ignored.
+func ListBlobs(img string) ([]digest.Digest, error) {
+	algos, err := ioutil.ReadDir(filepath.Join(img, "blobs"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var res []digest.Digest
+	for _, algo := range algos {
+		if !algo.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(img, "blobs", algo.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.IsDir() && len(f.Name()) == 2 {
+				// shard directory
+				sharded, err := ioutil.ReadDir(filepath.Join(img, "blobs", algo.Name(), f.Name()))
+				if err != nil {
+					return nil, err
+				}
+				for _, sf := range sharded {
+					d := digest.NewDigestFromHex(algo.Name(), sf.Name())
+					if !sf.Mode().IsRegular() || d.Validate() != nil {
+						continue
+					}
+					res = append(res, d)
+				}
+				continue
+			}
+			d := digest.NewDigestFromHex(algo.Name(), f.Name())
+			if !f.Mode().IsRegular() || d.Validate() != nil {
+				continue
+			}
+			res = append(res, d)
+		}
+	}
+	return res, nil
+}
+
+// ListTempBlobs returns the paths of the temporary files of BlobWriter.
+func ListTempBlobs(img string) ([]string, error) {
+	return filepath.Glob(filepath.Join(img, tempBlobPrefix+"*"))
+}
+
+// RemoveTempBlobs removes the temporary files left by BlobWriter, e.g. on crash.
+func RemoveTempBlobs(img string) error {
+	files, err := ListTempBlobs(img)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func ReadImageLayout(img string) (*spec.ImageLayout, error) {
@@ -138,8 +338,10 @@ func ReadImageLayout(img string) (*spec.ImageLayout, error) {
 	return &layout, nil
 }
 
+// WriteImageLayout writes the oci-layout file.
+// The blobs layout recorded in the existing file is preserved.
 func WriteImageLayout(img string, layout *spec.ImageLayout) error {
-	b, err := json.Marshal(layout)
+	b, err := json.Marshal(&imageLayout{ImageLayout: *layout, BlobsLayout: blobsLayout(img)})
 	if err != nil {
 		return err
 	}
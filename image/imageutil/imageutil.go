@@ -2,6 +2,7 @@ package imageutil
 
 import (
 	"encoding/json"
+	"fmt"
 
 	spec "github.com/opencontainers/image-spec/specs-go/v1"
 
@@ -23,3 +24,44 @@ func WriteJSONBlob(img string, x interface{}, mediaType string) (*spec.Descripto
 		Size:      int64(len(b)),
 	}, nil
 }
+
+// UpdateManifest updates the image manifest tagged as refName with fn,
+// and replaces the manifest descriptor in the index.
+// The old manifest blob is left in the image.
+func UpdateManifest(img, refName string, fn func(*spec.Manifest) error) (*spec.Descriptor, error) {
+	idx, err := image.ReadIndex(img)
+	if err != nil {
+		return nil, err
+	}
+	var desc *spec.Descriptor
+	for i, m := range idx.Manifests {
+		if m.Annotations[image.RefNameAnnotation] == refName {
+			desc = &idx.Manifests[i]
+			break
+		}
+	}
+	if desc == nil {
+		return nil, fmt.Errorf("unknown reference name: %q", refName)
+	}
+	b, err := image.ReadBlob(img, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	var manifest spec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return nil, err
+	}
+	if err := fn(&manifest); err != nil {
+		return nil, err
+	}
+	newDesc, err := WriteJSONBlob(img, manifest, desc.MediaType)
+	if err != nil {
+		return nil, err
+	}
+	newDesc.Platform = desc.Platform
+	newDesc.Annotations = desc.Annotations
+	if err := image.PutManifestDescriptorToIndex(img, newDesc); err != nil {
+		return nil, err
+	}
+	return newDesc, nil
+}
@@ -0,0 +1,85 @@
+package image
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/sys/unix"
+)
+
+// ficlone is the FICLONE ioctl(2) request, which is not defined in our version of golang.org/x/sys/unix.
+const ficlone = 0x40049409
+
+// IngestFile puts the content of the regular file at path as a blob, and returns the digest.
+// The file is reflinked into the blobs directory if the filesystem supports reflinks, otherwise copied.
+// Either way the file is read only once, for hashing.
+//
+// If link is true, the file is hardlinked instead of being copied when img is on the same filesystem.
+// The caller must not modify the file afterward, as the blob shares the inode with the file.
+// As the blob also shares the mode and the owner with the file, only files with the same
+// mode as blobs (0444) are hardlinked, so that e.g. a setuid binary or an unreadable file
+// does not appear in the blobs directory.
+//
+// Existing blobs are not overwritten.
+func IngestFile(img, path string, link bool) (digest.Digest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if link {
+		fi, err := f.Stat()
+		if err != nil {
+			return "", err
+		}
+		link = fi.Mode() == blobMode
+	}
+	if link {
+		d, err := digest.Canonical.FromReader(f)
+		if err != nil {
+			return "", err
+		}
+		if BlobExists(img, d) {
+			return d, nil
+		}
+		p := BlobPath(img, d)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return "", err
+		}
+		if err := os.Link(path, p); err == nil || os.IsExist(err) {
+			return d, nil
+		}
+		// e.g. EXDEV; fall back to copying
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+	}
+	bw, err := NewBlobWriter(img, digest.Canonical)
+	if err != nil {
+		return "", err
+	}
+	defer bw.Abort()
+	if cloneFile(bw.f, f) == nil {
+		_, err = io.Copy(bw.digester.Hash(), f)
+	} else {
+		_, err = io.Copy(bw, f)
+	}
+	if err != nil {
+		return "", err
+	}
+	d := bw.WrittenDigest()
+	if BlobExists(img, d) {
+		return d, nil
+	}
+	return d, bw.Close()
+}
+
+// cloneFile reflinks src to dst.
+func cloneFile(dst, src *os.File) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, dst.Fd(), ficlone, src.Fd()); errno != 0 {
+		return errno
+	}
+	return nil
+}
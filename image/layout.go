@@ -0,0 +1,176 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// BlobsLayout is the layout of the blobs directory.
+type BlobsLayout string
+
+const (
+	// FlatBlobsLayout stores the blobs as blobs/<alg>/<hex>, as in OCI Image Spec.
+	FlatBlobsLayout BlobsLayout = ""
+	// ShardedBlobsLayout stores the blobs as blobs/<alg>/<hex[:2]>/<hex>,
+	// so that a directory does not contain hundreds of thousands of files.
+	// See https://github.com/opencontainers/image-spec/issues/449
+	ShardedBlobsLayout BlobsLayout = "sharded"
+)
+
+func (l BlobsLayout) String() string {
+	if l == FlatBlobsLayout {
+		return "flat"
+	}
+	return string(l)
+}
+
+// ParseBlobsLayout parses "flat" or "sharded".
+func ParseBlobsLayout(s string) (BlobsLayout, error) {
+	switch s {
+	case "", "flat":
+		return FlatBlobsLayout, nil
+	case string(ShardedBlobsLayout):
+		return ShardedBlobsLayout, nil
+	}
+	return FlatBlobsLayout, fmt.Errorf("unknown blobs layout: %q", s)
+}
+
+// imageLayout is the content of the oci-layout file, with the FILEgrain extension.
+type imageLayout struct {
+	spec.ImageLayout
+	BlobsLayout BlobsLayout `json:"filegrain.blobsLayout,omitempty"`
+}
+
+var (
+	blobsLayoutsMu sync.Mutex
+	// blobsLayouts caches the blobs layouts. key: filepath.Clean(img)
+	blobsLayouts = make(map[string]BlobsLayout, 0)
+)
+
+// GetBlobsLayout returns the blobs layout recorded in the oci-layout file of img.
+// Returns FlatBlobsLayout if img has no oci-layout file (e.g. a blob cache directory).
+func GetBlobsLayout(img string) (BlobsLayout, error) {
+	b, err := ioutil.ReadFile(filepath.Join(img, spec.ImageLayoutFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return FlatBlobsLayout, nil
+		}
+		return FlatBlobsLayout, err
+	}
+	return UnmarshalBlobsLayout(b)
+}
+
+// UnmarshalBlobsLayout returns the blobs layout recorded in the content of an oci-layout file.
+func UnmarshalBlobsLayout(b []byte) (BlobsLayout, error) {
+	var layout imageLayout
+	if err := json.Unmarshal(b, &layout); err != nil {
+		return FlatBlobsLayout, err
+	}
+	return ParseBlobsLayout(string(layout.BlobsLayout))
+}
+
+// blobsLayout is a cached version of GetBlobsLayout.
+// Returns FlatBlobsLayout on error.
+func blobsLayout(img string) BlobsLayout {
+	key := filepath.Clean(img)
+	blobsLayoutsMu.Lock()
+	defer blobsLayoutsMu.Unlock()
+	if l, ok := blobsLayouts[key]; ok {
+		return l
+	}
+	l, err := GetBlobsLayout(img)
+	if err != nil {
+		return FlatBlobsLayout
+	}
+	blobsLayouts[key] = l
+	return l
+}
+
+func setBlobsLayoutCache(img string, l BlobsLayout) {
+	blobsLayoutsMu.Lock()
+	blobsLayouts[filepath.Clean(img)] = l
+	blobsLayoutsMu.Unlock()
+}
+
+// writeBlobsLayout writes the oci-layout file with the blobs layout.
+func writeBlobsLayout(img string, l BlobsLayout) error {
+	b, err := json.Marshal(&imageLayout{
+		ImageLayout: spec.ImageLayout{Version: spec.ImageLayoutVersion},
+		BlobsLayout: l,
+	})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(img, spec.ImageLayoutFile), b, 0644); err != nil {
+		return err
+	}
+	setBlobsLayoutCache(img, l)
+	return nil
+}
+
+// BlobRelPath returns the slash-separated path of the blob relative to the image, e.g. "blobs/sha256/ab/abcdef..".
+func BlobRelPath(d digest.Digest, l BlobsLayout) string {
+	if l == ShardedBlobsLayout && len(d.Hex()) > 2 {
+		return path.Join("blobs", d.Algorithm().String(), d.Hex()[:2], d.Hex())
+	}
+	return path.Join("blobs", d.Algorithm().String(), d.Hex())
+}
+
+// BlobPath returns the path of the blob in img.
+func BlobPath(img string, d digest.Digest) string {
+	return filepath.Join(img, filepath.FromSlash(BlobRelPath(d, blobsLayout(img))))
+}
+
+// otherBlobPath returns the path of the blob in the layout other than the current one.
+func otherBlobPath(img string, d digest.Digest) string {
+	other := ShardedBlobsLayout
+	if blobsLayout(img) == ShardedBlobsLayout {
+		other = FlatBlobsLayout
+	}
+	return filepath.Join(img, filepath.FromSlash(BlobRelPath(d, other)))
+}
+
+// ConvertBlobsLayout moves the blobs of img to the layout, and records the layout in the oci-layout file.
+// An interrupted conversion can be resumed by calling ConvertBlobsLayout again,
+// and the blobs remain readable during the conversion.
+func ConvertBlobsLayout(img string, l BlobsLayout) error {
+	other := ShardedBlobsLayout
+	if l == ShardedBlobsLayout {
+		other = FlatBlobsLayout
+	}
+	ds, err := ListBlobs(img)
+	if err != nil {
+		return err
+	}
+	for _, d := range ds {
+		dst := filepath.Join(img, filepath.FromSlash(BlobRelPath(d, l)))
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(filepath.Join(img, filepath.FromSlash(BlobRelPath(d, other))), dst); err != nil {
+			return err
+		}
+	}
+	if err := writeBlobsLayout(img, l); err != nil {
+		return err
+	}
+	if l == FlatBlobsLayout {
+		// remove the empty shard directories
+		dirs, _ := filepath.Glob(filepath.Join(img, "blobs", "*", "??"))
+		for _, dir := range dirs {
+			os.Remove(dir)
+		}
+	}
+	return nil
+}
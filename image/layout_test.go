@@ -0,0 +1,69 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestConvertBlobsLayout(t *testing.T) {
+	img, err := ioutil.TempDir("", "filegrain-test-image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(img)
+	if err := InitWithBlobsLayout(img, ShardedBlobsLayout); err != nil {
+		t.Fatal(err)
+	}
+	var ds []digest.Digest
+	for _, s := range []string{"foo", "bar", "baz"} {
+		d, err := WriteBlob(img, []byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ds = append(ds, d)
+	}
+	exists := func(d digest.Digest, l BlobsLayout) bool {
+		_, err := os.Stat(filepath.Join(img, filepath.FromSlash(BlobRelPath(d, l))))
+		return err == nil
+	}
+	for _, d := range ds {
+		if !exists(d, ShardedBlobsLayout) {
+			t.Fatalf("%s is not sharded", d)
+		}
+	}
+	// simulate an interrupted conversion
+	if err := os.Rename(BlobPath(img, ds[0]), filepath.Join(img, filepath.FromSlash(BlobRelPath(ds[0], FlatBlobsLayout)))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadBlob(img, ds[0]); err != nil {
+		t.Fatalf("blob should be readable during conversion: %v", err)
+	}
+	if err := ConvertBlobsLayout(img, FlatBlobsLayout); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := GetBlobsLayout(img); err != nil || l != FlatBlobsLayout {
+		t.Fatalf("expected flat layout, got %q (%v)", l, err)
+	}
+	listed, err := ListBlobs(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != len(ds) {
+		t.Fatalf("expected %d blobs, got %v", len(ds), listed)
+	}
+	for _, d := range ds {
+		if !exists(d, FlatBlobsLayout) || exists(d, ShardedBlobsLayout) {
+			t.Fatalf("%s is not converted", d)
+		}
+		if err := VerifyBlob(img, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ReadImageLayout(img); err != nil {
+		t.Fatal(err)
+	}
+}
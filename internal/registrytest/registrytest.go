@@ -0,0 +1,192 @@
+// Package registrytest provides an in-memory registry for testing the registry clients.
+package registrytest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Registry is an in-memory registry that supports pulling, pushing, and cross-repository blob mounts.
+// The fields must not be modified while the requests are being served, except via the methods.
+type Registry struct {
+	*httptest.Server
+	// Token enables bearer token authentication if non-empty.
+	Token string
+	// Scope is the only scope that the token is issued for, if non-empty.
+	Scope string
+
+	mu         sync.Mutex
+	blobs      map[string]map[digest.Digest][]byte // key: repository name
+	manifests  map[string]map[string][]byte        // key: repository name, and tag or digest
+	mediaTypes map[string]map[string]string
+	uploads    map[string][]byte
+
+	// Uploads, Mounts, and Patches are the numbers of the requests.
+	Uploads int
+	Mounts  int
+	Patches int
+}
+
+// NewRegistry starts a registry. The caller has to call Close.
+func NewRegistry() *Registry {
+	reg := &Registry{
+		blobs:      make(map[string]map[digest.Digest][]byte, 0),
+		manifests:  make(map[string]map[string][]byte, 0),
+		mediaTypes: make(map[string]map[string]string, 0),
+		uploads:    make(map[string][]byte, 0),
+	}
+	reg.Server = httptest.NewServer(reg)
+	return reg
+}
+
+// Host returns the host of the registry, for the references.
+func (reg *Registry) Host() string {
+	return strings.TrimPrefix(reg.URL, "http://")
+}
+
+// PutBlob puts the blob to the repository.
+func (reg *Registry) PutBlob(name string, b []byte) digest.Digest {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.putBlob(name, b)
+}
+
+func (reg *Registry) putBlob(name string, b []byte) digest.Digest {
+	d := digest.FromBytes(b)
+	if reg.blobs[name] == nil {
+		reg.blobs[name] = make(map[digest.Digest][]byte, 0)
+	}
+	reg.blobs[name][d] = b
+	return d
+}
+
+// PutManifest puts the manifest (or the index) to the repository, with the tag if non-empty.
+// The manifest can be also pulled by the digest.
+func (reg *Registry) PutManifest(name, tag, mediaType string, b []byte) digest.Digest {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.putManifest(name, tag, mediaType, b)
+}
+
+func (reg *Registry) putManifest(name, tag, mediaType string, b []byte) digest.Digest {
+	d := digest.FromBytes(b)
+	if reg.manifests[name] == nil {
+		reg.manifests[name] = make(map[string][]byte, 0)
+		reg.mediaTypes[name] = make(map[string]string, 0)
+	}
+	objects := []string{d.String()}
+	if tag != "" {
+		objects = append(objects, tag)
+	}
+	for _, o := range objects {
+		reg.manifests[name][o] = b
+		reg.mediaTypes[name][o] = mediaType
+	}
+	return d
+}
+
+// Manifest returns the manifest in the repository.
+func (reg *Registry) Manifest(name, object string) ([]byte, bool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	b, ok := reg.manifests[name][object]
+	return b, ok
+}
+
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if r.URL.Path == "/token" {
+		if scope := r.URL.Query().Get("scope"); reg.Scope != "" && scope != reg.Scope {
+			http.Error(w, "unexpected scope "+scope, http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": reg.Token})
+		return
+	}
+	if reg.Token != "" && r.Header.Get("Authorization") != "Bearer "+reg.Token {
+		w.Header().Set("WWW-Authenticate",
+			fmt.Sprintf(`Bearer realm="%s/token",service="test"`, reg.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	p := strings.TrimPrefix(r.URL.Path, "/v2/")
+	body, _ := ioutil.ReadAll(r.Body)
+	switch {
+	case strings.Contains(p, "/blobs/uploads/"):
+		i := strings.Index(p, "/blobs/uploads/")
+		name, id := p[:i], p[i+len("/blobs/uploads/"):]
+		switch r.Method {
+		case "POST":
+			if d := digest.Digest(r.URL.Query().Get("mount")); d != "" {
+				if b, ok := reg.blobs[r.URL.Query().Get("from")][d]; ok {
+					reg.putBlob(name, b)
+					reg.Mounts++
+					w.WriteHeader(http.StatusCreated)
+					return
+				}
+			}
+			id = fmt.Sprintf("upload%d", len(reg.uploads))
+			reg.uploads[id] = nil
+		case "PATCH":
+			reg.uploads[id] = append(reg.uploads[id], body...)
+			reg.Patches++
+		case "PUT":
+			b := append(reg.uploads[id], body...)
+			if d := digest.FromBytes(b); d.String() != r.URL.Query().Get("digest") {
+				http.Error(w, "digest mismatch", http.StatusBadRequest)
+				return
+			}
+			reg.putBlob(name, b)
+			reg.Uploads++
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		// relative location
+		w.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+id)
+		w.WriteHeader(http.StatusAccepted)
+	case strings.Contains(p, "/blobs/"):
+		i := strings.Index(p, "/blobs/")
+		b, ok := reg.blobs[p[:i]][digest.Digest(p[i+len("/blobs/"):])]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+	case strings.Contains(p, "/manifests/"):
+		i := strings.Index(p, "/manifests/")
+		name, object := p[:i], p[i+len("/manifests/"):]
+		if r.Method == "PUT" {
+			tag := object
+			if _, err := digest.Parse(object); err == nil {
+				tag = ""
+			}
+			reg.putManifest(name, tag, r.Header.Get("Content-Type"), body)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		b, ok := reg.manifests[name][object]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		mediaType := reg.mediaTypes[name][object]
+		if mediaType == "" {
+			mediaType = spec.MediaTypeImageManifest
+		}
+		w.Header().Set("Content-Type", mediaType)
+		w.Write(b)
+	default:
+		http.NotFound(w, r)
+	}
+}
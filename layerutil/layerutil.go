@@ -0,0 +1,93 @@
+package layerutil
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	MediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd" // TODO: define in upstream image-spec
+
+	MediaTypeDockerImageLayer     = "application/vnd.docker.image.rootfs.diff.tar"
+	MediaTypeDockerImageLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	// WhiteoutPrefix is the prefix of the whiteout files which remove the file in the lower layers.
+	WhiteoutPrefix = ".wh."
+	// WhiteoutOpaqueDir is the whiteout file which hides all the children of the directory in the lower layers.
+	WhiteoutOpaqueDir = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+
+	// PAXSchilyXattr is the prefix of the PAX records that contain xattrs.
+	PAXSchilyXattr = "SCHILY.xattr."
+)
+
+type Compression int
+
+const (
+	Uncompressed Compression = iota
+	Gzip
+	Zstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case Uncompressed:
+		return "uncompressed"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("unknown compression %d", int(c))
+}
+
+// IsTarLayer returns true if mediaType is a tar layer (including compressed ones).
+func IsTarLayer(mediaType string) bool {
+	_, err := LayerCompression(mediaType)
+	return err == nil
+}
+
+// LayerCompression returns the compression of the tar layer.
+// Returns an error if mediaType is not a tar layer.
+func LayerCompression(mediaType string) (Compression, error) {
+	switch mediaType {
+	case spec.MediaTypeImageLayer, spec.MediaTypeImageLayerNonDistributable, MediaTypeDockerImageLayer:
+		return Uncompressed, nil
+	case spec.MediaTypeImageLayerGzip, spec.MediaTypeImageLayerNonDistributableGzip, MediaTypeDockerImageLayerGzip:
+		return Gzip, nil
+	case MediaTypeImageLayerZstd:
+		return Zstd, nil
+	}
+	return Uncompressed, fmt.Errorf("unsupported layer mediaType: %s", mediaType)
+}
+
+// Decompress returns the decompressed stream of r.
+// Closing the returned reader does not close r.
+func Decompress(c Compression, r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case Uncompressed:
+		return ioutil.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return &zstdReadCloser{Decoder: dec}, nil
+	}
+	return nil, fmt.Errorf("unsupported compression: %v", c)
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z *zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
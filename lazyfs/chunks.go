@@ -0,0 +1,74 @@
+package lazyfs
+
+import (
+	"io"
+
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/cdc"
+)
+
+// loadChunkMap loads the chunk map of the continuity manifest layer.
+// Returns nil if the layer has no chunk map.
+func loadChunkMap(opts Options, layer *spec.Descriptor) (*cdc.Map, error) {
+	s, ok := layer.Annotations[cdc.Annotation]
+	if !ok {
+		return nil, nil
+	}
+	d, err := digest.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	b, err := loadBlobWithDescriptor(opts, &spec.Descriptor{Digest: d})
+	if err != nil {
+		return nil, err
+	}
+	return cdc.Unmarshal(b)
+}
+
+// readChunks reads the content of a chunked file at off into buf.
+// The chunks that do not overlap the range are not pulled.
+func readChunks(opts Options, e *entry, buf []byte, off int64) (int, error) {
+	var (
+		n        int
+		chunkOff int64
+	)
+	for _, c := range e.chunks {
+		if n == len(buf) {
+			break
+		}
+		if off+int64(n) >= chunkOff+c.Size {
+			chunkOff += c.Size
+			continue
+		}
+		m, err := readChunk(opts, e, c, buf[n:], off+int64(n)-chunkOff)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		chunkOff += c.Size
+	}
+	if n < len(buf) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func readChunk(opts Options, e *entry, c cdc.Chunk, buf []byte, off int64) (int, error) {
+	if b := e.compression.Lookup(c.Digest); b != nil {
+		return readCompressed(opts, b, c.Size, buf, off)
+	}
+	if int64(len(buf)) > c.Size-off {
+		buf = buf[:c.Size-off]
+	}
+	br, err := opts.Puller.PullBlob(opts.Image, c.Digest)
+	if err != nil {
+		return 0, err
+	}
+	defer br.Close()
+	if _, err := br.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(br, buf)
+}
@@ -0,0 +1,103 @@
+package lazyfs
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/blobcompress"
+	"github.com/AkihiroSuda/filegrain/layerutil"
+	"github.com/AkihiroSuda/filegrain/puller"
+)
+
+// loadCompressionMap loads the compression map of the continuity manifest layer.
+// Returns nil if the layer has no compression map.
+func loadCompressionMap(opts Options, layer *spec.Descriptor) (*blobcompress.Map, error) {
+	s, ok := layer.Annotations[blobcompress.Annotation]
+	if !ok {
+		return nil, nil
+	}
+	d, err := digest.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	b, err := loadBlobWithDescriptor(opts, &spec.Descriptor{Digest: d})
+	if err != nil {
+		return nil, err
+	}
+	return blobcompress.Unmarshal(b)
+}
+
+// readCompressed reads the content of the compressed blob at off into buf.
+// size is the size of the uncompressed content.
+// Only the frames that contain the range are pulled and decompressed.
+func readCompressed(opts Options, b *blobcompress.Blob, size int64, buf []byte, off int64) (int, error) {
+	if int64(len(buf)) > size-off {
+		if off >= size {
+			return 0, io.EOF
+		}
+		buf = buf[:size-off]
+	}
+	n := 0
+	for n < len(buf) {
+		m, err := readFrame(opts, b, buf[n:], off+int64(n))
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// readFrame reads the content at off into buf, from the frame that contains off.
+func readFrame(opts Options, b *blobcompress.Blob, buf []byte, off int64) (int, error) {
+	c, err := b.Compression()
+	if err != nil {
+		return 0, err
+	}
+	i, compressedOff, frameOff, err := b.Frame(off)
+	if err != nil {
+		return 0, err
+	}
+	if rest := b.FrameSize - frameOff; int64(len(buf)) > rest {
+		buf = buf[:rest]
+	}
+	r, err := pullRange(opts, spec.Descriptor{Digest: b.Digest, Size: b.Size}, compressedOff, b.Frames[i])
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	dr, err := layerutil.Decompress(c, r)
+	if err != nil {
+		return 0, err
+	}
+	defer dr.Close()
+	if _, err := io.CopyN(ioutil.Discard, dr, frameOff); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(dr, buf)
+}
+
+// pullRange pulls n bytes of the blob from off.
+// The whole blob is pulled if the puller does not implement puller.RangePuller.
+func pullRange(opts Options, desc spec.Descriptor, off, n int64) (io.ReadCloser, error) {
+	if rp, ok := opts.Puller.(puller.RangePuller); ok {
+		return rp.PullBlobRange(opts.Image, desc, off, n)
+	}
+	br, err := opts.Puller.PullBlob(opts.Image, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := br.Seek(off, io.SeekStart); err != nil {
+		br.Close()
+		return nil, err
+	}
+	return &limitedReadCloser{Reader: io.LimitReader(br, n), Closer: br}, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -3,34 +3,172 @@ package lazyfs
 import (
 	"fmt"
 	"os"
+	"sort"
+	"time"
 
-	"github.com/AkihiroSuda/filegrain/continuityutil"
 	continuitypb "github.com/containerd/continuity/proto"
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/blobcompress"
+	"github.com/AkihiroSuda/filegrain/cdc"
+	"github.com/AkihiroSuda/filegrain/continuityutil"
+	"github.com/AkihiroSuda/filegrain/layerutil"
+	"github.com/AkihiroSuda/filegrain/mtime"
 )
 
-func loadTree(opts Options) (*nodeManager, error) {
-	imageManifest, err := loadImageManifest(opts)
+// entry is the value of the tree nodes.
+type entry struct {
+	res *continuitypb.Resource
+	// tarMember is set if the content is stored in a tar layer,
+	// rather than in the blob specified by res.Digest.
+	tarMember *tarMember
+	// chunks is set if the content is stored as the chunk blobs,
+	// rather than in the blob specified by res.Digest.
+	chunks []cdc.Chunk
+	// compression is the compression map of the continuity manifest layer, or nil.
+	// The contents (or the chunks) in the map are stored as the compressed blobs.
+	compression *blobcompress.Map
+	// mtime is zero if unknown
+	mtime time.Time
+	// ino and nlink are set by assignInodes
+	ino   uint64
+	nlink uint32
+}
+
+func newImplicitDirEntry() *entry {
+	return &entry{
+		res: &continuitypb.Resource{
+			Mode: uint32(os.ModeDir | 0755),
+		},
+	}
+}
+
+// blobDigest returns the digest of the blob that contains the content.
+// For a chunked file, the digest of the whole content is returned.
+// Returns an empty digest if the entry has no content.
+func (e *entry) blobDigest() digest.Digest {
+	if e.tarMember != nil {
+		return e.tarMember.layer.desc.Digest
+	}
+	if len(e.res.Digest) == 0 {
+		return ""
+	}
+	if e.chunks != nil {
+		return digest.Digest(e.res.Digest[0])
+	}
+	return e.storedDigest(digest.Digest(e.res.Digest[0]))
+}
+
+// storedDigest returns the digest of the blob that stores the content (or the chunk) d.
+func (e *entry) storedDigest(d digest.Digest) digest.Digest {
+	if b := e.compression.Lookup(d); b != nil {
+		return b.Digest
+	}
+	return d
+}
+
+// loadMtimeMap loads the mtime map of the continuity manifest layer.
+// Returns nil if the layer has no mtime map.
+func loadMtimeMap(opts Options, layer *spec.Descriptor) (*mtime.Map, error) {
+	s, ok := layer.Annotations[mtime.Annotation]
+	if !ok {
+		return nil, nil
+	}
+	d, err := digest.Parse(s)
 	if err != nil {
 		return nil, err
 	}
-	nm := newNodeManager("/")           // "/" = path sep (not root dir)
-	nm.root.x = &continuitypb.Resource{ // set root content (unlikely to appear in the manifest)
-		Mode: uint32(os.ModeDir | 0755),
+	b, err := loadBlobWithDescriptor(opts, &spec.Descriptor{Digest: d})
+	if err != nil {
+		return nil, err
 	}
+	return mtime.Unmarshal(b)
+}
+
+func loadTree(opts Options, imageManifest *spec.Manifest) (*nodeManager, error) {
+	nm := newNodeManager("/")         // "/" = path sep (not root dir)
+	nm.root.x = newImplicitDirEntry() // set root content (unlikely to appear in the manifest)
 	for _, layer := range imageManifest.Layers {
-		// TODO: support mixing up tar layers and continutiy layers..
-		if layer.MediaType != continuityutil.MediaTypeManifestV0Protobuf {
+		switch {
+		case layer.MediaType == continuityutil.MediaTypeManifestV0Protobuf:
+			pb, err := loadContinuityPBManifest(opts, &layer)
+			if err != nil {
+				return nil, err
+			}
+			chunkMap, err := loadChunkMap(opts, &layer)
+			if err != nil {
+				return nil, fmt.Errorf("error while loading the chunk map for %s: %v", layer.Digest, err)
+			}
+			compressionMap, err := loadCompressionMap(opts, &layer)
+			if err != nil {
+				return nil, fmt.Errorf("error while loading the compression map for %s: %v", layer.Digest, err)
+			}
+			mtimeMap, err := loadMtimeMap(opts, &layer)
+			if err != nil {
+				return nil, fmt.Errorf("error while loading the mtime map for %s: %v", layer.Digest, err)
+			}
+			for _, resource := range pb.Resource {
+				e := &entry{res: resource, compression: compressionMap}
+				if len(resource.Path) > 0 {
+					e.mtime = mtimeMap.Lookup(resource.Path[0])
+				}
+				if chunkMap != nil && len(resource.Digest) > 0 {
+					e.chunks = chunkMap.Files[digest.Digest(resource.Digest[0])]
+				}
+				for _, path := range resource.Path {
+					nm.insert(path, e)
+				}
+			}
+		case layerutil.IsTarLayer(layer.MediaType):
+			if err := loadTarLayer(opts, nm, &layer); err != nil {
+				return nil, err
+			}
+		default:
 			return nil, fmt.Errorf("unsupported layer mediaType: %s", layer.MediaType)
 		}
-		pb, err := loadContinuityPBManifest(opts, &layer)
-		if err != nil {
-			return nil, err
+	}
+	// tar layers may lack the entries for the parent directories
+	nm.root.walk(nm.sep, nm.sep, func(path string, n *node) {
+		if n.x == nil {
+			n.x = newImplicitDirEntry()
+		}
+	})
+	assignInodes(nm)
+	return nm, nil
+}
+
+// assignInodes assigns the inode numbers and the link counts to the entries of the tree.
+// The inode numbers are assigned in the lexical order of the paths, so that
+// the same image always yields the same inode numbers.
+// The paths that share an entry (i.e. hardlinks) share the inode number.
+func assignInodes(nm *nodeManager) {
+	nodes := make(map[string]*node, 0)
+	var paths []string
+	nm.root.walk(nm.sep, nm.sep, func(path string, n *node) {
+		nodes[path] = n
+		paths = append(paths, path)
+	})
+	sort.Strings(paths)
+	var ino uint64
+	for _, path := range paths {
+		n := nodes[path]
+		e := n.x.(*entry)
+		if e.ino == 0 {
+			ino++ // the root directory is 1
+			e.ino = ino
 		}
-		for _, resource := range pb.Resource {
-			for _, path := range resource.Path {
-				nm.insert(path, resource)
+		if e.res.Mode&uint32(os.ModeDir) != 0 {
+			// "." and the entry in the parent, plus ".." of the subdirectories
+			e.nlink = 2
+			for _, child := range n.m {
+				if c, ok := child.x.(*entry); ok && c.res.Mode&uint32(os.ModeDir) != 0 {
+					e.nlink++
+				}
 			}
+		} else {
+			// count the paths that still refer to the entry, as later layers may replace some of them
+			e.nlink++
 		}
 	}
-	return nm, nil
 }
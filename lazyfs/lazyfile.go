@@ -2,24 +2,36 @@ package lazyfs
 
 import (
 	"io"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/opencontainers/go-digest"
-	continuitypb "github.com/containerd/continuity/proto"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/puller"
 )
 
 type file struct {
 	opts Options
-	res  *continuitypb.Resource
+	// path is the path used for opening the file
+	path string
+	e    *entry
+	// mu protects br
+	mu sync.Mutex
+	// br is opened on the first Read, and kept open until Release,
+	// so that the blob is not evicted from the cache while the file is open.
+	br image.BlobReader
 	nodefs.File
 }
 
-func newFile(opts Options, res *continuitypb.Resource) nodefs.File {
+func newFile(opts Options, path string, e *entry) nodefs.File {
 	f := new(file)
 	f.opts = opts
-	f.res = res
+	f.path = path
+	f.e = e
 	f.File = nodefs.NewDefaultFile()
 	cached := &nodefs.WithFlags{
 		File:      f,
@@ -29,36 +41,98 @@ func newFile(opts Options, res *continuitypb.Resource) nodefs.File {
 }
 
 func (f *file) GetAttr(out *fuse.Attr) fuse.Status {
-	*out = *continuityResourceToFuseAttr(f.res)
+	*out = *f.e.attr()
 	return fuse.OK
 }
 
 func (f *file) Read(buf []byte, off int64) (res fuse.ReadResult, code fuse.Status) {
-	if len(f.res.Digest) == 0 {
-		logrus.Errorf("no digest for %#v", f.res)
-		return nil, fuse.EIO
+	if f.opts.Recorder != nil {
+		f.opts.Recorder.Record(f.path, f.e.blobDigest())
 	}
-	dgst := digest.Digest(f.res.Digest[0])
-	br, err := f.opts.Puller.PullBlob(f.opts.Image, dgst)
-	if err != nil {
-		logrus.Errorf("error while pulling %s: %v", dgst, err)
+	if m := f.e.tarMember; m != nil {
+		n, err := readTarMember(f.opts, m, int64(f.e.res.Size), buf, off)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			logrus.Errorf("error while reading %d bytes at %d for %v in %s: %v",
+				len(buf), off, f.e.res.Path, m.layer.desc.Digest, err)
+			return nil, fuse.EIO
+		}
+		return fuse.ReadResultData(buf[:n]), fuse.OK
+	}
+	if f.e.chunks != nil {
+		n, err := readChunks(f.opts, f.e, buf, off)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			logrus.Errorf("error while reading %d bytes at %d for %v: %v", len(buf), off, f.e.res.Path, err)
+			return nil, fuse.EIO
+		}
+		return fuse.ReadResultData(buf[:n]), fuse.OK
+	}
+	if len(f.e.res.Digest) == 0 {
+		logrus.Errorf("no digest for %#v", f.e.res)
 		return nil, fuse.EIO
 	}
-	if _, err := br.Seek(off, 0); err != nil {
+	dgst := digest.Digest(f.e.res.Digest[0])
+	if b := f.e.compression.Lookup(dgst); b != nil {
+		n, err := readCompressed(f.opts, b, int64(f.e.res.Size), buf, off)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			logrus.Errorf("error while reading %d bytes at %d for %v in %s: %v", len(buf), off, f.e.res.Path, b.Digest, err)
+			return nil, fuse.EIO
+		}
+		return fuse.ReadResultData(buf[:n]), fuse.OK
+	}
+	if rp, ok := f.opts.Puller.(puller.RangePuller); ok && int64(f.e.res.Size) > f.opts.rangeThreshold() {
+		return f.readRange(rp, dgst, buf, off)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.br == nil {
+		br, err := f.opts.Puller.PullBlob(f.opts.Image, dgst)
+		if err != nil {
+			logrus.Errorf("error while pulling %s: %v", dgst, err)
+			return nil, fuse.EIO
+		}
+		f.br = br
+	}
+	if _, err := f.br.Seek(off, 0); err != nil {
 		logrus.Errorf("error while seeking %s to %d: %v", dgst, off, err)
 		return nil, fuse.EIO
 	}
-	if n, err := br.Read(buf); err == io.EOF {
-		buf = buf[:n]
-	} else if err != nil {
+	n, err := io.ReadFull(f.br, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		logrus.Errorf("error while reading %d bytes at %d for %s: %v",
 			len(buf), off, dgst, err)
 		return nil, fuse.EIO
 	}
-	if err := br.Close(); err != nil {
-		logrus.Errorf("error while closing after reading %d bytes at %d for %s: %v",
-			len(buf), off, dgst, err)
+	return fuse.ReadResultData(buf[:n]), fuse.OK
+}
+
+// readRange reads the range without pulling the whole blob.
+func (f *file) readRange(rp puller.RangePuller, dgst digest.Digest, buf []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	desc := spec.Descriptor{Digest: dgst, Size: int64(f.e.res.Size)}
+	if off >= desc.Size {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
+	r, err := rp.PullBlobRange(f.opts.Image, desc, off, int64(len(buf)))
+	if err != nil {
+		logrus.Errorf("error while pulling %d bytes at %d for %s: %v", len(buf), off, dgst, err)
+		return nil, fuse.EIO
+	}
+	defer r.Close()
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		logrus.Errorf("error while reading %d bytes at %d for %s: %v", len(buf), off, dgst, err)
 		return nil, fuse.EIO
 	}
-	return fuse.ReadResultData(buf), fuse.OK
+	return fuse.ReadResultData(buf[:n]), fuse.OK
+}
+
+func (f *file) Release() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.br == nil {
+		return
+	}
+	if err := f.br.Close(); err != nil {
+		logrus.Errorf("error while closing %v: %v", f.e.res.Path, err)
+	}
+	f.br = nil
 }
@@ -1,15 +1,21 @@
 package lazyfs
 
 import (
+	"fmt"
 	"os"
+	"path"
+	"strings"
 	"syscall"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/hanwen/go-fuse/fuse"
 	"github.com/hanwen/go-fuse/fuse/nodefs"
 	"github.com/hanwen/go-fuse/fuse/pathfs"
-	continuitypb "github.com/containerd/continuity/proto"
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
 
+	"github.com/AkihiroSuda/filegrain/profile"
 	"github.com/AkihiroSuda/filegrain/puller"
 )
 
@@ -19,54 +25,117 @@ import (
 //
 // Supported objects:
 //  - directories
-//  - regular files (including hardlinks) (excepts XAttrs)
+//  - regular files (including hardlinks)
 //  - symbolic links
+//  - character and block devices, named pipes, and sockets
+//    (the kernel handles the I/O of these objects, as usual for FUSE)
+//
+// Supported layers:
+//  - continuity manifest (application/vnd.continuity.manifest.v0+pb)
+//  - tar (application/vnd.oci.image.layer.v1.tar, and its gzip and zstd variants)
 type FS struct {
 	pathfs.FileSystem
 	opts Options
 	tree *nodeManager
 }
 
-func continuityResourceToFuseAttr(res *continuitypb.Resource) *fuse.Attr {
+func (e *entry) attr() *fuse.Attr {
+	res := e.res
 	mode := res.Mode & uint32(os.ModePerm)
 	siz := res.Size
+	var rdev uint32
 	switch res.Mode & uint32(os.ModeType) {
 	case uint32(os.ModeDir):
 		mode |= syscall.S_IFDIR
 	case uint32(os.ModeSymlink):
 		mode |= syscall.S_IFLNK
+	case uint32(os.ModeDevice | os.ModeCharDevice):
+		mode |= syscall.S_IFCHR
+		rdev = uint32(unix.Mkdev(uint32(res.Major), uint32(res.Minor)))
+	case uint32(os.ModeDevice):
+		mode |= syscall.S_IFBLK
+		rdev = uint32(unix.Mkdev(uint32(res.Major), uint32(res.Minor)))
+	case uint32(os.ModeNamedPipe):
+		mode |= syscall.S_IFIFO
+	case uint32(os.ModeSocket):
+		mode |= syscall.S_IFSOCK
 	case 0:
 		mode |= syscall.S_IFREG
 	}
-	return &fuse.Attr{
-		Mode: mode,
-		Size: siz,
-		// Times are not supported in current continuity
+	if res.Mode&uint32(os.ModeSetuid) != 0 {
+		mode |= syscall.S_ISUID
+	}
+	if res.Mode&uint32(os.ModeSetgid) != 0 {
+		mode |= syscall.S_ISGID
+	}
+	if res.Mode&uint32(os.ModeSticky) != 0 {
+		mode |= syscall.S_ISVTX
+	}
+	attr := &fuse.Attr{
+		Ino:   e.ino,
+		Mode:  mode,
+		Size:  siz,
+		Nlink: e.nlink,
+		Rdev:  rdev,
+		Owner: fuse.Owner{
+			Uid: uint32(res.Uid),
+			Gid: uint32(res.Gid),
+		},
+	}
+	// continuity lacks the times, so the mtime is recorded in the sidecar mtime map
+	if !e.mtime.IsZero() {
+		attr.SetTimes(&e.mtime, &e.mtime, &e.mtime)
 	}
+	return attr
 }
 
-func (fs *FS) lookup(name string) (*continuitypb.Resource, fuse.Status) {
+func (fs *FS) lookup(name string) (*entry, fuse.Status) {
 	n := fs.tree.lookup(name)
 	if n == nil {
 		return nil, fuse.ENOENT
 	}
-	res, ok := n.x.(*continuitypb.Resource)
+	e, ok := n.x.(*entry)
 	if !ok {
-		logrus.Errorf("can't convert %#v to *continuitypb.Resource while looking up %q", n.x, name)
+		logrus.Errorf("can't convert %#v to *entry while looking up %q", n.x, name)
 		return nil, fuse.EIO
 	}
-	return res, fuse.OK
+	return e, fuse.OK
 }
 
 func (fs *FS) GetAttr(name string, fc *fuse.Context) (*fuse.Attr, fuse.Status) {
-	res, st := fs.lookup(name)
+	e, st := fs.lookup(name)
 	if st != fuse.OK {
 		return nil, st
 	}
-	attr := continuityResourceToFuseAttr(res)
+	attr := e.attr()
 	return attr, fuse.OK
 }
 
+func (fs *FS) GetXAttr(name string, attribute string, fc *fuse.Context) ([]byte, fuse.Status) {
+	e, st := fs.lookup(name)
+	if st != fuse.OK {
+		return nil, st
+	}
+	for _, x := range e.res.Xattr {
+		if x.Name == attribute {
+			return x.Data, fuse.OK
+		}
+	}
+	return nil, fuse.ENOATTR
+}
+
+func (fs *FS) ListXAttr(name string, fc *fuse.Context) ([]string, fuse.Status) {
+	e, st := fs.lookup(name)
+	if st != fuse.OK {
+		return nil, st
+	}
+	var attrs []string
+	for _, x := range e.res.Xattr {
+		attrs = append(attrs, x.Name)
+	}
+	return attrs, fuse.OK
+}
+
 func (fs *FS) OpenDir(name string, fc *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
 	n := fs.tree.lookup(name)
 	if n == nil {
@@ -74,34 +143,38 @@ func (fs *FS) OpenDir(name string, fc *fuse.Context) ([]fuse.DirEntry, fuse.Stat
 	}
 	var ents []fuse.DirEntry
 	for k, v := range n.m {
-		res, ok := v.x.(*continuitypb.Resource)
+		e, ok := v.x.(*entry)
 		if !ok {
-			logrus.Errorf("can't convert %#v to *continuitypb.Resource while opendir %q, %q", n.x, name, k)
+			logrus.Errorf("can't convert %#v to *entry while opendir %q, %q", n.x, name, k)
 			return nil, fuse.EIO
 		}
-		mode := res.Mode // FIXME?
+		// the type bits are used for d_type
 		ents = append(ents, fuse.DirEntry{
 			Name: k,
-			Mode: mode,
+			Mode: e.attr().Mode,
 		})
 	}
 	return ents, fuse.OK
 }
 
 func (fs *FS) Open(name string, flags uint32, fc *fuse.Context) (nodefs.File, fuse.Status) {
-	res, st := fs.lookup(name)
+	e, st := fs.lookup(name)
 	if st != fuse.OK {
 		return nil, st
 	}
-	return newFile(fs.opts, res), fuse.OK
+	p := "/" + name
+	if fs.opts.Recorder != nil {
+		fs.opts.Recorder.Record(p, e.blobDigest())
+	}
+	return newFile(fs.opts, p, e), fuse.OK
 }
 
 func (fs *FS) Readlink(name string, fc *fuse.Context) (string, fuse.Status) {
-	res, st := fs.lookup(name)
+	e, st := fs.lookup(name)
 	if st != fuse.OK {
 		return "", st
 	}
-	return res.Target, fuse.OK
+	return e.res.Target, fuse.OK
 }
 
 type Options struct {
@@ -109,10 +182,41 @@ type Options struct {
 	Puller     puller.Puller
 	Image      string
 	RefName    string
+	// Recorder records the accesses if non-nil.
+	Recorder *profile.Recorder
+	// RangeThreshold is the size of the files to be read partially, when Puller implements puller.RangePuller.
+	// Smaller files are read after pulling the whole blob.
+	// Defaults to puller.DefaultChunkSize.
+	RangeThreshold int64
+	// AllowDev allows opening the device nodes in the image.
+	// Otherwise the filesystem is mounted with "nodev", as the device nodes of an untrusted image
+	// could expose the host devices.
+	AllowDev bool
+	// AllowSUID honors the setuid and setgid bits in the image.
+	// Otherwise the filesystem is mounted with "nosuid".
+	AllowSUID bool
 }
 
+func (opts Options) rangeThreshold() int64 {
+	if opts.RangeThreshold > 0 {
+		return opts.RangeThreshold
+	}
+	return puller.DefaultChunkSize
+}
+
+// NewFS loads the image.
+// The blobs are verified via puller.NewVerifyingPuller(opts.Puller).
+// Unless opts.Puller is a puller.BlobCacher, the files are read after pulling and verifying the whole blobs.
+// If the image has the prefetch profile and opts.Puller implements puller.Prefetcher,
+// the blobs in the profile are prefetched in background.
 func NewFS(opts Options) (*FS, error) {
-	tree, err := loadTree(opts)
+	// every blob is verified centrally, so that a tampered blob cannot feed bad data
+	opts.Puller = puller.NewVerifyingPuller(opts.Puller, 0)
+	imageManifest, err := loadImageManifest(opts)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := loadTree(opts, imageManifest)
 	if err != nil {
 		return nil, err
 	}
@@ -121,15 +225,140 @@ func NewFS(opts Options) (*FS, error) {
 		opts:       opts,
 		tree:       tree,
 	}
+	if pf, ok := opts.Puller.(puller.Prefetcher); ok {
+		if err := fs.prefetch(pf, imageManifest); err != nil {
+			logrus.Warnf("error while loading the prefetch profile: %v", err)
+		}
+	}
 	return fs, nil
 }
 
+// prefetch starts prefetching the blobs in the prefetch profile.
+// The blobs are looked up by the paths in the profile, so that the profile
+// recorded for an older version of the image can be used as well.
+func (fs *FS) prefetch(pf puller.Prefetcher, imageManifest *spec.Manifest) error {
+	s, ok := imageManifest.Annotations[profile.Annotation]
+	if !ok {
+		return nil
+	}
+	d, err := digest.Parse(s)
+	if err != nil {
+		return err
+	}
+	b, err := loadBlobWithDescriptor(fs.opts, &spec.Descriptor{Digest: d})
+	if err != nil {
+		return err
+	}
+	prof, err := profile.Unmarshal(b)
+	if err != nil {
+		return err
+	}
+	var ds blobDigests
+	for _, pe := range prof.Entries {
+		p, err := cleanPath(pe.Path)
+		if err != nil {
+			logrus.Warnf("Skipping %q in the prefetch profile %s: %v", pe.Path, d, err)
+			continue
+		}
+		if n := fs.tree.lookup(p); n != nil {
+			ds.add(n)
+		}
+	}
+	logrus.Infof("Prefetching %d blobs (profile %s)", len(ds.ds), d)
+	pf.Prefetch(fs.opts.Image, ds.ds)
+	return nil
+}
+
+// Prefetch prefetches the blobs for the files under the path in background.
+// e.g. "/" for the whole image.
+func (fs *FS) Prefetch(path string) error {
+	pf, ok := fs.opts.Puller.(puller.Prefetcher)
+	if !ok {
+		return fmt.Errorf("puller %T does not support prefetching", fs.opts.Puller)
+	}
+	path, err := cleanPath(path)
+	if err != nil {
+		return err
+	}
+	n := fs.tree.lookup(path)
+	if n == nil {
+		return fmt.Errorf("%s: %v", path, os.ErrNotExist)
+	}
+	var ds blobDigests
+	n.walk(path, fs.tree.sep, func(_ string, n *node) {
+		ds.add(n)
+	})
+	logrus.Infof("Prefetching %d blobs (%s)", len(ds.ds), path)
+	pf.Prefetch(fs.opts.Image, ds.ds)
+	return nil
+}
+
+// cleanPath cleans the path given from outside of the tree (e.g. from a prefetch profile),
+// as the tree does not accept "." and ".." as path elements.
+// Paths containing ".." are rejected.
+func cleanPath(p string) (string, error) {
+	for _, s := range strings.Split(p, "/") {
+		if s == ".." {
+			return "", fmt.Errorf("invalid path %q: contains \"..\"", p)
+		}
+	}
+	return path.Clean("/" + p), nil
+}
+
+// blobDigests is the list of the blob digests without duplicates.
+type blobDigests struct {
+	ds   []digest.Digest
+	seen map[digest.Digest]struct{}
+}
+
+// add adds the digests of the blobs for the node, if any.
+func (bd *blobDigests) add(n *node) {
+	e, ok := n.x.(*entry)
+	if !ok {
+		return
+	}
+	if e.chunks != nil {
+		for _, c := range e.chunks {
+			bd.addDigest(e.storedDigest(c.Digest))
+		}
+		return
+	}
+	if d := e.blobDigest(); d != "" {
+		bd.addDigest(d)
+	}
+}
+
+func (bd *blobDigests) addDigest(d digest.Digest) {
+	if bd.seen == nil {
+		bd.seen = make(map[digest.Digest]struct{}, 0)
+	}
+	if _, dup := bd.seen[d]; dup {
+		return
+	}
+	bd.seen[d] = struct{}{}
+	bd.ds = append(bd.ds, d)
+}
+
 func NewServer(fs *FS) (*fuse.Server, error) {
-	nfs := pathfs.NewPathNodeFs(pathfs.NewReadonlyFileSystem(fs), nil)
+	nfs := pathfs.NewPathNodeFs(pathfs.NewReadonlyFileSystem(fs), &pathfs.PathNodeFsOptions{
+		// use the inode numbers returned by GetAttr, so that hardlinks share the kernel inode
+		ClientInodes: true,
+	})
 	conn := nodefs.NewFileSystemConnector(nfs.Root(), nil)
-	return fuse.NewServer(conn.RawFS(), fs.opts.Mountpoint,
-		&fuse.MountOptions{
-			FsName: fs.opts.Mountpoint + ":" + fs.opts.RefName,
-			Name:   "filegrain.lazyfs",
-		})
+	mountOpts := &fuse.MountOptions{
+		FsName: fs.opts.Mountpoint + ":" + fs.opts.RefName,
+		Name:   "filegrain.lazyfs",
+	}
+	// fusermount rejects "dev" and "suid" for non-root users
+	if fs.opts.AllowDev {
+		mountOpts.Options = append(mountOpts.Options, "dev")
+	} else {
+		mountOpts.Options = append(mountOpts.Options, "nodev")
+	}
+	if fs.opts.AllowSUID {
+		mountOpts.Options = append(mountOpts.Options, "suid")
+	} else {
+		mountOpts.Options = append(mountOpts.Options, "nosuid")
+	}
+	return fuse.NewServer(conn.RawFS(), fs.opts.Mountpoint, mountOpts)
 }
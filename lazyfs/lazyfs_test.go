@@ -0,0 +1,493 @@
+package lazyfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	continuitypb "github.com/containerd/continuity/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/hanwen/go-fuse/fuse"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+
+	"github.com/AkihiroSuda/filegrain/builder"
+	"github.com/AkihiroSuda/filegrain/continuityutil"
+	"github.com/AkihiroSuda/filegrain/gzindex"
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/image/imageutil"
+	"github.com/AkihiroSuda/filegrain/layerutil"
+	"github.com/AkihiroSuda/filegrain/profile"
+	"github.com/AkihiroSuda/filegrain/puller"
+	"github.com/AkihiroSuda/filegrain/tartoc"
+)
+
+type testPrefetcher struct {
+	*puller.LocalPuller
+	prefetched []digest.Digest
+}
+
+func (p *testPrefetcher) Prefetch(img string, ds []digest.Digest) {
+	p.prefetched = append(p.prefetched, ds...)
+}
+
+func TestPrefetchProfile(t *testing.T) {
+	img, err := ioutil.TempDir("", "filegrain-test-lazyfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(img)
+	if err := image.Init(img); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		resources []*continuitypb.Resource
+		digests   = make(map[string]digest.Digest, 0)
+	)
+	for _, p := range []string{"/a", "/b", "/c"} {
+		d, err := image.WriteBlob(img, []byte(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		digests[p] = d
+		resources = append(resources, &continuitypb.Resource{
+			Path: []string{p}, Mode: 0644, Size: uint64(len(p)), Digest: []string{d.String()},
+		})
+	}
+	contM, err := proto.Marshal(&continuitypb.Manifest{Resource: resources})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDesc, err := imageutil.WriteJSONBlob(img, &spec.Image{}, spec.MediaTypeImageConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDesc, err := imageutil.WriteJSONBlob(img, &spec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    *configDesc,
+		Layers:    []spec.Descriptor{testWriteLayer(t, img, continuityutil.MediaTypeManifestV0Protobuf, contM)},
+	}, spec.MediaTypeImageManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDesc.Annotations = map[string]string{image.RefNameAnnotation: "latest"}
+	if err := image.PutManifestDescriptorToIndex(img, manifestDesc); err != nil {
+		t.Fatal(err)
+	}
+
+	// record
+	opts := Options{
+		Puller:   puller.NewLocalPuller(),
+		Image:    img,
+		RefName:  "latest",
+		Recorder: profile.NewRecorder(),
+	}
+	fs, err := NewFS(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"c", "a", "c"} {
+		if _, st := fs.Open(name, 0, nil); !st.Ok() {
+			t.Fatalf("failed to open %s: %v", name, st)
+		}
+	}
+	prof := opts.Recorder.Profile()
+	expectedEntries := []profile.Entry{{Path: "/c", Digest: digests["/c"]}, {Path: "/a", Digest: digests["/a"]}}
+	if !reflect.DeepEqual(prof.Entries, expectedEntries) {
+		t.Fatalf("expected %+v, got %+v", expectedEntries, prof.Entries)
+	}
+
+	// store, with the crafted paths that must not crash the mount
+	prof.Entries = append(prof.Entries, profile.Entry{Path: "/../c"}, profile.Entry{Path: "./b/."})
+	profDesc, err := imageutil.WriteJSONBlob(img, prof, profile.MediaType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := imageutil.UpdateManifest(img, "latest", func(m *spec.Manifest) error {
+		m.Annotations = map[string]string{profile.Annotation: profDesc.Digest.String()}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// prefetch
+	pf := &testPrefetcher{LocalPuller: puller.NewLocalPuller()}
+	opts = Options{
+		Puller:  pf,
+		Image:   img,
+		RefName: "latest",
+	}
+	if _, err := NewFS(opts); err != nil {
+		t.Fatal(err)
+	}
+	expectedPrefetched := []digest.Digest{digests["/c"], digests["/a"], digests["/b"]}
+	if !reflect.DeepEqual(pf.prefetched, expectedPrefetched) {
+		t.Fatalf("expected %v, got %v", expectedPrefetched, pf.prefetched)
+	}
+}
+
+// buildTestImage builds the image "latest" from a rootfs with the files, in a temporary directory.
+// The paths ending with "/" are created as directories.
+// setup is called with the rootfs before building, if non-nil.
+// Returns the image directory and the function to remove the temporary directory.
+func buildTestImage(t *testing.T, files map[string]string, opts builder.Options, setup func(rootfs string)) (string, func()) {
+	tmpDir, err := ioutil.TempDir("", "filegrain-test-lazyfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+	built := false
+	defer func() {
+		// setup may call t.Skip
+		if !built {
+			cleanup()
+		}
+	}()
+	rootfs, img := filepath.Join(tmpDir, "rootfs"), filepath.Join(tmpDir, "img")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for p, content := range files {
+		if strings.HasSuffix(p, "/") {
+			if err := os.MkdirAll(filepath.Join(rootfs, p), 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(rootfs, filepath.Dir(p)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(rootfs, p), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if setup != nil {
+		setup(rootfs)
+	}
+	b, err := builder.NewBuilderWithRootFS(rootfs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Build(img, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	built = true
+	return img, cleanup
+}
+
+// newTestFS loads the image "latest" via p.
+func newTestFS(t *testing.T, p puller.Puller, img string) *FS {
+	fs, err := NewFS(Options{
+		Puller:  p,
+		Image:   img,
+		RefName: "latest",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+// buildTestFS is similar to buildTestImage, but loads the image via LocalPuller.
+func buildTestFS(t *testing.T, files map[string]string, opts builder.Options, setup func(rootfs string)) (*FS, string, func()) {
+	img, cleanup := buildTestImage(t, files, opts, setup)
+	return newTestFS(t, puller.NewLocalPuller(), img), img, cleanup
+}
+
+func TestChunkedAndCompressedFiles(t *testing.T) {
+	testCases := map[string]struct {
+		opts       builder.Options
+		chunked    bool
+		compressed bool
+	}{
+		"chunk":      {builder.Options{ChunkThreshold: 1024, ChunkAvgSize: 16 << 10}, true, false},
+		"zstd":       {builder.Options{Compression: layerutil.Zstd}, false, true},
+		"chunk+gzip": {builder.Options{ChunkThreshold: 1024, ChunkAvgSize: 16 << 10, Compression: layerutil.Gzip}, true, true},
+	}
+	for name, tc := range testCases {
+		testChunkedAndCompressedFiles(t, name, tc.opts, tc.chunked, tc.compressed)
+	}
+}
+
+func testChunkedAndCompressedFiles(t *testing.T, name string, opts builder.Options, chunked, compressed bool) {
+	// compressible, but not repetitive
+	big := make([]byte, 3<<20)
+	rnd := rand.New(rand.NewSource(42))
+	for i := range big {
+		big[i] = "abcd"[rnd.Intn(4)]
+	}
+	fs, img, cleanup := buildTestFS(t, map[string]string{"big": string(big), "small": "small"}, opts, nil)
+	defer cleanup()
+	if _, err := image.GetBlobReader(img, digest.FromBytes(big)); err == nil {
+		t.Fatalf("%s: the whole uncompressed content should not be stored", name)
+	}
+	e, _ := fs.lookup("big")
+	if chunked != (len(e.chunks) >= 2) {
+		t.Fatalf("%s: unexpected %d chunks", name, len(e.chunks))
+	}
+	if compressed != (e.compression != nil) {
+		t.Fatalf("%s: unexpected compression map %v", name, e.compression)
+	}
+	for _, p := range []string{"big", "small"} {
+		expected := big
+		if p == "small" {
+			expected = []byte("small")
+		}
+		f, st := fs.Open(p, 0, nil)
+		if !st.Ok() {
+			t.Fatal(st)
+		}
+		for _, off := range []int64{0, 1000, 1<<20 - 10, int64(len(expected)) - 10} {
+			if off < 0 || off > int64(len(expected)) {
+				continue
+			}
+			buf := make([]byte, 4096)
+			res, st := f.Read(buf, off)
+			if !st.Ok() {
+				t.Fatalf("%s: %v", name, st)
+			}
+			got, _ := res.Bytes(buf)
+			end := off + 4096
+			if end > int64(len(expected)) {
+				end = int64(len(expected))
+			}
+			if !bytes.Equal(got, expected[off:end]) {
+				t.Fatalf("%s: unexpected content of %s at %d", name, p, off)
+			}
+		}
+		f.Release()
+	}
+}
+
+type testRecordingPuller struct {
+	*puller.LocalPuller
+	pulled []digest.Digest
+}
+
+func (p *testRecordingPuller) PullBlob(img string, d digest.Digest) (image.BlobReader, error) {
+	p.pulled = append(p.pulled, d)
+	return p.LocalPuller.PullBlob(img, d)
+}
+
+func TestPackedFiles(t *testing.T) {
+	files := map[string]string{
+		"/etc/hostname":                "host",
+		"/etc/large":                   "this file is larger than the threshold",
+		"/usr/share/locale/ja/LC_FOOS": "this file is under the pack dir",
+	}
+	img, cleanup := buildTestImage(t, files, builder.Options{
+		PackThreshold: 16,
+		PackDirs:      []string{"/usr/share/locale"},
+		Compression:   layerutil.Gzip,
+	}, func(rootfs string) {
+		if err := os.Link(filepath.Join(rootfs, "/etc/hostname"), filepath.Join(rootfs, "/etc/hostname2")); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer cleanup()
+	files["/etc/hostname2"] = files["/etc/hostname"]
+	opts := Options{
+		Puller:  puller.NewLocalPuller(),
+		Image:   img,
+		RefName: "latest",
+	}
+	imageManifest, err := loadImageManifest(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(imageManifest.Layers); n != 2 {
+		t.Fatalf("expected a continuity layer and a tar layer, got %d layers", n)
+	}
+	l := imageManifest.Layers[1]
+	if l.MediaType != spec.MediaTypeImageLayerGzip || l.Annotations[gzindex.IndexAnnotation] == "" || l.Annotations[tartoc.Annotation] == "" {
+		t.Fatalf("expected a gzip tar layer with the index and the TOC, got %+v", l)
+	}
+	rp := &testRecordingPuller{LocalPuller: puller.NewLocalPuller()}
+	fs := newTestFS(t, rp, img)
+	for _, d := range rp.pulled {
+		if d == l.Digest {
+			t.Fatal("the tar layer should not be pulled on mounting, as the layer has the TOC")
+		}
+	}
+	for p, content := range files {
+		e, st := fs.lookup(p[1:])
+		if !st.Ok() {
+			t.Fatalf("%s: %v", p, st)
+		}
+		if packed := e.tarMember != nil; packed == (p == "/etc/large") {
+			t.Errorf("%s: unexpected packing %v", p, packed)
+		}
+		f, st := fs.Open(p[1:], 0, nil)
+		if !st.Ok() {
+			t.Fatalf("%s: %v", p, st)
+		}
+		buf := make([]byte, 64)
+		res, st := f.Read(buf, 0)
+		if !st.Ok() {
+			t.Fatalf("%s: %v", p, st)
+		}
+		if got, _ := res.Bytes(buf); string(got) != content {
+			t.Errorf("%s: expected %q, got %q", p, content, string(got))
+		}
+		f.Release()
+	}
+	if e, _ := fs.lookup("etc/hostname"); len(e.res.Path) != 2 {
+		t.Errorf("expected hardlink paths, got %v", e.res.Path)
+	}
+}
+
+func TestAttrAndXAttr(t *testing.T) {
+	for _, packed := range []bool{false, true} {
+		testAttrAndXAttr(t, packed)
+	}
+}
+
+func testAttrAndXAttr(t *testing.T, packed bool) {
+	var opts builder.Options
+	if packed {
+		opts.PackThreshold = 1024
+	}
+	var (
+		xattr bool
+		mt    = time.Unix(1234567890, 123456789)
+	)
+	fs, _, cleanup := buildTestFS(t, map[string]string{"file": "content"}, opts, func(rootfs string) {
+		p := filepath.Join(rootfs, "file")
+		if err := os.Lchown(p, 1000, 2000); err != nil {
+			t.Skipf("requires chown: %v", err)
+		}
+		xattr = unix.Setxattr(p, "user.foo", []byte("bar"), 0) == nil
+		if err := os.Chtimes(p, mt, mt); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer cleanup()
+	attr, st := fs.GetAttr("file", nil)
+	if !st.Ok() {
+		t.Fatal(st)
+	}
+	if attr.Uid != 1000 || attr.Gid != 2000 {
+		t.Errorf("packed=%v: unexpected owner %d:%d", packed, attr.Uid, attr.Gid)
+	}
+	// tar headers have the mtimes in seconds (unless PAX)
+	if got := attr.ModTime(); got.Unix() != mt.Unix() {
+		t.Errorf("packed=%v: expected mtime %v, got %v", packed, mt, got)
+	}
+	if !xattr {
+		t.Logf("skipping xattr tests, as the temporary directory does not support user xattrs")
+		return
+	}
+	names, st := fs.ListXAttr("file", nil)
+	if !st.Ok() || !reflect.DeepEqual(names, []string{"user.foo"}) {
+		t.Errorf("packed=%v: unexpected xattrs %v: %v", packed, names, st)
+	}
+	if v, st := fs.GetXAttr("file", "user.foo", nil); !st.Ok() || string(v) != "bar" {
+		t.Errorf("packed=%v: unexpected xattr value %q: %v", packed, string(v), st)
+	}
+	if _, st := fs.GetXAttr("file", "user.nonexistent", nil); st != fuse.ENOATTR {
+		t.Errorf("packed=%v: expected ENOATTR, got %v", packed, st)
+	}
+}
+
+func TestSpecialFilesAttr(t *testing.T) {
+	testCases := []struct {
+		res  continuitypb.Resource
+		mode uint32
+		rdev uint32
+	}{
+		{continuitypb.Resource{Mode: uint32(os.ModeDevice | os.ModeCharDevice | 0666), Major: 1, Minor: 3}, syscall.S_IFCHR | 0666, uint32(unix.Mkdev(1, 3))},
+		{continuitypb.Resource{Mode: uint32(os.ModeDevice | 0660), Major: 8, Minor: 1}, syscall.S_IFBLK | 0660, uint32(unix.Mkdev(8, 1))},
+		{continuitypb.Resource{Mode: uint32(os.ModeNamedPipe | 0644)}, syscall.S_IFIFO | 0644, 0},
+		{continuitypb.Resource{Mode: uint32(os.ModeSocket | 0755)}, syscall.S_IFSOCK | 0755, 0},
+		{continuitypb.Resource{Mode: uint32(os.ModeSetuid | 0755)}, syscall.S_IFREG | syscall.S_ISUID | 0755, 0},
+	}
+	fs := &FS{tree: newNodeManager("/")}
+	for i, tc := range testCases {
+		e := &entry{res: &testCases[i].res}
+		attr := e.attr()
+		if attr.Mode != tc.mode || attr.Rdev != tc.rdev {
+			t.Errorf("%s: expected mode %o and rdev %x, got mode %o and rdev %x",
+				os.FileMode(tc.res.Mode), tc.mode, tc.rdev, attr.Mode, attr.Rdev)
+		}
+		fs.tree.insert(fmt.Sprintf("/%d", i), e)
+	}
+	// the type bits of the directory entries are used for d_type
+	ents, st := fs.OpenDir("", nil)
+	if !st.Ok() || len(ents) != len(testCases) {
+		t.Fatalf("unexpected directory entries %+v: %v", ents, st)
+	}
+	for _, ent := range ents {
+		i, err := strconv.Atoi(ent.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := testCases[i].mode & syscall.S_IFMT; ent.Mode&syscall.S_IFMT != expected {
+			t.Errorf("%s: expected type %o, got %o", os.FileMode(testCases[i].res.Mode), expected, ent.Mode&syscall.S_IFMT)
+		}
+	}
+}
+
+func TestInodes(t *testing.T) {
+	files := map[string]string{
+		"etc/hostname": "etc/hostname",
+		"usr/bin/foo":  "usr/bin/foo",
+		"usr/lib/":     "",
+	}
+	img, cleanup := buildTestImage(t, files, builder.Options{}, func(rootfs string) {
+		if err := os.Link(filepath.Join(rootfs, "usr/bin/foo"), filepath.Join(rootfs, "usr/bin/bar")); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer cleanup()
+	paths := []string{"", "etc", "etc/hostname", "usr", "usr/bin", "usr/bin/bar", "usr/bin/foo", "usr/lib"}
+	var inos []map[string]uint64
+	for i := 0; i < 2; i++ {
+		fs := newTestFS(t, puller.NewLocalPuller(), img)
+		m := make(map[string]uint64, 0)
+		for _, p := range paths {
+			attr, st := fs.GetAttr(p, nil)
+			if !st.Ok() {
+				t.Fatalf("%q: %v", p, st)
+			}
+			m[p] = attr.Ino
+		}
+		nlinks := map[string]uint32{"": 4, "etc": 2, "etc/hostname": 1, "usr": 4, "usr/bin": 2, "usr/bin/foo": 2}
+		for p, nlink := range nlinks {
+			if attr, _ := fs.GetAttr(p, nil); attr.Nlink != nlink {
+				t.Errorf("%q: expected nlink %d, got %d", p, nlink, attr.Nlink)
+			}
+		}
+		inos = append(inos, m)
+	}
+	if !reflect.DeepEqual(inos[0], inos[1]) {
+		t.Fatalf("inode numbers are not stable: %v, %v", inos[0], inos[1])
+	}
+	m := inos[0]
+	if m[""] != 1 {
+		t.Errorf("expected the root inode to be 1, got %d", m[""])
+	}
+	if m["usr/bin/foo"] != m["usr/bin/bar"] {
+		t.Errorf("expected hardlinks to share the inode, got %d and %d", m["usr/bin/foo"], m["usr/bin/bar"])
+	}
+	seen := make(map[uint64]string, 0)
+	for _, p := range paths {
+		if p == "usr/bin/bar" {
+			continue
+		}
+		if q, ok := seen[m[p]]; ok {
+			t.Errorf("%q and %q share the inode %d", p, q, m[p])
+		}
+		seen[m[p]] = p
+	}
+}
@@ -4,12 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"runtime"
 
 	"github.com/golang/protobuf/proto"
 	spec "github.com/opencontainers/image-spec/specs-go/v1"
 	continuitypb "github.com/containerd/continuity/proto"
 
 	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/puller"
+	"github.com/AkihiroSuda/filegrain/registry"
+	"github.com/AkihiroSuda/filegrain/version"
 )
 
 func loadContinuityPBManifest(opts Options, desc *spec.Descriptor) (*continuitypb.Manifest, error) {
@@ -41,6 +45,20 @@ func loadImageManifest(opts Options) (*spec.Manifest, error) {
 	if imageManifestDesc == nil {
 		return nil, fmt.Errorf("unknown reference name: %q", opts.RefName)
 	}
+	// the reference name may refer to a nested index, e.g. a manifest list pulled from a registry
+	for imageManifestDesc.MediaType == spec.MediaTypeImageIndex || imageManifestDesc.MediaType == registry.MediaTypeDockerManifestList {
+		nestedBlob, err := loadBlobWithDescriptor(opts, imageManifestDesc)
+		if err != nil {
+			return nil, err
+		}
+		var nested spec.Index
+		if err := json.Unmarshal(nestedBlob, &nested); err != nil {
+			return nil, err
+		}
+		if imageManifestDesc, err = selectManifest(&nested); err != nil {
+			return nil, fmt.Errorf("error while selecting the manifest for %q: %v", opts.RefName, err)
+		}
+	}
 	imageManifestBlob, err := loadBlobWithDescriptor(opts, imageManifestDesc)
 	if err != nil {
 		return nil, err
@@ -52,8 +70,30 @@ func loadImageManifest(opts Options) (*spec.Manifest, error) {
 	return &imageManifest, nil
 }
 
+// selectManifest selects the manifest for the current platform from the nested index.
+// FILEgrain manifests are preferred over the other manifests.
+func selectManifest(idx *spec.Index) (*spec.Descriptor, error) {
+	var selected *spec.Descriptor
+	for i := range idx.Manifests {
+		m := &idx.Manifests[i]
+		if p := m.Platform; p != nil && (p.OS != runtime.GOOS || p.Architecture != runtime.GOARCH) {
+			continue
+		}
+		if _, ok := m.Annotations[version.VersionAnnotation]; ok {
+			return m, nil
+		}
+		if selected == nil {
+			selected = m
+		}
+	}
+	if selected == nil {
+		return nil, fmt.Errorf("no manifest for %s/%s", runtime.GOOS, runtime.GOARCH)
+	}
+	return selected, nil
+}
+
 func loadBlobWithDescriptor(opts Options, desc *spec.Descriptor) ([]byte, error) {
-	r, err := opts.Puller.PullBlob(opts.Image, desc.Digest)
+	r, err := puller.PullBlobWithDescriptor(opts.Puller, opts.Image, *desc)
 	if err != nil {
 		return nil, err
 	}
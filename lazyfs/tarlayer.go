@@ -0,0 +1,384 @@
+package lazyfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	continuitypb "github.com/containerd/continuity/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/gzindex"
+	"github.com/AkihiroSuda/filegrain/layerutil"
+	"github.com/AkihiroSuda/filegrain/puller"
+	"github.com/AkihiroSuda/filegrain/tartoc"
+)
+
+type tarLayer struct {
+	desc spec.Descriptor
+	// gzIndex is set for gzip layers, so as to seek without decompressing from the beginning.
+	gzIndex *gzindex.Index
+}
+
+// tarMember is the location of the content of a regular file in a tar layer.
+type tarMember struct {
+	layer *tarLayer
+	// offset is the offset of the content in the uncompressed tar stream.
+	offset int64
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// tarEntry is an entry of a tar layer.
+type tarEntry struct {
+	name   string
+	hdr    *tar.Header
+	offset int64
+}
+
+// loadTarLayer indexes the tar layer into nm.
+// Whiteouts in the layer are applied to the entries of the lower layers.
+func loadTarLayer(opts Options, nm *nodeManager, desc *spec.Descriptor) error {
+	layer := &tarLayer{desc: *desc}
+	tarEntries, err := listTarEntries(opts, layer)
+	if err != nil {
+		return err
+	}
+	var (
+		whiteouts []string
+		opaques   []string
+		entries   []tarEntry
+	)
+	for _, te := range tarEntries {
+		dir, base := path.Split(te.name)
+		switch {
+		case base == layerutil.WhiteoutOpaqueDir:
+			opaques = append(opaques, dir)
+		case strings.HasPrefix(base, layerutil.WhiteoutPrefix):
+			whiteouts = append(whiteouts, path.Join(dir, strings.TrimPrefix(base, layerutil.WhiteoutPrefix)))
+		default:
+			entries = append(entries, te)
+		}
+	}
+	// whiteouts are applied to the lower layers, regardless to the order in the tar
+	for _, p := range whiteouts {
+		nm.remove(p)
+	}
+	for _, p := range opaques {
+		if n := nm.lookup(p); n != nil {
+			n.m = make(map[string]*node, 0)
+		}
+	}
+	// layerEntries is the set of the entries created in this layer
+	layerEntries := make(map[*entry]bool, 0)
+	for _, te := range entries {
+		if te.hdr.Typeflag == tar.TypeLink {
+			targetName := path.Clean("/" + te.hdr.Linkname)
+			target := nm.lookup(targetName)
+			if target == nil || target.x == nil {
+				logrus.Warnf("Skipping %q in %s: hardlink target %q not found", te.hdr.Name, desc.Digest, te.hdr.Linkname)
+				continue
+			}
+			e := target.x.(*entry)
+			if !layerEntries[e] {
+				// the entry of the lower layer must not be modified, as it is shared with the other paths of the lower layer
+				copied := *e
+				copied.res = proto.Clone(e.res).(*continuitypb.Resource)
+				copied.res.Path = []string{targetName}
+				e = &copied
+				layerEntries[e] = true
+				target.x = e
+			}
+			e.res.Path = append(e.res.Path, te.name)
+			nm.remove(te.name)
+			nm.insert(te.name, e)
+			continue
+		}
+		res, err := tarHeaderToContinuityResource(te.name, te.hdr)
+		if err != nil {
+			logrus.Warnf("Skipping %q in %s: %v", te.hdr.Name, desc.Digest, err)
+			continue
+		}
+		e := &entry{res: res, mtime: te.hdr.ModTime}
+		layerEntries[e] = true
+		if te.hdr.Typeflag == tar.TypeReg || te.hdr.Typeflag == tar.TypeRegA {
+			e.tarMember = &tarMember{layer: layer, offset: te.offset}
+		}
+		if te.hdr.Typeflag != tar.TypeDir {
+			// replacing a directory with a non-directory hides the children
+			nm.remove(te.name)
+		}
+		nm.insert(te.name, e)
+	}
+	return nil
+}
+
+// listTarEntries returns the entries of the tar layer, and sets layer.gzIndex for gzip layers.
+// If the layer has the sidecar TOC (and the sidecar gzip index for gzip layers),
+// the entries are listed without pulling the layer.
+func listTarEntries(opts Options, layer *tarLayer) ([]tarEntry, error) {
+	toc, err := loadTarTOC(opts, layer)
+	if err != nil {
+		return nil, err
+	}
+	if toc != nil {
+		compression, err := layerutil.LayerCompression(layer.desc.MediaType)
+		if err != nil {
+			return nil, err
+		}
+		hasIndex := true
+		if compression == layerutil.Gzip {
+			if hasIndex, err = loadGzipIndex(opts, layer); err != nil {
+				return nil, err
+			}
+		}
+		// without the gzip index, the layer needs to be scanned for building the index
+		if hasIndex {
+			entries := make([]tarEntry, len(toc.Entries))
+			for i, e := range toc.Entries {
+				entries[i] = tarEntry{name: path.Clean("/" + e.Name), hdr: e.Header(), offset: e.Offset}
+			}
+			return entries, nil
+		}
+	}
+	return scanTarEntries(opts, layer)
+}
+
+// loadTarTOC loads the sidecar TOC of the tar layer.
+// Returns nil if the layer has no TOC.
+func loadTarTOC(opts Options, layer *tarLayer) (*tartoc.TOC, error) {
+	s, ok := layer.desc.Annotations[tartoc.Annotation]
+	if !ok {
+		return nil, nil
+	}
+	d, err := digest.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	b, err := loadBlobWithDescriptor(opts, &spec.Descriptor{Digest: d})
+	if err != nil {
+		return nil, err
+	}
+	toc, err := tartoc.Unmarshal(b)
+	if err != nil {
+		return nil, fmt.Errorf("error while loading tar TOC %s for %s: %v", d, layer.desc.Digest, err)
+	}
+	return toc, nil
+}
+
+// scanTarEntries reads the whole tar layer and returns the entries.
+func scanTarEntries(opts Options, layer *tarLayer) ([]tarEntry, error) {
+	desc := &layer.desc
+	compression, err := layerutil.LayerCompression(desc.MediaType)
+	if err != nil {
+		return nil, err
+	}
+	r, err := opts.Puller.PullBlob(opts.Image, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var dr io.ReadCloser
+	if compression == layerutil.Gzip {
+		dr, err = openGzipLayer(opts, layer, r)
+	} else {
+		dr, err = layerutil.Decompress(compression, r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer dr.Close()
+	var entries []tarEntry
+	cr := &countingReader{r: dr}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error while reading tar layer %s: %v", desc.Digest, err)
+		}
+		// cr.n points to the beginning of the content, as tar.Reader does not read ahead
+		entries = append(entries, tarEntry{name: path.Clean("/" + hdr.Name), hdr: hdr, offset: cr.n})
+	}
+	// read the rest of the stream (e.g. padding), so that the gzip index is built completely
+	if _, err := io.Copy(ioutil.Discard, cr); err != nil {
+		return nil, fmt.Errorf("error while reading tar layer %s: %v", desc.Digest, err)
+	}
+	if err := dr.Close(); err != nil {
+		return nil, fmt.Errorf("error while reading tar layer %s: %v", desc.Digest, err)
+	}
+	return entries, nil
+}
+
+func tarHeaderToContinuityResource(name string, hdr *tar.Header) (*continuitypb.Resource, error) {
+	res := &continuitypb.Resource{
+		Path: []string{name},
+		Uid:  int64(hdr.Uid),
+		Gid:  int64(hdr.Gid),
+		Mode: uint32(hdr.FileInfo().Mode()),
+	}
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA:
+		res.Size = uint64(hdr.Size)
+	case tar.TypeDir:
+	case tar.TypeSymlink:
+		res.Target = hdr.Linkname
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		res.Major = uint64(hdr.Devmajor)
+		res.Minor = uint64(hdr.Devminor)
+	default:
+		return nil, fmt.Errorf("unsupported tar entry type %q", hdr.Typeflag)
+	}
+	var xattrNames []string
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, layerutil.PAXSchilyXattr) {
+			xattrNames = append(xattrNames, k)
+		}
+	}
+	sort.Strings(xattrNames)
+	for _, k := range xattrNames {
+		res.Xattr = append(res.Xattr, &continuitypb.XAttr{
+			Name: strings.TrimPrefix(k, layerutil.PAXSchilyXattr),
+			Data: []byte(hdr.PAXRecords[k]),
+		})
+	}
+	return res, nil
+}
+
+// openGzipLayer returns the uncompressed stream of the gzip layer r.
+// If the layer has the sidecar gzip index, the index is loaded to layer.gzIndex.
+// Otherwise the index is built while reading the stream, and set to layer.gzIndex
+// on closing the returned reader.
+func openGzipLayer(opts Options, layer *tarLayer, r io.Reader) (io.ReadCloser, error) {
+	hasIndex, err := loadGzipIndex(opts, layer)
+	if err != nil {
+		return nil, err
+	}
+	if hasIndex {
+		return layerutil.Decompress(layerutil.Gzip, r)
+	}
+	logrus.Debugf("Building gzip index for %s", layer.desc.Digest)
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		idx, err := gzindex.BuildIndex(r, 0, pw)
+		layer.gzIndex = idx
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	return &gzipLayerReader{PipeReader: pr, done: done}, nil
+}
+
+// loadGzipIndex loads the sidecar gzip index of the gzip layer to layer.gzIndex.
+// Returns false if the layer has no sidecar gzip index.
+func loadGzipIndex(opts Options, layer *tarLayer) (bool, error) {
+	s, ok := layer.desc.Annotations[gzindex.IndexAnnotation]
+	if !ok {
+		return false, nil
+	}
+	d, err := digest.Parse(s)
+	if err != nil {
+		return false, err
+	}
+	b, err := loadBlobWithDescriptor(opts, &spec.Descriptor{Digest: d})
+	if err != nil {
+		return false, err
+	}
+	var idx gzindex.Index
+	if err := idx.UnmarshalBinary(b); err != nil {
+		return false, fmt.Errorf("error while loading gzip index %s for %s: %v", d, layer.desc.Digest, err)
+	}
+	layer.gzIndex = &idx
+	return true, nil
+}
+
+type gzipLayerReader struct {
+	*io.PipeReader
+	done     chan error
+	closed   bool
+	closeErr error
+}
+
+// Close waits for the index to be built.
+func (r *gzipLayerReader) Close() error {
+	if r.closed {
+		return r.closeErr
+	}
+	r.PipeReader.Close()
+	r.closed = true
+	if err := <-r.done; err != io.ErrClosedPipe {
+		// ErrClosedPipe means that the reader was closed before reading the whole stream
+		r.closeErr = err
+	}
+	return r.closeErr
+}
+
+// readTarMember reads the content of the tar member m into buf.
+// size is the size of the content.
+func readTarMember(opts Options, m *tarMember, size int64, buf []byte, off int64) (int, error) {
+	if off >= size {
+		return 0, nil
+	}
+	if rest := size - off; int64(len(buf)) > rest {
+		buf = buf[:rest]
+	}
+	compression, err := layerutil.LayerCompression(m.layer.desc.MediaType)
+	if err != nil {
+		return 0, err
+	}
+	if rp, ok := opts.Puller.(puller.RangePuller); ok && compression == layerutil.Uncompressed {
+		r, err := rp.PullBlobRange(opts.Image, m.layer.desc, m.offset+off, int64(len(buf)))
+		if err != nil {
+			return 0, err
+		}
+		defer r.Close()
+		return io.ReadFull(r, buf)
+	}
+	br, err := opts.Puller.PullBlob(opts.Image, m.layer.desc.Digest)
+	if err != nil {
+		return 0, err
+	}
+	defer br.Close()
+	switch {
+	case compression == layerutil.Uncompressed:
+		if _, err := br.Seek(m.offset+off, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return io.ReadFull(br, buf)
+	case compression == layerutil.Gzip && m.layer.gzIndex != nil:
+		zr, err := m.layer.gzIndex.NewReader(br, m.offset+off)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+		return io.ReadFull(zr, buf)
+	}
+	// FIXME: decompressing from the beginning of the layer is slow
+	dr, err := layerutil.Decompress(compression, br)
+	if err != nil {
+		return 0, err
+	}
+	defer dr.Close()
+	if _, err := io.CopyN(ioutil.Discard, dr, m.offset+off); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(dr, buf)
+}
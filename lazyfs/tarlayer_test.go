@@ -0,0 +1,175 @@
+package lazyfs
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	continuitypb "github.com/containerd/continuity/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/opencontainers/image-spec/specs-go"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/continuityutil"
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/image/imageutil"
+	"github.com/AkihiroSuda/filegrain/puller"
+)
+
+func testTarBlob(t *testing.T, gz bool, hdrs []*tar.Header, contents []string) []byte {
+	var (
+		buf bytes.Buffer
+		w   io.Writer = &buf
+		gw  *gzip.Writer
+	)
+	if gz {
+		gw = gzip.NewWriter(&buf)
+		w = gw
+	}
+	tw := tar.NewWriter(w)
+	for i, hdr := range hdrs {
+		hdr.Size = int64(len(contents[i]))
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(contents[i])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func testWriteLayer(t *testing.T, img, mediaType string, b []byte) spec.Descriptor {
+	d, err := image.WriteBlob(img, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return spec.Descriptor{MediaType: mediaType, Digest: d, Size: int64(len(b))}
+}
+
+func TestLoadTreeMixedLayers(t *testing.T) {
+	img, err := ioutil.TempDir("", "filegrain-test-lazyfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(img)
+	if err := image.Init(img); err != nil {
+		t.Fatal(err)
+	}
+	fooDigest, err := image.WriteBlob(img, []byte("foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contM, err := proto.Marshal(&continuitypb.Manifest{
+		Resource: []*continuitypb.Resource{
+			{Path: []string{"/opt"}, Mode: uint32(os.ModeDir | 0755)},
+			{Path: []string{"/opt/foo"}, Mode: 0644, Size: 3, Digest: []string{fooDigest.String()}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers := []spec.Descriptor{
+		testWriteLayer(t, img, spec.MediaTypeImageLayerGzip, testTarBlob(t, true,
+			[]*tar.Header{
+				{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+				{Name: "etc/hostname", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "usr/lib/old", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "etc/group", Typeflag: tar.TypeLink, Linkname: "etc/passwd"},
+			},
+			[]string{"", "hostname", "passwd", "old", ""})),
+		testWriteLayer(t, img, continuityutil.MediaTypeManifestV0Protobuf, contM),
+		testWriteLayer(t, img, spec.MediaTypeImageLayer, testTarBlob(t, false,
+			[]*tar.Header{
+				{Name: "etc/.wh.hostname", Typeflag: tar.TypeReg},
+				{Name: "usr/lib/new", Typeflag: tar.TypeReg, Mode: 0644},
+				{Name: "usr/lib/.wh..wh..opq", Typeflag: tar.TypeReg},
+				{Name: "etc/passwd-", Typeflag: tar.TypeLink, Linkname: "etc/passwd"},
+			},
+			[]string{"", "new", "", ""})),
+	}
+	configDesc, err := imageutil.WriteJSONBlob(img, &spec.Image{}, spec.MediaTypeImageConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDesc, err := imageutil.WriteJSONBlob(img, &spec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    *configDesc,
+		Layers:    layers,
+	}, spec.MediaTypeImageManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDesc.Annotations = map[string]string{image.RefNameAnnotation: "latest"}
+	if err := image.PutManifestDescriptorToIndex(img, manifestDesc); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{
+		Puller:  puller.NewLocalPuller(),
+		Image:   img,
+		RefName: "latest",
+	}
+	imageManifest, err := loadImageManifest(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nm, err := loadTree(opts, imageManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, nx := range []string{"/etc/hostname", "/usr/lib/old"} {
+		if n := nm.lookup(nx); n != nil {
+			t.Errorf("%s should have been removed by whiteouts", nx)
+		}
+	}
+	expected := map[string]string{
+		"/etc/passwd":  "passwd",
+		"/etc/passwd-": "passwd",
+		"/etc/group":   "passwd",
+		"/usr/lib/new": "new",
+		"/opt/foo":     "",
+	}
+	for p, content := range expected {
+		n := nm.lookup(p)
+		if n == nil {
+			t.Fatalf("%s not found", p)
+		}
+		e := n.x.(*entry)
+		if e.tarMember == nil {
+			continue
+		}
+		buf := make([]byte, 64)
+		m, err := readTarMember(opts, e.tarMember, int64(e.res.Size), buf, 0)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			t.Fatal(err)
+		}
+		if string(buf[:m]) != content {
+			t.Errorf("expected %q for %s, got %q", content, p, string(buf[:m]))
+		}
+	}
+	if n := nm.lookup("/usr").x.(*entry); n.res.Mode != uint32(os.ModeDir|0755) {
+		t.Errorf("expected implicit directory for /usr, got %+v", n.res)
+	}
+	if n := nm.lookup("/etc/passwd").x.(*entry); !reflect.DeepEqual(n.res.Path, []string{"/etc/passwd", "/etc/passwd-"}) || n.nlink != 2 {
+		t.Errorf("expected hardlink paths, got %v (nlink=%d)", n.res.Path, n.nlink)
+	}
+	// the hardlink in the upper layer must not modify the entry of the lower layer
+	if n := nm.lookup("/etc/group").x.(*entry); !reflect.DeepEqual(n.res.Path, []string{"/etc/passwd", "/etc/group"}) || n.nlink != 1 {
+		t.Errorf("expected the lower hardlink paths, got %v (nlink=%d)", n.res.Path, n.nlink)
+	}
+}
@@ -67,3 +67,40 @@ func (nm *nodeManager) lookup(path string) *node {
 	}
 	return n
 }
+
+// remove removes the node and its children.
+// Returns the removed node, or nil if not found.
+func (nm *nodeManager) remove(path string) *node {
+	var (
+		parent *node
+		base   string
+	)
+	n := nm.root
+	for _, s := range strings.Split(path, nm.sep) {
+		if s == "" {
+			continue
+		}
+		if s == "." || s == ".." {
+			panic(fmt.Errorf("disallowed path element: %q", s))
+		}
+		nn, ok := n.m[s]
+		if !ok {
+			return nil
+		}
+		parent, base, n = n, s, nn
+	}
+	if parent == nil {
+		// the root cannot be removed
+		return nil
+	}
+	delete(parent.m, base)
+	return n
+}
+
+// walk calls fn for n and its descendants.
+func (n *node) walk(path, sep string, fn func(path string, n *node)) {
+	fn(path, n)
+	for k, v := range n.m {
+		v.walk(strings.TrimSuffix(path, sep)+sep+k, sep, fn)
+	}
+}
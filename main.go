@@ -1,9 +1,13 @@
 package main
 
 import (
+	"os"
+
 	"github.com/AkihiroSuda/filegrain/commands"
 )
 
 func main() {
-	commands.MainCmd.Execute()
+	if err := commands.MainCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
 }
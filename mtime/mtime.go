@@ -0,0 +1,66 @@
+// Package mtime provides the sidecar map of the modification times of the files,
+// as continuity manifests lack the times.
+package mtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// Annotation is the annotation of a continuity manifest layer descriptor.
+	// The value is the digest of the mtime map blob.
+	Annotation = "filegrain.mtimes"
+
+	// MediaType is the media type of the mtime map blob.
+	MediaType = "application/vnd.filegrain.mtimes.v1+json"
+
+	Version = 1
+)
+
+// Map is the mtime map.
+type Map struct {
+	Version int `json:"version"`
+	// Files is keyed by the first path of a resource in the continuity manifest.
+	// The values are the Unix times in nanoseconds.
+	Files map[string]int64 `json:"files"`
+}
+
+// NewMap returns an empty mtime map.
+func NewMap() *Map {
+	return &Map{
+		Version: Version,
+		Files:   make(map[string]int64, 0),
+	}
+}
+
+// Unmarshal decodes the mtime map.
+func Unmarshal(b []byte) (*Map, error) {
+	var m Map
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	if m.Version != Version {
+		return nil, fmt.Errorf("unsupported mtime map version: %d", m.Version)
+	}
+	return &m, nil
+}
+
+// Set sets the mtime of the path.
+func (m *Map) Set(path string, t time.Time) {
+	m.Files[path] = t.UnixNano()
+}
+
+// Lookup returns the mtime of the path.
+// Returns the zero time if m is nil or the path is not found.
+func (m *Map) Lookup(path string) time.Time {
+	if m == nil {
+		return time.Time{}
+	}
+	ns, ok := m.Files[path]
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
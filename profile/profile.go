@@ -0,0 +1,99 @@
+// Package profile provides the prefetch profile, i.e. the list of the files
+// accessed by a workload, in the order of the first access.
+package profile
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// Annotation is the annotation of an image manifest.
+	// The value is the digest of the profile blob.
+	Annotation = "filegrain.prefetch.profile"
+
+	// MediaType is the media type of the profile blob.
+	MediaType = "application/vnd.filegrain.prefetch.profile.v1+json"
+
+	Version = 1
+)
+
+type Entry struct {
+	Path string `json:"path"`
+	// Digest is the digest of the blob read for the path.
+	// For a file in a tar layer, Digest is the digest of the layer.
+	Digest digest.Digest `json:"digest,omitempty"`
+}
+
+type Profile struct {
+	Version int     `json:"version"`
+	Entries []Entry `json:"entries"`
+}
+
+// Unmarshal decodes the profile.
+func Unmarshal(b []byte) (*Profile, error) {
+	var p Profile
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	if p.Version != Version {
+		return nil, fmt.Errorf("unsupported profile version %d", p.Version)
+	}
+	return &p, nil
+}
+
+func ReadFile(filename string) (*Profile, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Unmarshal(b)
+}
+
+func (p *Profile) WriteFile(filename string) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0644)
+}
+
+// Recorder records the accesses.
+// Only the first access to each path is recorded.
+type Recorder struct {
+	mu      sync.Mutex
+	seen    map[string]struct{}
+	entries []Entry
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		seen: make(map[string]struct{}, 0),
+	}
+}
+
+// Record records the access to path.
+// d is the digest of the blob that contains the content, and can be empty.
+func (r *Recorder) Record(path string, d digest.Digest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.seen[path]; ok {
+		return
+	}
+	r.seen[path] = struct{}{}
+	r.entries = append(r.entries, Entry{Path: path, Digest: d})
+}
+
+// Profile returns the profile recorded so far.
+func (r *Recorder) Profile() *Profile {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &Profile{
+		Version: Version,
+		Entries: append([]Entry(nil), r.entries...),
+	}
+}
@@ -1,121 +1,475 @@
 package puller
 
 import (
+	"container/list"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/go-units"
 	"github.com/opencontainers/go-digest"
 	spec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
 
 	"github.com/AkihiroSuda/filegrain/image"
 )
 
-type pullStatus int
+// inflight is a blob being pulled.
+type inflight struct {
+	// done is closed when the pull is finished.
+	done chan struct{}
+	// err is the result of the pull, and is valid after done is closed.
+	err error
+}
 
-const (
-	pullStatusUnknown pullStatus = iota
-	pullStatusPulling
-	pullStatusPulled
-)
+// BlobCacherOptions is the options for BlobCacher.
+type BlobCacherOptions struct {
+	// VerifyOnLoad verifies the digests of the blobs found in the cache directory on startup.
+	// Corrupted blobs are removed.
+	// When false, the blobs are trusted by their file names.
+	VerifyOnLoad bool
+	// MaxBytes is the soft limit of the total size of the cached blobs.
+	// When exceeded, the least recently used blobs are evicted, except open blobs and pinned blobs.
+	// Zero means unlimited.
+	MaxBytes int64
+	// Retries is the number of the retries on pull failures.
+	Retries int
+	// RetryBackoff is the wait before the first retry. The wait is doubled on every retry.
+	// Defaults to DefaultRetryBackoff.
+	RetryBackoff time.Duration
+	// PrefetchConcurrency is the number of the workers for Prefetch.
+	// Defaults to DefaultPrefetchConcurrency.
+	PrefetchConcurrency int
+	// ChunkSize is the size of the chunks for PullBlobRange.
+	// Defaults to DefaultChunkSize.
+	ChunkSize int64
+	// BlobsLayout is the layout of the blobs in the cache directory.
+	// The cached blobs are converted on startup if the layout differs.
+	BlobsLayout image.BlobsLayout
+}
+
+const DefaultRetryBackoff = 500 * time.Millisecond
+
+// cacheEntry is a pulled blob.
+type cacheEntry struct {
+	d    digest.Digest
+	size int64
+	// opened is the number of the open readers. Open blobs are never evicted.
+	opened int
+	// elem is the element in BlobCacher.lru
+	elem *list.Element
+}
 
 type BlobCacher struct {
 	cachePath string
 	puller    Puller
+	opts      BlobCacherOptions
 
-	pullStatus     map[digest.Digest]pullStatus
-	pullStatusCond *sync.Cond
+	// mu protects the fields below
+	mu       sync.Mutex
+	inflight map[digest.Digest]*inflight
+	entries  map[digest.Digest]*cacheEntry
+	// lru contains *cacheEntry and *partialBlob. The front is the most recently used one.
+	lru         *list.List
+	pinned      map[digest.Digest]struct{}
+	cachedBytes int64
+	// onDemand is the number of the PullBlob calls in progress.
+	// Prefetch workers do not start pulling while onDemand > 0.
+	onDemand     int
+	onDemandCond *sync.Cond
+
+	// partials are the blobs being cached chunk by chunk
+	partials map[digest.Digest]*partialBlob
+
+	// lockFile holds the shared lock on the cache directory
+	lockFile *os.File
+
+	prefetch     *prefetchQueue
+	prefetchOnce sync.Once
 
 	pulledBlobBytes uint64 // atomic
 	pulledBlobs     uint64 // atomic
 }
 
-func NewBlobCacher(cachePath string, puller Puller) (*BlobCacher, error) {
+// NewBlobCacher creates BlobCacher.
+// The blobs already cached in cachePath (e.g. by the previous mount) are reused.
+func NewBlobCacher(cachePath string, puller Puller, opts BlobCacherOptions) (*BlobCacher, error) {
 	if _, err := os.Stat(cachePath); err != nil {
 		return nil, err
 	}
 	cacher := &BlobCacher{
 		cachePath:       cachePath,
 		puller:          puller,
-		pullStatus:      make(map[digest.Digest]pullStatus, 0),
-		pullStatusCond:  sync.NewCond(&sync.Mutex{}),
+		opts:            opts,
+		inflight:        make(map[digest.Digest]*inflight, 0),
+		entries:         make(map[digest.Digest]*cacheEntry, 0),
+		lru:             list.New(),
+		pinned:          make(map[digest.Digest]struct{}, 0),
+		partials:        make(map[digest.Digest]*partialBlob, 0),
 		pulledBlobBytes: 0,
 		pulledBlobs:     0,
 	}
-	// currently, cachePath needs to be empty.
-	// TODO: load cacher.pulled
+	cacher.onDemandCond = sync.NewCond(&cacher.mu)
+	cacher.prefetch = newPrefetchQueue()
+	if err := cacher.load(); err != nil {
+		return nil, err
+	}
 	return cacher, nil
 }
 
+// cacheLockFile is the lock file in the cache directory.
+// Every BlobCacher holds a shared lock on the file while it is alive, so that the files
+// being written by a BlobCacher are not removed by another BlobCacher sharing the cache directory.
+const cacheLockFile = "lock"
+
+// lock takes the lock on the cache directory.
+// The exclusive lock is taken if no other BlobCacher uses the cache directory.
+// Otherwise the shared lock is taken, and false is returned.
+func (p *BlobCacher) lock() (bool, error) {
+	f, err := os.OpenFile(filepath.Join(p.cachePath, cacheLockFile), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return false, err
+	}
+	p.lockFile = f
+	err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if err == nil {
+		return true, nil
+	}
+	if err != unix.EWOULDBLOCK {
+		return false, err
+	}
+	// blocks until the BlobCacher holding the exclusive lock finishes the cleanup
+	return false, unix.Flock(int(f.Fd()), unix.LOCK_SH)
+}
+
+// load scans the cache directory.
+// The blobs are ordered by the modification time, i.e. the time of caching.
+func (p *BlobCacher) load() error {
+	exclusive, err := p.lock()
+	if err != nil {
+		return fmt.Errorf("error while locking %s: %v", p.cachePath, err)
+	}
+	l, err := image.GetBlobsLayout(p.cachePath)
+	if err != nil {
+		return err
+	}
+	if exclusive {
+		// the garbage can be removed only when no other BlobCacher is writing the files
+		if err := image.RemoveTempBlobs(p.cachePath); err != nil {
+			return err
+		}
+		// partial blobs are not reused, as the chunk bitmaps are not persisted
+		if err := os.RemoveAll(p.partialDir()); err != nil {
+			return err
+		}
+		if l != p.opts.BlobsLayout {
+			logrus.Infof("Cache: converting the blobs layout from %s to %s", l, p.opts.BlobsLayout)
+			if err := image.ConvertBlobsLayout(p.cachePath, p.opts.BlobsLayout); err != nil {
+				return err
+			}
+		}
+		if err := unix.Flock(int(p.lockFile.Fd()), unix.LOCK_SH); err != nil {
+			return err
+		}
+	} else {
+		logrus.Infof("Cache: %s is used by another process, skipping the cleanup", p.cachePath)
+		if l != p.opts.BlobsLayout {
+			logrus.Warnf("Cache: keeping the %s blobs layout of %s, as the directory is used by another process", l, p.cachePath)
+		}
+	}
+	blobs, err := image.ListBlobs(p.cachePath)
+	if err != nil {
+		return err
+	}
+	type loaded struct {
+		d     digest.Digest
+		size  int64
+		mtime time.Time
+	}
+	var ls []loaded
+	for _, d := range blobs {
+		size, mtime, err := p.loadBlob(d)
+		if err != nil {
+			logrus.Warnf("Removing corrupted cache %s: %v", d, err)
+			if err := image.DeleteBlob(p.cachePath, d); err != nil {
+				return err
+			}
+			continue
+		}
+		ls = append(ls, loaded{d: d, size: size, mtime: mtime})
+	}
+	sort.Slice(ls, func(i, j int) bool { return ls[i].mtime.Before(ls[j].mtime) })
+	for _, l := range ls {
+		p.addEntry(l.d, l.size)
+	}
+	if len(ls) > 0 {
+		logrus.Infof("Cache: loaded %d blobs, %s", len(ls), units.BytesSize(float64(p.cachedBytes)))
+	}
+	p.evict()
+	return nil
+}
+
+// loadBlob returns the size and the modification time of the cached blob d.
+func (p *BlobCacher) loadBlob(d digest.Digest) (int64, time.Time, error) {
+	f, err := image.GetBlobReader(p.cachePath, d)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	defer f.Close()
+	st, err := f.(*os.File).Stat()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	if !p.opts.VerifyOnLoad {
+		return st.Size(), st.ModTime(), nil
+	}
+	verifier := d.Verifier()
+	if _, err := io.Copy(verifier, f); err != nil {
+		return 0, time.Time{}, err
+	}
+	if !verifier.Verified() {
+		return 0, time.Time{}, fmt.Errorf("digest mismatch")
+	}
+	return st.Size(), st.ModTime(), nil
+}
+
+// PullBlob returns the cached blob, after caching the blob if not cached yet.
+// The blob is not evicted until the returned reader is closed.
+//
+// When the blob is being pulled by another caller, PullBlob waits for it, and
+// the error is shared with all the waiters. The next call after the error pulls the blob again.
 func (p *BlobCacher) PullBlob(img string, d digest.Digest) (image.BlobReader, error) {
-	if err := p.cacheBlobIfNotYet(img, d); err != nil {
-		return nil, err
+	// on-demand pulls jump the prefetch queue
+	if p.prefetch.remove(d) {
+		defer p.Unpin(d)
 	}
-	return p.openCachedBlob(img, d)
+	p.mu.Lock()
+	p.onDemand++
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		p.onDemand--
+		p.onDemandCond.Broadcast()
+		p.mu.Unlock()
+	}()
+	return p.pullBlob(img, d)
 }
 
-func (p *BlobCacher) cacheBlobIfNotYet(img string, d digest.Digest) error {
-	alreadyCached := false
+func (p *BlobCacher) pullBlob(img string, d digest.Digest) (image.BlobReader, error) {
 	for {
-		p.pullStatusCond.L.Lock()
-		st, ok := p.pullStatus[d]
-		if ok && st == pullStatusPulling {
-			p.pullStatusCond.Wait()
-			p.pullStatusCond.L.Unlock()
-		} else {
-			p.pullStatusCond.L.Unlock()
-			alreadyCached = st == pullStatusPulled
-			break
+		p.mu.Lock()
+		if e, ok := p.entries[d]; ok {
+			r, err := p.openEntry(e)
+			if err == nil || !os.IsNotExist(err) {
+				p.mu.Unlock()
+				return r, err
+			}
+			// evicted by another process sharing the cache directory, so pull the blob again
+			logrus.Debugf("Cache: %s was removed by another process", d)
+			p.removeEntry(e)
+		}
+		if fl, ok := p.inflight[d]; ok {
+			p.mu.Unlock()
+			<-fl.done
+			if fl.err != nil {
+				return nil, fl.err
+			}
+			// the blob might have been evicted again here, so retry the lookup
+			continue
 		}
+		fl := &inflight{done: make(chan struct{})}
+		p.inflight[d] = fl
+		p.mu.Unlock()
+		r, err := p.cacheBlob(img, d, fl)
+		return r, err
 	}
-	if !alreadyCached {
-		return p.cacheBlob(img, d)
+}
+
+// cacheBlob caches the blob and returns the reader for the cached blob.
+// fl is finished with the result.
+func (p *BlobCacher) cacheBlob(img string, d digest.Digest, fl *inflight) (image.BlobReader, error) {
+	copied, err := p.pullWithRetries(img, d)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.inflight, d)
+	fl.err = err
+	defer close(fl.done)
+	if err != nil {
+		return nil, err
+	}
+	totalCopied := atomic.AddUint64(&p.pulledBlobBytes, uint64(copied))
+	totalCachedBlobs := atomic.AddUint64(&p.pulledBlobs, uint64(1))
+	e := p.addEntry(d, copied)
+	// open before evicting, so that e is not evicted
+	br, err := p.openEntry(e)
+	p.evict()
+	logrus.Infof("Cache: pulled %d blobs, %s (cached: %d blobs, %s)",
+		totalCachedBlobs, units.BytesSize(float64(totalCopied)),
+		len(p.entries), units.BytesSize(float64(p.cachedBytes)))
+	return br, err
+}
+
+func (p *BlobCacher) pullWithRetries(img string, d digest.Digest) (int64, error) {
+	var copied int64
+	err := p.withRetries(d.String(), func() error {
+		var err error
+		copied, err = p.pull(img, d)
+		return err
+	})
+	return copied, err
+}
+
+// withRetries calls fn until it succeeds, up to 1+Retries times with backoff.
+// what is used for logging.
+func (p *BlobCacher) withRetries(what string, fn func() error) error {
+	backoff := p.opts.RetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || i >= p.opts.Retries {
+			return err
+		}
+		logrus.Warnf("error while pulling %s, retrying in %v (%d/%d): %v", what, backoff, i+1, p.opts.Retries, err)
+		time.Sleep(backoff)
+		backoff *= 2
 	}
-	return nil
 }
 
-func (p *BlobCacher) cacheBlob(img string, d digest.Digest) error {
+// pull pulls the blob into the cache directory, and returns the size.
+// The temporary file is removed on failure.
+func (p *BlobCacher) pull(img string, d digest.Digest) (int64, error) {
 	// logrus.Debugf("Caching blob: %s", d)
-	p.pullStatusCond.L.Lock()
-	p.pullStatus[d] = pullStatusPulling
-	p.pullStatusCond.L.Unlock()
 	r, err := p.puller.PullBlob(img, d)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer r.Close()
 	w, err := image.NewBlobWriter(p.cachePath, d.Algorithm())
 	if err != nil {
-		return err
+		return 0, err
 	}
 	copied, err := io.Copy(w, r)
 	if err != nil {
-		return err
+		w.Abort()
+		return 0, err
 	}
-	if err := r.Close(); err != nil {
-		return err
+	if dd := w.WrittenDigest(); dd != d {
+		w.Abort()
+		return 0, fmt.Errorf("expected %q, got %q", d, dd)
 	}
 	if err := w.Close(); err != nil {
-		return err
+		w.Abort()
+		return 0, err
+	}
+	return copied, nil
+}
+
+// addEntry adds the entry as the most recently used one.
+// Needs to be called with mu.
+// If the entry already exists, the existing one is returned.
+func (p *BlobCacher) addEntry(d digest.Digest, size int64) *cacheEntry {
+	if e, ok := p.entries[d]; ok {
+		return e
 	}
-	if dd := w.Digest(); dd == nil || *dd != d {
-		return fmt.Errorf("expected %q, got %q", d, dd)
+	e := &cacheEntry{d: d, size: size}
+	e.elem = p.lru.PushFront(e)
+	p.entries[d] = e
+	p.cachedBytes += size
+	return e
+}
+
+// removeEntry removes the entry, without removing the blob file.
+// Needs to be called with mu.
+func (p *BlobCacher) removeEntry(e *cacheEntry) {
+	p.lru.Remove(e.elem)
+	delete(p.entries, e.d)
+	p.cachedBytes -= e.size
+}
+
+// openEntry opens the cached blob.
+// Needs to be called with mu.
+func (p *BlobCacher) openEntry(e *cacheEntry) (image.BlobReader, error) {
+	r, err := image.GetBlobReader(p.cachePath, e.d)
+	if err != nil {
+		return nil, err
 	}
-	totalCopied := atomic.AddUint64(&p.pulledBlobBytes, uint64(copied))
-	totalCachedBlobs := atomic.AddUint64(&p.pulledBlobs, uint64(1))
-	logrus.Infof("Cache: %d blobs, %s", totalCachedBlobs, units.BytesSize(float64(totalCopied)))
-	p.pullStatusCond.L.Lock()
-	p.pullStatus[d] = pullStatusPulled
-	p.pullStatusCond.L.Unlock()
-	p.pullStatusCond.Broadcast()
-	return nil
+	e.opened++
+	p.lru.MoveToFront(e.elem)
+	return &cachedBlobReader{BlobReader: r, cacher: p, entry: e}, nil
+}
+
+// evict evicts the least recently used blobs (including partial blobs) until the total size gets smaller than MaxBytes.
+// Needs to be called with mu.
+func (p *BlobCacher) evict() {
+	if p.opts.MaxBytes <= 0 {
+		return
+	}
+	for elem := p.lru.Back(); elem != nil && p.cachedBytes > p.opts.MaxBytes; {
+		prev := elem.Prev()
+		if pb, ok := elem.Value.(*partialBlob); ok {
+			if _, pinned := p.pinned[pb.desc.Digest]; pb.users == 0 && !pinned {
+				p.evictPartial(pb)
+			}
+			elem = prev
+			continue
+		}
+		e := elem.Value.(*cacheEntry)
+		if _, pinned := p.pinned[e.d]; e.opened == 0 && !pinned {
+			// the blob may have been evicted by another process sharing the cache directory
+			if err := image.DeleteBlob(p.cachePath, e.d); err != nil && !os.IsNotExist(err) {
+				logrus.Warnf("error while evicting %s: %v", e.d, err)
+			} else {
+				logrus.Debugf("Cache: evicted %s (%s)", e.d, units.BytesSize(float64(e.size)))
+				p.removeEntry(e)
+			}
+		}
+		elem = prev
+	}
+}
+
+// Pin prevents the blob from being evicted, e.g. for prefetching.
+// The blob is not pulled by Pin.
+func (p *BlobCacher) Pin(d digest.Digest) {
+	p.mu.Lock()
+	p.pinned[d] = struct{}{}
+	p.mu.Unlock()
+}
+
+// Unpin undoes Pin.
+func (p *BlobCacher) Unpin(d digest.Digest) {
+	p.mu.Lock()
+	delete(p.pinned, d)
+	p.evict()
+	p.mu.Unlock()
 }
 
-func (p *BlobCacher) openCachedBlob(img string, d digest.Digest) (image.BlobReader, error) {
-	return image.GetBlobReader(p.cachePath, d)
+type cachedBlobReader struct {
+	image.BlobReader
+	cacher *BlobCacher
+	entry  *cacheEntry
+	closed bool
+}
+
+func (r *cachedBlobReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	err := r.BlobReader.Close()
+	p := r.cacher
+	p.mu.Lock()
+	r.entry.opened--
+	p.evict()
+	p.mu.Unlock()
+	return err
 }
 
 func (p *BlobCacher) PullIndex(img string) (*spec.Index, error) {
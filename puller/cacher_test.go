@@ -0,0 +1,525 @@
+package puller
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/image"
+)
+
+// failingPuller fails for every blob.
+type failingPuller struct{}
+
+func (failingPuller) PullBlob(img string, d digest.Digest) (image.BlobReader, error) {
+	return nil, errors.New("should not be pulled")
+}
+
+func (failingPuller) PullIndex(img string) (*spec.Index, error) {
+	return nil, errors.New("should not be pulled")
+}
+
+func TestBlobCacherReload(t *testing.T) {
+	cachePath, err := ioutil.TempDir("", "test-blobcacher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+	if err := os.MkdirAll(filepath.Join(cachePath, "blobs", "sha256"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	good, err := image.WriteBlob(cachePath, []byte("good"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := digest.FromString("bad")
+	if err := ioutil.WriteFile(filepath.Join(cachePath, "blobs", "sha256", bad.Hex()), []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(cachePath, "tmp.blobwriter12345")
+	if err := ioutil.WriteFile(tmp, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cacher, err := NewBlobCacher(cachePath, failingPuller{}, BlobCacherOptions{VerifyOnLoad: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed, got %v", tmp, err)
+	}
+	r, err := cacher.PullBlob("dummy", good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "good" {
+		t.Fatalf("unexpected content %q", b)
+	}
+	if _, err := cacher.PullBlob("dummy", bad); err == nil {
+		t.Fatal("corrupted blob should not be loaded")
+	}
+}
+
+func TestBlobCacherSharedCacheDir(t *testing.T) {
+	cachePath, err := ioutil.TempDir("", "test-blobcacher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+	first, err := NewBlobCacher(cachePath, failingPuller{}, BlobCacherOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a file being written by the first cacher
+	tmp := filepath.Join(cachePath, "tmp.blobwriter12345")
+	if err := ioutil.WriteFile(tmp, []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBlobCacher(cachePath, failingPuller{}, BlobCacherOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); err != nil {
+		t.Fatalf("expected %s to be kept while the cache directory is shared, got %v", tmp, err)
+	}
+	runtime.KeepAlive(first)
+}
+
+// memPuller pulls blobs from the memory.
+type memPuller map[digest.Digest][]byte
+
+func (p memPuller) PullBlob(img string, d digest.Digest) (image.BlobReader, error) {
+	b, ok := p[d]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return nopCloser{bytes.NewReader(b)}, nil
+}
+
+func (p memPuller) PullIndex(img string) (*spec.Index, error) {
+	return nil, errors.New("not implemented")
+}
+
+func TestBlobCacherEviction(t *testing.T) {
+	cachePath, err := ioutil.TempDir("", "test-blobcacher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+	blobs := memPuller{}
+	var ds []digest.Digest
+	for i := 0; i < 4; i++ {
+		b := bytes.Repeat([]byte{byte('a' + i)}, 100)
+		d := digest.FromBytes(b)
+		blobs[d] = b
+		ds = append(ds, d)
+	}
+	cacher, err := NewBlobCacher(cachePath, blobs, BlobCacherOptions{MaxBytes: 250})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := func(d digest.Digest) bool {
+		_, err := os.Stat(filepath.Join(cachePath, "blobs", "sha256", d.Hex()))
+		return err == nil
+	}
+	cacher.Pin(ds[0])
+	for _, d := range ds[:2] {
+		r, err := cacher.PullBlob("dummy", d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+	// ds[2] is kept open
+	open, err := cacher.PullBlob("dummy", ds[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ds[1] is the only candidate: ds[0] is pinned, ds[2] is open.
+	if !cached(ds[0]) || cached(ds[1]) || !cached(ds[2]) {
+		t.Fatalf("unexpected eviction: %v %v %v", cached(ds[0]), cached(ds[1]), cached(ds[2]))
+	}
+	r, err := cacher.PullBlob("dummy", ds[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	// exceeding the limit, as nothing is evictable except ds[3]
+	if !cached(ds[0]) || !cached(ds[2]) || cached(ds[3]) {
+		t.Fatalf("unexpected eviction: %v %v %v", cached(ds[0]), cached(ds[2]), cached(ds[3]))
+	}
+	open.Close()
+	cacher.Unpin(ds[0])
+	r, err = cacher.PullBlob("dummy", ds[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	// ds[0] is the least recently used one
+	if cached(ds[0]) || !cached(ds[2]) {
+		t.Fatalf("unexpected eviction: %v %v", cached(ds[0]), cached(ds[2]))
+	}
+}
+
+func TestBlobCacherSharedEviction(t *testing.T) {
+	cachePath, err := ioutil.TempDir("", "test-blobcacher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+	blobs := memPuller{}
+	var ds []digest.Digest
+	for i := 0; i < 2; i++ {
+		b := bytes.Repeat([]byte{byte('a' + i)}, 100)
+		d := digest.FromBytes(b)
+		blobs[d] = b
+		ds = append(ds, d)
+	}
+	opts := BlobCacherOptions{MaxBytes: 150}
+	first, err := NewBlobCacher(cachePath, blobs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := first.PullBlob("dummy", ds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	// the second cacher lists ds[0], and evicts it for ds[1]
+	second, err := NewBlobCacher(cachePath, blobs, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err = second.PullBlob("dummy", ds[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if _, err := image.StatBlob(cachePath, ds[0]); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be evicted, got %v", ds[0], err)
+	}
+	// the first cacher pulls ds[0] again
+	r, err = first.PullBlob("dummy", ds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(b, blobs[ds[0]]) {
+		t.Fatalf("unexpected content %q: %v", string(b), err)
+	}
+}
+
+// flakyPuller fails the first n pulls of every blob, after sending a part of the blob.
+type flakyPuller struct {
+	memPuller
+	n int
+
+	mu    sync.Mutex
+	pulls map[digest.Digest]int
+}
+
+func (p *flakyPuller) PullBlob(img string, d digest.Digest) (image.BlobReader, error) {
+	p.mu.Lock()
+	p.pulls[d]++
+	fail := p.pulls[d] <= p.n
+	p.mu.Unlock()
+	r, err := p.memPuller.PullBlob(img, d)
+	if err != nil || !fail {
+		return r, err
+	}
+	// let the waiters pile up
+	time.Sleep(10 * time.Millisecond)
+	return &brokenReader{Reader: io.MultiReader(io.LimitReader(r, 10), errReader{})}, nil
+}
+
+type brokenReader struct {
+	io.Reader
+}
+
+func (*brokenReader) Seek(int64, int) (int64, error) {
+	return 0, errors.New("not seekable")
+}
+
+func (*brokenReader) Close() error {
+	return nil
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestBlobCacherFailure(t *testing.T) {
+	cachePath, err := ioutil.TempDir("", "test-blobcacher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+	b := bytes.Repeat([]byte("x"), 100)
+	d := digest.FromBytes(b)
+	flaky := &flakyPuller{memPuller: memPuller{d: b}, n: 2, pulls: make(map[digest.Digest]int, 0)}
+	cacher, err := NewBlobCacher(cachePath, flaky, BlobCacherOptions{Retries: 1, RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// all the waiters get the error, instead of hanging
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := cacher.PullBlob("dummy", d)
+			if err == nil {
+				r.Close()
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	failed := 0
+	for err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed == 0 {
+		t.Fatal("expected failures")
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(cachePath, "tmp.blobwriter*")); len(tmps) != 0 {
+		t.Fatalf("temporary files leaked: %v", tmps)
+	}
+	// the next pull succeeds
+	r, err := cacher.PullBlob("dummy", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Fatalf("unexpected content %q", got)
+	}
+}
+
+// slowPuller counts the pulls.
+type slowPuller struct {
+	memPuller
+
+	mu         sync.Mutex
+	pulls      map[digest.Digest]int
+	active     int
+	maxActive  int
+	totalPulls int
+}
+
+func (p *slowPuller) PullBlob(img string, d digest.Digest) (image.BlobReader, error) {
+	p.mu.Lock()
+	p.pulls[d]++
+	p.totalPulls++
+	p.active++
+	if p.active > p.maxActive {
+		p.maxActive = p.active
+	}
+	p.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+	p.mu.Lock()
+	p.active--
+	p.mu.Unlock()
+	return p.memPuller.PullBlob(img, d)
+}
+
+func TestBlobCacherPrefetch(t *testing.T) {
+	cachePath, err := ioutil.TempDir("", "test-blobcacher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+	slow := &slowPuller{memPuller: memPuller{}, pulls: make(map[digest.Digest]int, 0)}
+	var ds []digest.Digest
+	for i := 0; i < 32; i++ {
+		b := []byte(fmt.Sprintf("blob%d", i))
+		d := digest.FromBytes(b)
+		slow.memPuller[d] = b
+		ds = append(ds, d)
+	}
+	const concurrency = 3
+	cacher, err := NewBlobCacher(cachePath, slow, BlobCacherOptions{PrefetchConcurrency: concurrency})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacher.Prefetch("dummy", ds)
+	// duplicated
+	cacher.Prefetch("dummy", ds[:4])
+	// on-demand pulls during prefetching
+	for i := len(ds) - 1; i >= 0; i -= 4 {
+		r, err := cacher.PullBlob("dummy", ds[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		blobs, err := image.ListBlobs(cachePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the prefetched blobs must be unpinned, so that they can be evicted
+		cacher.mu.Lock()
+		pinned := len(cacher.pinned)
+		cacher.mu.Unlock()
+		if len(blobs) == len(ds) && pinned == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out: %d/%d blobs prefetched, %d blobs pinned", len(blobs), len(ds), pinned)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	slow.mu.Lock()
+	defer slow.mu.Unlock()
+	for d, n := range slow.pulls {
+		if n != 1 {
+			t.Errorf("%s pulled %d times", d, n)
+		}
+	}
+	// +1 for the on-demand pull
+	if slow.maxActive > concurrency+1 {
+		t.Errorf("expected at most %d concurrent pulls, got %d", concurrency+1, slow.maxActive)
+	}
+}
+
+// rangeMemPuller is a memPuller that implements RangePuller.
+type rangeMemPuller struct {
+	memPuller
+
+	mu     sync.Mutex
+	ranges []int64
+}
+
+func (p *rangeMemPuller) PullBlobRange(img string, desc spec.Descriptor, off, n int64) (io.ReadCloser, error) {
+	b, ok := p.memPuller[desc.Digest]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	p.mu.Lock()
+	p.ranges = append(p.ranges, off)
+	p.mu.Unlock()
+	return ioutil.NopCloser(bytes.NewReader(b[off : off+n])), nil
+}
+
+func TestBlobCacherPullBlobRange(t *testing.T) {
+	cachePath, err := ioutil.TempDir("", "test-blobcacher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+	b := make([]byte, 250)
+	for i := range b {
+		b[i] = byte(i)
+	}
+	desc := spec.Descriptor{Digest: digest.FromBytes(b), Size: int64(len(b))}
+	p := &rangeMemPuller{memPuller: memPuller{desc.Digest: b}}
+	cacher, err := NewBlobCacher(cachePath, p, BlobCacherOptions{ChunkSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := func(off, n int64) {
+		r, err := cacher.PullBlobRange("dummy", desc, off, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, b[off:off+n]) {
+			t.Fatalf("unexpected content at %d", off)
+		}
+	}
+	cached := func() bool {
+		_, err := os.Stat(filepath.Join(cachePath, "blobs", "sha256", desc.Digest.Hex()))
+		return err == nil
+	}
+	read(10, 20)
+	read(50, 60)
+	if len(p.ranges) != 2 || p.ranges[0] != 0 || p.ranges[1] != 100 {
+		t.Fatalf("expected chunks at 0 and 100 to be pulled, got %v", p.ranges)
+	}
+	if cached() {
+		t.Fatal("blob should not be cached before all the chunks are pulled")
+	}
+	read(240, 10)
+	if len(p.ranges) != 3 {
+		t.Fatalf("expected 3 chunks to be pulled, got %v", p.ranges)
+	}
+	if !cached() {
+		t.Fatal("blob should be cached after all the chunks are pulled")
+	}
+	read(0, 250)
+	if len(p.ranges) != 3 {
+		t.Fatalf("expected no more pulls, got %v", p.ranges)
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Join(cachePath, "partial")); len(entries) != 0 {
+		t.Fatalf("partial blobs should have been removed: %v", entries)
+	}
+}
+
+func TestBlobCacherPartialEviction(t *testing.T) {
+	cachePath, err := ioutil.TempDir("", "test-blobcacher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+	p := &rangeMemPuller{memPuller: memPuller{}}
+	var descs []spec.Descriptor
+	for i := 0; i < 4; i++ {
+		b := bytes.Repeat([]byte{byte(i)}, 1000)
+		desc := spec.Descriptor{Digest: digest.FromBytes(b), Size: int64(len(b))}
+		p.memPuller[desc.Digest] = b
+		descs = append(descs, desc)
+	}
+	cacher, err := NewBlobCacher(cachePath, p, BlobCacherOptions{ChunkSize: 100, MaxBytes: 250})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each read caches 2 chunks of a partial blob
+	for _, desc := range descs {
+		r, err := cacher.PullBlobRange("dummy", desc, 50, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+	cacher.mu.Lock()
+	cachedBytes, partials := cacher.cachedBytes, len(cacher.partials)
+	cacher.mu.Unlock()
+	if cachedBytes > 250 || partials != 1 {
+		t.Fatalf("expected the least recently used partial blobs to be evicted, got %d bytes in %d partial blobs", cachedBytes, partials)
+	}
+	if entries, _ := ioutil.ReadDir(filepath.Join(cachePath, "partial")); len(entries) != 1 {
+		t.Fatalf("expected the evicted partial blobs to be removed, got %v", entries)
+	}
+}
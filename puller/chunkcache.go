@@ -0,0 +1,293 @@
+package puller
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-units"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/image"
+)
+
+// DefaultChunkSize is the default size of the chunks for BlobCacher.PullBlobRange.
+const DefaultChunkSize = 1 << 20
+
+// errPromoted is returned when the partial blob has been completed and promoted to the cached blob.
+var errPromoted = errors.New("partial blob promoted")
+
+// partialBlob is a blob being cached chunk by chunk.
+// The chunks are written to a sparse file, and tracked in a bitmap.
+// When all the chunks are cached, the digest of the whole blob is verified, and
+// the file is promoted to the cached blob.
+type partialBlob struct {
+	desc spec.Descriptor
+	path string
+	// mu protects f. f is set to nil on promotion.
+	mu sync.RWMutex
+	f  *os.File
+
+	// the fields below are protected by BlobCacher.mu
+	bitmap   []uint64
+	nChunks  int64
+	nHave    int64
+	inflight map[int64]*inflight
+	// size is the total size of the cached chunks
+	size int64
+	// users is the number of the readPartial calls in progress. Partial blobs in use are never evicted.
+	users int
+	// elem is the element in BlobCacher.lru
+	elem *list.Element
+}
+
+func (pb *partialBlob) has(c int64) bool {
+	return pb.bitmap[c/64]&(1<<uint(c%64)) != 0
+}
+
+func (pb *partialBlob) set(c int64) {
+	pb.bitmap[c/64] |= 1 << uint(c%64)
+	pb.nHave++
+}
+
+func (p *BlobCacher) partialDir() string {
+	return filepath.Join(p.cachePath, "partial")
+}
+
+func (p *BlobCacher) chunkSize() int64 {
+	if p.opts.ChunkSize > 0 {
+		return p.opts.ChunkSize
+	}
+	return DefaultChunkSize
+}
+
+// PullBlobRange returns n bytes from the offset off of the blob.
+//
+// When the upstream puller implements RangePuller, only the chunks that contain the range are
+// pulled and cached, rather than the whole blob.
+// Otherwise, or if the blob is not larger than a chunk, the whole blob is pulled and cached.
+func (p *BlobCacher) PullBlobRange(img string, desc spec.Descriptor, off, n int64) (io.ReadCloser, error) {
+	off, n, err := clampRange(desc.Size, off, n)
+	if err != nil {
+		return nil, err
+	}
+	rp, ok := p.puller.(RangePuller)
+	p.mu.Lock()
+	_, cached := p.entries[desc.Digest]
+	p.mu.Unlock()
+	if ok && !cached && desc.Size > p.chunkSize() {
+		buf := make([]byte, n)
+		err := p.readPartial(img, rp, desc, buf, off)
+		if err == nil {
+			return ioutil.NopCloser(bytes.NewReader(buf)), nil
+		}
+		if err != errPromoted {
+			return nil, err
+		}
+	}
+	r, err := p.PullBlob(img, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: io.LimitReader(r, n), Closer: r}, nil
+}
+
+// readPartial reads the range into buf, after pulling the chunks that contain the range.
+func (p *BlobCacher) readPartial(img string, rp RangePuller, desc spec.Descriptor, buf []byte, off int64) error {
+	if len(buf) == 0 {
+		return nil
+	}
+	pb, err := p.getPartial(desc)
+	if err != nil {
+		return err
+	}
+	defer p.releasePartial(pb)
+	cs := p.chunkSize()
+	for c := off / cs; c <= (off+int64(len(buf))-1)/cs; c++ {
+		if err := p.ensureChunk(img, rp, pb, c); err != nil {
+			return err
+		}
+	}
+	pb.mu.RLock()
+	defer pb.mu.RUnlock()
+	if pb.f == nil {
+		return errPromoted
+	}
+	_, err = pb.f.ReadAt(buf, off)
+	return err
+}
+
+// getPartial returns the partial blob, after creating it if not created yet.
+// The partial blob must be released with releasePartial.
+func (p *BlobCacher) getPartial(desc spec.Descriptor) (*partialBlob, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pb, ok := p.partials[desc.Digest]; ok {
+		pb.users++
+		p.lru.MoveToFront(pb.elem)
+		return pb, nil
+	}
+	if err := os.MkdirAll(p.partialDir(), 0700); err != nil {
+		return nil, err
+	}
+	// the file name is unique to this BlobCacher, as the cache directory may be shared with other processes
+	f, err := ioutil.TempFile(p.partialDir(), desc.Digest.Algorithm().String()+"-"+desc.Digest.Hex()+".")
+	if err != nil {
+		return nil, err
+	}
+	path := f.Name()
+	// sparse
+	if err := f.Truncate(desc.Size); err != nil {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	nChunks := (desc.Size + p.chunkSize() - 1) / p.chunkSize()
+	pb := &partialBlob{
+		desc:     desc,
+		path:     path,
+		f:        f,
+		bitmap:   make([]uint64, (nChunks+63)/64),
+		nChunks:  nChunks,
+		inflight: make(map[int64]*inflight, 0),
+		users:    1,
+	}
+	pb.elem = p.lru.PushFront(pb)
+	p.partials[desc.Digest] = pb
+	return pb, nil
+}
+
+// releasePartial undoes getPartial.
+func (p *BlobCacher) releasePartial(pb *partialBlob) {
+	p.mu.Lock()
+	pb.users--
+	p.evict()
+	p.mu.Unlock()
+}
+
+// evictPartial removes the partial blob and its chunks.
+// Needs to be called with mu, and the partial blob must not be in use.
+func (p *BlobCacher) evictPartial(pb *partialBlob) {
+	pb.f.Close()
+	pb.f = nil
+	if err := os.Remove(pb.path); err != nil {
+		logrus.Warnf("error while evicting partial %s: %v", pb.desc.Digest, err)
+	}
+	logrus.Debugf("Cache: evicted partial %s (%s)", pb.desc.Digest, units.BytesSize(float64(pb.size)))
+	p.lru.Remove(pb.elem)
+	delete(p.partials, pb.desc.Digest)
+	p.cachedBytes -= pb.size
+}
+
+// ensureChunk pulls the chunk c unless it is already cached.
+// The chunk is pulled only once even if ensureChunk is called concurrently.
+func (p *BlobCacher) ensureChunk(img string, rp RangePuller, pb *partialBlob, c int64) error {
+	for {
+		p.mu.Lock()
+		if pb.has(c) {
+			p.mu.Unlock()
+			return nil
+		}
+		if fl, ok := pb.inflight[c]; ok {
+			p.mu.Unlock()
+			<-fl.done
+			if fl.err != nil {
+				return fl.err
+			}
+			continue
+		}
+		fl := &inflight{done: make(chan struct{})}
+		pb.inflight[c] = fl
+		p.mu.Unlock()
+		var n int64
+		err := p.withRetries(fmt.Sprintf("chunk %d of %s", c, pb.desc.Digest), func() error {
+			var err error
+			n, err = p.pullChunk(img, rp, pb, c)
+			return err
+		})
+		p.mu.Lock()
+		delete(pb.inflight, c)
+		complete := false
+		if err == nil {
+			pb.set(c)
+			pb.size += n
+			p.cachedBytes += n
+			complete = pb.nHave == pb.nChunks
+		}
+		fl.err = err
+		close(fl.done)
+		p.mu.Unlock()
+		if complete {
+			return p.promote(pb)
+		}
+		return err
+	}
+}
+
+// pullChunk pulls the chunk c, and returns the size of the chunk.
+func (p *BlobCacher) pullChunk(img string, rp RangePuller, pb *partialBlob, c int64) (int64, error) {
+	cs := p.chunkSize()
+	off, n, err := clampRange(pb.desc.Size, c*cs, cs)
+	if err != nil {
+		return 0, err
+	}
+	r, err := rp.PullBlobRange(img, pb.desc, off, n)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return 0, err
+	}
+	// f is never closed while chunks are being pulled, as promotion requires all the chunks
+	if _, err := pb.f.WriteAt(buf, off); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// promote verifies the digest of the completed partial blob, and moves it to the cached blobs.
+// The partial blob is removed on digest mismatch.
+func (p *BlobCacher) promote(pb *partialBlob) error {
+	pb.mu.Lock()
+	defer pb.mu.Unlock()
+	d := pb.desc.Digest
+	p.mu.Lock()
+	delete(p.partials, d)
+	p.lru.Remove(pb.elem)
+	p.cachedBytes -= pb.size
+	p.mu.Unlock()
+	f := pb.f
+	pb.f = nil
+	verifier := d.Verifier()
+	_, err := io.Copy(verifier, io.NewSectionReader(f, 0, pb.desc.Size))
+	f.Close()
+	if err == nil && !verifier.Verified() {
+		err = fmt.Errorf("digest mismatch for %s", d)
+	}
+	if err == nil {
+		err = image.PutBlobFile(p.cachePath, d, pb.path)
+	}
+	if err != nil {
+		os.Remove(pb.path)
+		return err
+	}
+	logrus.Debugf("Cache: completed %s from chunks", d)
+	p.mu.Lock()
+	p.addEntry(d, pb.desc.Size)
+	p.evict()
+	p.mu.Unlock()
+	return errPromoted
+}
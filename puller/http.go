@@ -0,0 +1,230 @@
+package puller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/registry"
+)
+
+// maxIndexSize is the limit of the size of index.json.
+const maxIndexSize = 4 << 20
+
+// HTTPPuller pulls images from a static HTTP(S) server that serves OCI image layouts.
+// img is the base URL of the layout, e.g. "https://example.com/images/foo".
+// The index is pulled from <img>/index.json, and the blobs are pulled from <img>/blobs/<alg>/<hex>
+// (or <img>/blobs/<alg>/<hex[:2]>/<hex> if <img>/oci-layout specifies the sharded layout).
+//
+// HTTPPuller lacks caching of blobs. Use with BlobCacher.
+type HTTPPuller struct {
+	client *http.Client
+
+	mu sync.Mutex
+	// indexes are the cached indexes, revalidated with ETag. key: img
+	indexes map[string]*cachedIndex
+	// layouts are the blobs layouts read from the oci-layout files. key: img
+	layouts map[string]image.BlobsLayout
+}
+
+type cachedIndex struct {
+	etag string
+	idx  *spec.Index
+}
+
+// NewHTTPPuller creates HTTPPuller.
+// If client is nil, a client with a connection pool suitable for pulling many blobs is used.
+func NewHTTPPuller(client *http.Client) *HTTPPuller {
+	if client == nil {
+		// same as http.DefaultTransport, except MaxIdleConnsPerHost
+		tr := &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   32,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		}
+		client = &http.Client{Transport: tr}
+	}
+	return &HTTPPuller{
+		client:  client,
+		indexes: make(map[string]*cachedIndex, 0),
+		layouts: make(map[string]image.BlobsLayout, 0),
+	}
+}
+
+func (p *HTTPPuller) PullIndex(img string) (*spec.Index, error) {
+	u := strings.TrimSuffix(img, "/") + "/index.json"
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	cached := p.indexes[img]
+	p.mu.Unlock()
+	if cached != nil {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if cached == nil {
+			return nil, fmt.Errorf("unexpected status %s for %s", resp.Status, u)
+		}
+		return copyIndex(cached.idx), nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("unexpected status %s for %s", resp.Status, u)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxIndexSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxIndexSize {
+		return nil, fmt.Errorf("%s is too large", u)
+	}
+	var idx spec.Index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, err
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		p.mu.Lock()
+		p.indexes[img] = &cachedIndex{etag: etag, idx: copyIndex(&idx)}
+		p.mu.Unlock()
+	}
+	return &idx, nil
+}
+
+// copyIndex copies the index, so that the callers can modify the returned index.
+func copyIndex(idx *spec.Index) *spec.Index {
+	c := *idx
+	c.Manifests = make([]spec.Descriptor, len(idx.Manifests))
+	for i, m := range idx.Manifests {
+		c.Manifests[i] = m
+		if m.Annotations != nil {
+			c.Manifests[i].Annotations = make(map[string]string, len(m.Annotations))
+			for k, v := range m.Annotations {
+				c.Manifests[i].Annotations[k] = v
+			}
+		}
+	}
+	return &c
+}
+
+// PullBlob returns the reader for the blob.
+// Seeking is implemented with HTTP Range requests.
+func (p *HTTPPuller) PullBlob(img string, d digest.Digest) (image.BlobReader, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	u, err := p.blobURL(img, d)
+	if err != nil {
+		return nil, err
+	}
+	return newHTTPReader(func(off int64) (io.ReadCloser, int64, error) {
+		return getRange(p.client, u, off, 0)
+	})
+}
+
+func (p *HTTPPuller) PullBlobRange(img string, desc spec.Descriptor, off, n int64) (io.ReadCloser, error) {
+	off, n, err := clampRange(desc.Size, off, n)
+	if err != nil {
+		return nil, err
+	}
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	u, err := p.blobURL(img, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := getRange(p.client, u, off, n)
+	return r, err
+}
+
+// blobURL returns the URL of the blob.
+func (p *HTTPPuller) blobURL(img string, d digest.Digest) (string, error) {
+	l, err := p.blobsLayout(img)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(img, "/") + "/" + image.BlobRelPath(d, l), nil
+}
+
+// blobsLayout returns the blobs layout specified in <img>/oci-layout.
+// The flat layout is assumed if the file is missing.
+func (p *HTTPPuller) blobsLayout(img string) (image.BlobsLayout, error) {
+	p.mu.Lock()
+	l, ok := p.layouts[img]
+	p.mu.Unlock()
+	if ok {
+		return l, nil
+	}
+	u := strings.TrimSuffix(img, "/") + "/" + spec.ImageLayoutFile
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return l, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxIndexSize))
+		if err != nil {
+			return l, err
+		}
+		if l, err = image.UnmarshalBlobsLayout(b); err != nil {
+			return l, fmt.Errorf("error while parsing %s: %v", u, err)
+		}
+	case http.StatusNotFound:
+	default:
+		return l, fmt.Errorf("unexpected status %s for %s", resp.Status, u)
+	}
+	p.mu.Lock()
+	p.layouts[img] = l
+	p.mu.Unlock()
+	return l, nil
+}
+
+// getRange gets n bytes from the offset off (until the end if n <= 0),
+// and returns the size of the whole content (-1 if unknown).
+func getRange(client *http.Client, u string, off, n int64) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r := registry.RangeHeader(off, n); r != "" {
+		req.Header.Set("Range", r)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("unexpected status %s for %s", resp.Status, u)
+	}
+	return registry.RangeResponseBody(resp, off, n)
+}
@@ -0,0 +1,102 @@
+package puller
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/image"
+)
+
+func TestHTTPPuller(t *testing.T) {
+	img, err := ioutil.TempDir("", "filegrain-test-httppuller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(img)
+	if err := image.Init(img); err != nil {
+		t.Fatal(err)
+	}
+	blob := bytes.Repeat([]byte("0123456789"), 1000)
+	d, err := image.WriteBlob(img, blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := image.PutManifestDescriptorToIndex(img, &spec.Descriptor{
+		MediaType:   spec.MediaTypeImageManifest,
+		Digest:      d,
+		Annotations: map[string]string{image.RefNameAnnotation: "latest"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var notModified, ranged int32
+	fileServer := http.FileServer(http.Dir(img))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if path.Base(r.URL.Path) == "index.json" {
+			w.Header().Set("ETag", `"42"`)
+			if r.Header.Get("If-None-Match") == `"42"` {
+				atomic.AddInt32(&notModified, 1)
+			}
+		}
+		if r.Header.Get("Range") != "" {
+			atomic.AddInt32(&ranged, 1)
+		}
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	p := NewHTTPPuller(nil)
+	for i := 0; i < 2; i++ {
+		idx, err := p.PullIndex(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(idx.Manifests) != 1 || idx.Manifests[0].Digest != d {
+			t.Fatalf("unexpected index %+v", idx)
+		}
+		// modifying the returned index must not affect the cache
+		idx.Manifests[0].Annotations[image.RefNameAnnotation] = "modified"
+	}
+	if notModified != 1 {
+		t.Errorf("expected index.json to be revalidated once, got %d", notModified)
+	}
+	idx, err := p.PullIndex(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refName := idx.Manifests[0].Annotations[image.RefNameAnnotation]; refName != "latest" {
+		t.Errorf("cached index was modified: %q", refName)
+	}
+
+	br, err := p.PullBlob(srv.URL, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+	if _, err := br.Seek(-5, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "56789" {
+		t.Errorf("unexpected content %q", b)
+	}
+	if ranged != 1 {
+		t.Errorf("expected 1 range request, got %d", ranged)
+	}
+	if _, err := p.PullBlob(srv.URL, digest.FromString("nonexistent")); err == nil {
+		t.Error("expected error for nonexistent blob")
+	}
+}
@@ -0,0 +1,79 @@
+package puller
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// rangeOpener opens the stream from the offset off, and returns the size of the whole stream.
+type rangeOpener func(off int64) (io.ReadCloser, int64, error)
+
+// httpReader implements image.BlobReader over HTTP.
+// Seeking is deferred until the next Read, which sends the request with the Range header.
+type httpReader struct {
+	open rangeOpener
+	size int64
+	off  int64
+	body io.ReadCloser
+	// bodyOff is the offset of body
+	bodyOff int64
+}
+
+func newHTTPReader(open rangeOpener) (*httpReader, error) {
+	body, size, err := open(0)
+	if err != nil {
+		return nil, err
+	}
+	return &httpReader{open: open, size: size, body: body}, nil
+}
+
+func (r *httpReader) Read(p []byte) (int, error) {
+	if r.size >= 0 && r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil || r.bodyOff != r.off {
+		if r.body != nil {
+			r.body.Close()
+			r.body = nil
+		}
+		body, _, err := r.open(r.off)
+		if err != nil {
+			return 0, err
+		}
+		r.body, r.bodyOff = body, r.off
+	}
+	n, err := r.body.Read(p)
+	r.off += int64(n)
+	r.bodyOff = r.off
+	return n, err
+}
+
+func (r *httpReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		if r.size < 0 {
+			return 0, errors.New("seeking from the end of unknown size")
+		}
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *httpReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
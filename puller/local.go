@@ -1,6 +1,8 @@
 package puller
 
 import (
+	"io"
+
 	"github.com/opencontainers/go-digest"
 	spec "github.com/opencontainers/image-spec/specs-go/v1"
 
@@ -22,3 +24,24 @@ func (p *LocalPuller) PullBlob(img string, d digest.Digest) (image.BlobReader, e
 func (p *LocalPuller) PullIndex(img string) (*spec.Index, error) {
 	return image.ReadIndex(img)
 }
+
+func (p *LocalPuller) PullBlobRange(img string, desc spec.Descriptor, off, n int64) (io.ReadCloser, error) {
+	off, n, err := clampRange(desc.Size, off, n)
+	if err != nil {
+		return nil, err
+	}
+	r, err := image.GetBlobReader(img, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: io.LimitReader(r, n), Closer: r}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
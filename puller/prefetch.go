@@ -0,0 +1,121 @@
+package puller
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/opencontainers/go-digest"
+)
+
+const DefaultPrefetchConcurrency = 4
+
+type prefetchItem struct {
+	img string
+	d   digest.Digest
+}
+
+// prefetchQueue is the FIFO queue of the blobs to be prefetched.
+// The blobs are deduplicated.
+type prefetchQueue struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	items *list.List // prefetchItem
+	elems map[digest.Digest]*list.Element
+}
+
+func newPrefetchQueue() *prefetchQueue {
+	q := &prefetchQueue{
+		items: list.New(),
+		elems: make(map[digest.Digest]*list.Element, 0),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push returns false if d is already queued.
+func (q *prefetchQueue) push(img string, d digest.Digest) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.elems[d]; ok {
+		return false
+	}
+	q.elems[d] = q.items.PushBack(prefetchItem{img: img, d: d})
+	q.cond.Signal()
+	return true
+}
+
+// pop blocks until an item is queued.
+func (q *prefetchQueue) pop() prefetchItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.items.Len() == 0 {
+		q.cond.Wait()
+	}
+	item := q.items.Remove(q.items.Front()).(prefetchItem)
+	delete(q.elems, item.d)
+	return item
+}
+
+// remove returns false if d is not queued.
+func (q *prefetchQueue) remove(d digest.Digest) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	elem, ok := q.elems[d]
+	if !ok {
+		return false
+	}
+	q.items.Remove(elem)
+	delete(q.elems, d)
+	return true
+}
+
+// Prefetch pins the blobs and enqueues them for pulling in background, in the order of ds.
+// The blobs are unpinned when they are pulled.
+// The queued blobs are pulled by PrefetchConcurrency workers.
+// Blobs being pulled on demand are deduplicated, and PullBlob calls take priority over
+// the queue: a blob requested via PullBlob is removed from the queue, and workers do not
+// start pulling a new blob while PullBlob calls are in progress.
+//
+// When the cache size exceeds MaxBytes, the queued blobs are skipped and unpinned.
+func (p *BlobCacher) Prefetch(img string, ds []digest.Digest) {
+	p.prefetchOnce.Do(func() {
+		n := p.opts.PrefetchConcurrency
+		if n <= 0 {
+			n = DefaultPrefetchConcurrency
+		}
+		for i := 0; i < n; i++ {
+			go p.prefetchWorker()
+		}
+	})
+	for _, d := range ds {
+		p.Pin(d)
+		p.prefetch.push(img, d)
+	}
+}
+
+func (p *BlobCacher) prefetchWorker() {
+	for {
+		item := p.prefetch.pop()
+		p.mu.Lock()
+		for p.onDemand > 0 {
+			p.onDemandCond.Wait()
+		}
+		full := p.opts.MaxBytes > 0 && p.cachedBytes > p.opts.MaxBytes
+		p.mu.Unlock()
+		if full {
+			logrus.Debugf("Cache is full, skipping prefetching %s", item.d)
+			p.Unpin(item.d)
+			continue
+		}
+		r, err := p.pullBlob(item.img, item.d)
+		// the prefetched blob is evicted in the LRU order, as well as the other blobs
+		p.Unpin(item.d)
+		if err != nil {
+			logrus.Warnf("error while prefetching %s: %v", item.d, err)
+			continue
+		}
+		r.Close()
+		logrus.Debugf("Prefetched %s", item.d)
+	}
+}
@@ -1,6 +1,9 @@
 package puller
 
 import (
+	"fmt"
+	"io"
+
 	"github.com/opencontainers/go-digest"
 	spec "github.com/opencontainers/image-spec/specs-go/v1"
 
@@ -11,3 +14,27 @@ type Puller interface {
 	PullBlob(img string, d digest.Digest) (image.BlobReader, error)
 	PullIndex(img string) (*spec.Index, error)
 }
+
+// Prefetcher pulls the blobs in background, in the order of ds.
+type Prefetcher interface {
+	Prefetch(img string, ds []digest.Digest)
+}
+
+// RangePuller can pull a part of a blob without pulling the whole blob.
+type RangePuller interface {
+	Puller
+	// PullBlobRange returns the reader for n bytes from the offset off of the blob.
+	// desc.Size must be set.
+	PullBlobRange(img string, desc spec.Descriptor, off, n int64) (io.ReadCloser, error)
+}
+
+// clampRange clamps the range [off, off+n) to the blob size.
+func clampRange(size, off, n int64) (int64, int64, error) {
+	if off < 0 || n < 0 || off > size {
+		return 0, 0, fmt.Errorf("invalid range %d+%d for the blob size %d", off, n, size)
+	}
+	if off+n > size {
+		n = size - off
+	}
+	return off, n, nil
+}
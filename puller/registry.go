@@ -0,0 +1,126 @@
+package puller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/registry"
+)
+
+// RegistryPuller pulls images from Docker Registry HTTP API v2.
+// img is a reference like "registry.example.com/foo:tag".
+//
+// RegistryPuller lacks caching. Use with BlobCacher.
+type RegistryPuller struct {
+	client *registry.Client
+
+	mu sync.Mutex
+	// manifests are pulled from /v2/<name>/manifests/<digest> rather than /v2/<name>/blobs/<digest>
+	manifests map[digest.Digest]struct{}
+	// synthesized are the manifests (and the indexes) fetched by PullIndex
+	synthesized map[digest.Digest][]byte
+}
+
+func NewRegistryPuller(client *registry.Client) *RegistryPuller {
+	if client == nil {
+		client = registry.NewClient()
+	}
+	return &RegistryPuller{
+		client:      client,
+		manifests:   make(map[digest.Digest]struct{}, 0),
+		synthesized: make(map[digest.Digest][]byte, 0),
+	}
+}
+
+// PullIndex returns the index of img.
+// The index contains a single descriptor annotated with the tag (or the digest) of img.
+// If img refers to an index (e.g. a manifest list), the descriptor refers to the index
+// as a nested index, so that the manifests in the index do not share the tag.
+func (p *RegistryPuller) PullIndex(img string) (*spec.Index, error) {
+	ref, err := registry.ParseReference(img)
+	if err != nil {
+		return nil, err
+	}
+	desc, b, err := p.client.GetManifest(ref, ref.Object())
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch desc.MediaType {
+	case spec.MediaTypeImageIndex, registry.MediaTypeDockerManifestList:
+		var nested spec.Index
+		if err := json.Unmarshal(b, &nested); err != nil {
+			return nil, err
+		}
+		for _, m := range nested.Manifests {
+			p.manifests[m.Digest] = struct{}{}
+		}
+	case spec.MediaTypeImageManifest, registry.MediaTypeDockerManifest:
+	default:
+		return nil, fmt.Errorf("unsupported manifest mediaType %q for %s", desc.MediaType, ref)
+	}
+	p.synthesized[desc.Digest] = b
+	desc.Annotations = map[string]string{image.RefNameAnnotation: ref.Object()}
+	return &spec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []spec.Descriptor{*desc},
+	}, nil
+}
+
+func (p *RegistryPuller) PullBlob(img string, d digest.Digest) (image.BlobReader, error) {
+	ref, err := registry.ParseReference(img)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	b, synthesized := p.synthesized[d]
+	_, isManifest := p.manifests[d]
+	p.mu.Unlock()
+	if synthesized {
+		return nopCloser{bytes.NewReader(b)}, nil
+	}
+	if isManifest {
+		_, b, err := p.client.GetManifest(ref, d.String())
+		if err != nil {
+			return nil, err
+		}
+		return nopCloser{bytes.NewReader(b)}, nil
+	}
+	return newHTTPReader(func(off int64) (io.ReadCloser, int64, error) {
+		return p.client.GetBlob(ref, d, off, 0)
+	})
+}
+
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func (p *RegistryPuller) PullBlobRange(img string, desc spec.Descriptor, off, n int64) (io.ReadCloser, error) {
+	off, n, err := clampRange(desc.Size, off, n)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	ref, err := registry.ParseReference(img)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := p.client.GetBlob(ref, desc.Digest, off, n)
+	return r, err
+}
@@ -0,0 +1,171 @@
+package puller
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/internal/registrytest"
+	"github.com/AkihiroSuda/filegrain/registry"
+)
+
+const testToken = "t0k3n"
+
+// newTestRegistry starts a registry that requires the bearer token for pulling "foo".
+func newTestRegistry() *registrytest.Registry {
+	reg := registrytest.NewRegistry()
+	reg.Token = testToken
+	reg.Scope = "repository:foo:pull"
+	return reg
+}
+
+func TestRegistryPuller(t *testing.T) {
+	reg := newTestRegistry()
+	defer reg.Close()
+	blob := []byte(strings.Repeat("0123456789", 1000))
+	blobDigest := digest.FromBytes(blob)
+	reg.PutBlob("foo", blob)
+	manifest := spec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Layers: []spec.Descriptor{
+			{MediaType: spec.MediaTypeImageLayer, Digest: blobDigest, Size: int64(len(blob))},
+		},
+	}
+	manifestBlob, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest := digest.FromBytes(manifestBlob)
+	reg.PutManifest("foo", "tag", spec.MediaTypeImageManifest, manifestBlob)
+
+	client := registry.NewClient()
+	client.PlainHTTP = true
+	client.Credentials = nil
+	p := NewRegistryPuller(client)
+	img := reg.Host() + "/foo:tag"
+
+	idx, err := p.PullIndex(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Manifests) != 1 {
+		t.Fatalf("expected 1 manifest, got %+v", idx.Manifests)
+	}
+	m := idx.Manifests[0]
+	if m.Digest != manifestDigest || m.MediaType != spec.MediaTypeImageManifest {
+		t.Fatalf("unexpected descriptor %+v", m)
+	}
+	if refName := m.Annotations[image.RefNameAnnotation]; refName != "tag" {
+		t.Fatalf("expected ref name %q, got %q", "tag", refName)
+	}
+
+	mr, err := p.PullBlob(img, manifestDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(mr)
+	mr.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, manifestBlob) {
+		t.Fatalf("unexpected manifest %q", b)
+	}
+
+	br, err := p.PullBlob(img, blobDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer br.Close()
+	for _, off := range []int64{4242, 10, 9999} {
+		if _, err := br.Seek(off, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 5)
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			t.Fatal(err)
+		}
+		if expected := blob[off:min64(off+5, int64(len(blob)))]; !bytes.Equal(buf[:n], expected) {
+			t.Fatalf("at %d: expected %q, got %q", off, expected, buf[:n])
+		}
+	}
+
+	if _, err := p.PullBlob(img, digest.FromString("nonexistent")); !registry.IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+}
+
+func TestRegistryPullerManifestList(t *testing.T) {
+	reg := newTestRegistry()
+	defer reg.Close()
+	idx := spec.Index{Versioned: specs.Versioned{SchemaVersion: 2}}
+	for _, arch := range []string{"amd64", "arm64"} {
+		b, err := json.Marshal(spec.Manifest{Versioned: specs.Versioned{SchemaVersion: 2}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = append(b, arch...) // make the digests distinct
+		d := digest.FromBytes(b)
+		reg.PutManifest("foo", "", spec.MediaTypeImageManifest, b)
+		idx.Manifests = append(idx.Manifests, spec.Descriptor{
+			MediaType: spec.MediaTypeImageManifest,
+			Digest:    d,
+			Size:      int64(len(b)),
+			Platform:  &spec.Platform{OS: "linux", Architecture: arch},
+		})
+	}
+	idxBlob, err := json.Marshal(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idxDigest := digest.FromBytes(idxBlob)
+	reg.PutManifest("foo", "tag", spec.MediaTypeImageIndex, idxBlob)
+
+	client := registry.NewClient()
+	client.PlainHTTP = true
+	client.Credentials = nil
+	p := NewRegistryPuller(client)
+	img := reg.Host() + "/foo:tag"
+	pulled, err := p.PullIndex(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the tag must refer to a single descriptor, i.e. the nested index
+	if len(pulled.Manifests) != 1 {
+		t.Fatalf("expected 1 descriptor, got %+v", pulled.Manifests)
+	}
+	m := pulled.Manifests[0]
+	if m.Digest != idxDigest || m.MediaType != spec.MediaTypeImageIndex || m.Annotations[image.RefNameAnnotation] != "tag" {
+		t.Fatalf("unexpected descriptor %+v", m)
+	}
+	for _, d := range append([]digest.Digest{idxDigest}, idx.Manifests[0].Digest, idx.Manifests[1].Digest) {
+		r, err := p.PullBlob(img, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := digest.FromBytes(b); got != d {
+			t.Fatalf("expected %s, got %s", d, got)
+		}
+	}
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,250 @@
+package puller
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/image"
+)
+
+// DefaultMaxSize is the default size limit of the blobs pulled with the descriptors that lack the sizes,
+// e.g. the sidecar blobs referenced from the annotations.
+const DefaultMaxSize = 256 << 20
+
+// DescriptorPuller can pull a blob with the size in the descriptor.
+type DescriptorPuller interface {
+	Puller
+	// PullBlobWithDescriptor is similar to PullBlob, but fails if the size of the blob does not match desc.Size.
+	// If desc.Size is zero, the size is limited by the puller.
+	PullBlobWithDescriptor(img string, desc spec.Descriptor) (image.BlobReader, error)
+}
+
+// PullBlobWithDescriptor pulls the blob with p.PullBlobWithDescriptor if p implements DescriptorPuller,
+// otherwise with p.PullBlob.
+func PullBlobWithDescriptor(p Puller, img string, desc spec.Descriptor) (image.BlobReader, error) {
+	if dp, ok := p.(DescriptorPuller); ok {
+		return dp.PullBlobWithDescriptor(img, desc)
+	}
+	return p.PullBlob(img, desc.Digest)
+}
+
+// NewVerifyingPuller returns a DescriptorPuller that verifies the digests and the sizes of the blobs.
+//
+// The blobs pulled with PullBlobWithDescriptor (i.e. the manifests, the configs, and the sidecar blobs)
+// are verified while the caller reads them, and the reader fails at EOF on mismatch.
+// The blobs are limited to maxSize bytes if the descriptors lack the sizes.
+// Zero maxSize means DefaultMaxSize.
+//
+// The blobs pulled with PullBlob (e.g. the file blobs and the layers) are verified by BlobCacher when
+// the blobs are fetched, if p is a BlobCacher. Otherwise they are verified as a whole on the first pull,
+// and the blobs larger than maxSize cannot be pulled.
+//
+// The returned puller implements Prefetcher if p implements it.
+// The returned puller implements RangePuller only if p is a BlobCacher, as the ranges cannot be verified
+// without the whole blob. Note that the ranges read from a partially fetched blob are not verified until
+// all the chunks of the blob are fetched.
+// If p is already a verifying puller, p is returned.
+func NewVerifyingPuller(p Puller, maxSize int64) DescriptorPuller {
+	if vp, ok := p.(verifying); ok {
+		return vp
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	vp := &verifyingPuller{
+		Puller:  p,
+		maxSize: maxSize,
+	}
+	bc, isCacher := p.(*BlobCacher)
+	if !isCacher {
+		vp.verified = newDigestSet(maxVerified)
+	}
+	pf, isPrefetcher := p.(Prefetcher)
+	switch {
+	case isCacher:
+		// BlobCacher implements Prefetcher as well
+		return struct {
+			*verifyingRangePuller
+			Prefetcher
+		}{&verifyingRangePuller{vp, bc}, bc}
+	case isPrefetcher:
+		return struct {
+			*verifyingPuller
+			Prefetcher
+		}{vp, pf}
+	}
+	return vp
+}
+
+// maxVerified is the number of the digests remembered as verified, for the pullers other than BlobCacher.
+const maxVerified = 4096
+
+type verifying interface {
+	DescriptorPuller
+	verifying()
+}
+
+type verifyingPuller struct {
+	Puller
+	maxSize int64
+	// verified is non-nil if the blobs pulled with PullBlob need to be verified here
+	verified *digestSet
+}
+
+func (vp *verifyingPuller) verifying() {}
+
+func (vp *verifyingPuller) PullBlob(img string, d digest.Digest) (image.BlobReader, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	r, err := vp.Puller.PullBlob(img, d)
+	if err != nil || vp.verified == nil || vp.verified.contains(d) {
+		return r, err
+	}
+	if err := verifyBlob(r, d, vp.maxSize); err != nil {
+		r.Close()
+		return nil, err
+	}
+	vp.verified.add(d)
+	return r, nil
+}
+
+// verifyBlob verifies the digest of r, and rewinds r.
+func verifyBlob(r image.BlobReader, d digest.Digest, limit int64) error {
+	verifier := d.Verifier()
+	// read an extra byte to detect the excess
+	n, err := io.Copy(verifier, io.LimitReader(r, limit+1))
+	if err != nil {
+		return err
+	}
+	if n > limit {
+		return fmt.Errorf("blob %s exceeds the size limit %d", d, limit)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("digest mismatch for %s", d)
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	return err
+}
+
+// digestSet is a set of digests, which forgets the oldest digest when the set is full.
+type digestSet struct {
+	mu    sync.Mutex
+	max   int
+	m     map[digest.Digest]*list.Element
+	order *list.List
+}
+
+func newDigestSet(max int) *digestSet {
+	return &digestSet{
+		max:   max,
+		m:     make(map[digest.Digest]*list.Element, 0),
+		order: list.New(),
+	}
+}
+
+func (s *digestSet) contains(d digest.Digest) bool {
+	s.mu.Lock()
+	_, ok := s.m[d]
+	s.mu.Unlock()
+	return ok
+}
+
+func (s *digestSet) add(d digest.Digest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.m[d]; ok {
+		return
+	}
+	s.m[d] = s.order.PushBack(d)
+	if s.order.Len() > s.max {
+		oldest := s.order.Front()
+		s.order.Remove(oldest)
+		delete(s.m, oldest.Value.(digest.Digest))
+	}
+}
+
+func (vp *verifyingPuller) PullBlobWithDescriptor(img string, desc spec.Descriptor) (image.BlobReader, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	r, err := vp.Puller.PullBlob(img, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	limit := desc.Size
+	if limit == 0 {
+		limit = vp.maxSize
+	}
+	return &verifyingReader{
+		BlobReader: r,
+		d:          desc.Digest,
+		size:       desc.Size,
+		limit:      limit,
+		verifier:   desc.Digest.Verifier(),
+	}, nil
+}
+
+// verifyingReader verifies the digest and the size of the blob while reading.
+// Read returns an error instead of io.EOF if the blob does not match.
+type verifyingReader struct {
+	image.BlobReader
+	d digest.Digest
+	// size is checked if non-zero
+	size     int64
+	limit    int64
+	verifier digest.Verifier
+	n        int64
+}
+
+func (r *verifyingReader) Read(b []byte) (int, error) {
+	// read an extra byte to detect the excess
+	if rest := r.limit + 1 - r.n; int64(len(b)) > rest {
+		b = b[:rest]
+	}
+	n, err := r.BlobReader.Read(b)
+	r.verifier.Write(b[:n])
+	r.n += int64(n)
+	if r.n > r.limit {
+		return n, fmt.Errorf("blob %s exceeds the size limit %d", r.d, r.limit)
+	}
+	if err == io.EOF {
+		if r.size != 0 && r.n != r.size {
+			return n, fmt.Errorf("unexpected size %d for %s, expected %d", r.n, r.d, r.size)
+		}
+		if !r.verifier.Verified() {
+			return n, fmt.Errorf("digest mismatch for %s", r.d)
+		}
+	}
+	return n, err
+}
+
+// Seek supports only rewinding, as the digest cannot be verified after skipping the contents.
+func (r *verifyingReader) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, fmt.Errorf("blob %s: verifying reader cannot seek to %d (whence=%d)", r.d, offset, whence)
+	}
+	if _, err := r.BlobReader.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r.verifier = r.d.Verifier()
+	r.n = 0
+	return 0, nil
+}
+
+type verifyingRangePuller struct {
+	*verifyingPuller
+	rp RangePuller
+}
+
+func (vp *verifyingRangePuller) PullBlobRange(img string, desc spec.Descriptor, off, n int64) (io.ReadCloser, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	return vp.rp.PullBlobRange(img, desc, off, n)
+}
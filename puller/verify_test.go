@@ -0,0 +1,121 @@
+package puller
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/image"
+)
+
+func TestVerifyingPuller(t *testing.T) {
+	img, err := ioutil.TempDir("", "test-verifyingpuller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(img)
+	if err := image.Init(img); err != nil {
+		t.Fatal(err)
+	}
+	good, err := image.WriteBlob(img, []byte("good"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := digest.FromString("original")
+	if err := ioutil.WriteFile(image.BlobPath(img, tampered), []byte("tampered"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := NewVerifyingPuller(NewLocalPuller(), 2)
+	// the ranges cannot be verified without BlobCacher
+	if _, ok := p.(RangePuller); ok {
+		t.Fatal("RangePuller should not be implemented for LocalPuller")
+	}
+	if _, ok := p.(Prefetcher); ok {
+		t.Fatal("Prefetcher should not be implemented for LocalPuller")
+	}
+	if NewVerifyingPuller(p, 0) != p {
+		t.Fatal("verifying puller should not be wrapped twice")
+	}
+	// the file blobs are verified as a whole, as LocalPuller does not verify them
+	for _, maxSize := range []int64{0, 2} {
+		wp := NewVerifyingPuller(NewLocalPuller(), maxSize)
+		if _, err := wp.PullBlob(img, tampered); err == nil {
+			t.Fatal("tampered blob should not be pulled")
+		}
+		r, err := wp.PullBlob(img, good)
+		if maxSize == 2 {
+			if err == nil {
+				t.Fatal("blob exceeding the size limit should not be pulled")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || string(b) != "good" {
+			t.Fatalf("unexpected content %q: %v", string(b), err)
+		}
+	}
+	for _, tc := range []struct {
+		desc spec.Descriptor
+		ok   bool
+	}{
+		{spec.Descriptor{Digest: good, Size: 4}, true},
+		{spec.Descriptor{Digest: good, Size: 3}, false},
+		{spec.Descriptor{Digest: good, Size: 5}, false},
+		// exceeds maxSize
+		{spec.Descriptor{Digest: good}, false},
+		{spec.Descriptor{Digest: tampered, Size: 8}, false},
+	} {
+		r, err := p.PullBlobWithDescriptor(img, tc.desc)
+		if err != nil {
+			t.Fatalf("%+v: %v", tc.desc, err)
+		}
+		// the blob is verified while reading
+		b, err := ioutil.ReadAll(r)
+		if (err == nil) != tc.ok {
+			t.Fatalf("%+v: unexpected error %v", tc.desc, err)
+		}
+		if err == nil && string(b) != "good" {
+			t.Fatalf("%+v: unexpected content %q", tc.desc, string(b))
+		}
+		if tc.ok {
+			// rewinding restarts the verification
+			if _, err := r.Seek(0, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			if b, err = ioutil.ReadAll(r); err != nil || string(b) != "good" {
+				t.Fatalf("%+v: unexpected content after rewinding %q: %v", tc.desc, string(b), err)
+			}
+			if _, err := r.Seek(1, io.SeekStart); err == nil {
+				t.Fatalf("%+v: seeking to the middle should fail", tc.desc)
+			}
+		}
+		r.Close()
+	}
+}
+
+func TestVerifyingPullerWithBlobCacher(t *testing.T) {
+	cachePath, err := ioutil.TempDir("", "test-verifyingpuller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cachePath)
+	cacher, err := NewBlobCacher(cachePath, NewLocalPuller(), BlobCacherOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewVerifyingPuller(cacher, 0)
+	if _, ok := p.(RangePuller); !ok {
+		t.Fatal("RangePuller should be implemented for BlobCacher")
+	}
+	if _, ok := p.(Prefetcher); !ok {
+		t.Fatal("Prefetcher should be implemented for BlobCacher")
+	}
+}
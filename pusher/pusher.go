@@ -0,0 +1,198 @@
+// Package pusher pushes images in local OCI image layouts to registries.
+package pusher
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	progressbar "github.com/cheggaaa/pb"
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/puller"
+	"github.com/AkihiroSuda/filegrain/registry"
+	"github.com/AkihiroSuda/filegrain/walker"
+)
+
+const DefaultJobs = 4
+
+type Options struct {
+	// Client defaults to registry.NewClient().
+	Client *registry.Client
+	// Jobs is the number of the concurrent uploads. Defaults to DefaultJobs.
+	Jobs int
+	// ChunkSize is the size of the chunks for uploading large blobs.
+	// Defaults to registry.DefaultChunkSize.
+	ChunkSize int64
+	// MountFrom is the list of the repositories on the same registry.
+	// Blobs are mounted from these repositories if possible, rather than uploaded.
+	MountFrom []string
+	// Progress shows the progress bar.
+	Progress bool
+}
+
+// Push pushes the manifest tagged as refName in the image layout img to ref.
+// All the blobs referenced from the manifest, including the file blobs referenced from
+// continuity manifests and the sidecar blobs, are uploaded unless the registry already has them.
+func Push(img, refName string, ref *registry.Reference, opts Options) error {
+	if opts.Client == nil {
+		opts.Client = registry.NewClient()
+	}
+	if opts.Jobs <= 0 {
+		opts.Jobs = DefaultJobs
+	}
+	idx, err := image.ReadIndex(img)
+	if err != nil {
+		return err
+	}
+	var top *spec.Descriptor
+	for i, m := range idx.Manifests {
+		if m.Annotations[image.RefNameAnnotation] == refName {
+			top = &idx.Manifests[i]
+			break
+		}
+	}
+	if top == nil {
+		return fmt.Errorf("unknown reference name: %q", refName)
+	}
+	var blobs, manifests []spec.Descriptor
+	if err := walker.Walk(puller.NewLocalPuller(), img, []spec.Descriptor{*top}, func(desc spec.Descriptor) error {
+		if isManifest(desc.MediaType) {
+			manifests = append(manifests, desc)
+		} else {
+			blobs = append(blobs, desc)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	p := &pusher{img: img, ref: ref, opts: opts}
+	logrus.Infof("Pushing %d blobs to %s", len(blobs), ref)
+	if err := p.pushBlobs(blobs); err != nil {
+		return err
+	}
+	// manifests are pushed after the children, i.e. in the reverse order of walking
+	for i := len(manifests) - 1; i >= 0; i-- {
+		m := manifests[i]
+		object := m.Digest.String()
+		if i == 0 {
+			object = ref.Object()
+		}
+		b, err := image.ReadBlob(img, m.Digest)
+		if err != nil {
+			return err
+		}
+		if err := opts.Client.PutManifest(ref, object, m.MediaType, b); err != nil {
+			return err
+		}
+		logrus.Infof("Pushed manifest %s as %s", m.Digest, object)
+	}
+	return nil
+}
+
+func isManifest(mediaType string) bool {
+	switch mediaType {
+	case spec.MediaTypeImageManifest, spec.MediaTypeImageIndex,
+		registry.MediaTypeDockerManifest, registry.MediaTypeDockerManifestList:
+		return true
+	}
+	return false
+}
+
+type pusher struct {
+	img  string
+	ref  *registry.Reference
+	opts Options
+}
+
+func (p *pusher) pushBlobs(blobs []spec.Descriptor) error {
+	var bar *progressbar.ProgressBar
+	if p.opts.Progress {
+		bar = progressbar.StartNew(len(blobs))
+		defer bar.Finish()
+	}
+	ch := make(chan digest.Digest)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		stats    = make(map[string]int, 0)
+	)
+	for i := 0; i < p.opts.Jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range ch {
+				how, err := p.pushBlob(d)
+				if bar != nil {
+					bar.Increment()
+				}
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = fmt.Errorf("error while pushing %s: %v", d, err)
+				}
+				stats[how]++
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, b := range blobs {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		ch <- b.Digest
+	}
+	close(ch)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	logrus.Infof("Blobs: %d uploaded, %d mounted, %d skipped (already exist)",
+		stats["uploaded"], stats["mounted"], stats["skipped"])
+	return nil
+}
+
+// pushBlob returns how the blob was pushed: "skipped", "mounted", or "uploaded".
+func (p *pusher) pushBlob(d digest.Digest) (string, error) {
+	c := p.opts.Client
+	exists, err := c.BlobExists(p.ref, d, registry.PushScope(p.ref))
+	if err != nil {
+		return "", err
+	}
+	if exists {
+		return "skipped", nil
+	}
+	for _, from := range p.opts.MountFrom {
+		mounted, err := c.MountBlob(p.ref, d, from, registry.MountScope(p.ref, from))
+		if err != nil {
+			logrus.Debugf("error while mounting %s from %s: %v", d, from, err)
+			continue
+		}
+		if mounted {
+			return "mounted", nil
+		}
+	}
+	st, err := image.StatBlob(p.img, d)
+	if err != nil {
+		return "", err
+	}
+	r, err := image.GetBlobReader(p.img, d)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		return "", fmt.Errorf("blob %s cannot be read at offsets", d)
+	}
+	if err := c.UploadBlob(p.ref, d, ra, st.Size(), p.opts.ChunkSize); err != nil {
+		return "", err
+	}
+	return "uploaded", nil
+}
@@ -0,0 +1,130 @@
+package pusher
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	continuitypb "github.com/containerd/continuity/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/opencontainers/image-spec/specs-go"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/continuityutil"
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/image/imageutil"
+	"github.com/AkihiroSuda/filegrain/internal/registrytest"
+	"github.com/AkihiroSuda/filegrain/puller"
+	"github.com/AkihiroSuda/filegrain/registry"
+	"github.com/AkihiroSuda/filegrain/walker"
+)
+
+func TestPush(t *testing.T) {
+	img, err := ioutil.TempDir("", "filegrain-test-pusher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(img)
+	if err := image.Init(img); err != nil {
+		t.Fatal(err)
+	}
+	var resources []*continuitypb.Resource
+	contents := []string{"existing", "mountable", "small", strings.Repeat("large", 10)}
+	for i, s := range contents {
+		d, err := image.WriteBlob(img, []byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resources = append(resources, &continuitypb.Resource{
+			Path: []string{fmt.Sprintf("/%d", i)}, Mode: 0644, Size: uint64(len(s)), Digest: []string{d.String()},
+		})
+	}
+	contM, err := proto.Marshal(&continuitypb.Manifest{Resource: resources})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contMDigest, err := image.WriteBlob(img, contM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDesc, err := imageutil.WriteJSONBlob(img, &spec.Image{}, spec.MediaTypeImageConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDesc, err := imageutil.WriteJSONBlob(img, &spec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    *configDesc,
+		Layers: []spec.Descriptor{
+			{MediaType: continuityutil.MediaTypeManifestV0Protobuf, Digest: contMDigest, Size: int64(len(contM))},
+		},
+	}, spec.MediaTypeImageManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDesc.Annotations = map[string]string{image.RefNameAnnotation: "latest"}
+	if err := image.PutManifestDescriptorToIndex(img, manifestDesc); err != nil {
+		t.Fatal(err)
+	}
+
+	reg := registrytest.NewRegistry()
+	defer reg.Close()
+	reg.PutBlob("foo", []byte("existing"))
+	reg.PutBlob("other", []byte("mountable"))
+	ref, err := registry.ParseReference(reg.Host() + "/foo:tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := registry.NewClient()
+	client.PlainHTTP = true
+	client.Credentials = nil
+	if err := Push(img, "latest", ref, Options{
+		Client:    client,
+		ChunkSize: 16,
+		MountFrom: []string{"nonexistent", "other"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// small, large, continuity manifest, config
+	if reg.Uploads != 4 || reg.Mounts != 1 {
+		t.Errorf("expected 4 uploads and 1 mount, got %d uploads and %d mounts", reg.Uploads, reg.Mounts)
+	}
+	if reg.Patches == 0 {
+		t.Error("expected chunked upload")
+	}
+
+	// pull back
+	p := puller.NewRegistryPuller(client)
+	idx, err := p.PullIndex(ref.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	if err := walker.Walk(p, ref.String(), idx.Manifests, func(desc spec.Descriptor) error {
+		r, err := p.PullBlob(ref.String(), desc.Digest)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		expected, err := image.ReadBlob(img, desc.Digest)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(b, expected) {
+			return fmt.Errorf("unexpected content for %s: %q", desc.Digest, b)
+		}
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(contents)+3 {
+		t.Errorf("expected %d blobs, got %d", len(contents)+3, n)
+	}
+}
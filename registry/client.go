@@ -0,0 +1,359 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+
+	// maxManifestSize is the limit of the size of manifests and token responses.
+	maxManifestSize = 4 << 20
+)
+
+var manifestMediaTypes = []string{
+	spec.MediaTypeImageIndex,
+	spec.MediaTypeImageManifest,
+	MediaTypeDockerManifestList,
+	MediaTypeDockerManifest,
+}
+
+// StatusError is returned for unexpected HTTP status codes.
+type StatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d for %s %s: %q", e.StatusCode, e.Method, e.URL, e.Body)
+}
+
+// IsNotFound returns true if err is a StatusError with 404.
+func IsNotFound(err error) bool {
+	se, ok := err.(*StatusError)
+	return ok && se.StatusCode == http.StatusNotFound
+}
+
+func newStatusError(resp *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return &StatusError{
+		Method:     resp.Request.Method,
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		Body:       string(b),
+	}
+}
+
+// Client is a client for Docker Registry HTTP API v2.
+type Client struct {
+	HTTPClient *http.Client
+	// PlainHTTP uses http rather than https.
+	PlainHTTP bool
+	// Credentials returns the username and the password for the host.
+	// Anonymous if nil, or if the username is empty.
+	Credentials func(host string) (username, password string)
+
+	mu sync.Mutex
+	// auth is the Authorization header value. key: host + " " + scope
+	auth map[string]string
+}
+
+func NewClient() *Client {
+	return &Client{
+		HTTPClient:  http.DefaultClient,
+		Credentials: DockerConfigCredentials,
+	}
+}
+
+// URL returns the URL of the API endpoint, e.g. "/v2/<name>/blobs/<digest>" for
+// URL(ref, "blobs", digest).
+func (c *Client) URL(ref *Reference, elem ...string) string {
+	scheme := "https"
+	if c.PlainHTTP {
+		scheme = "http"
+	}
+	return scheme + "://" + ref.Host + "/v2/" + ref.Name + "/" + strings.Join(elem, "/")
+}
+
+// PullScope returns the token scope for pulling ref.
+func PullScope(ref *Reference) string {
+	return "repository:" + ref.Name + ":pull"
+}
+
+// PushScope returns the token scope for pushing ref.
+func PushScope(ref *Reference) string {
+	return "repository:" + ref.Name + ":pull,push"
+}
+
+// Do sends req with the Authorization header for the scope.
+// When the registry requires authorization, the request is retried after authorization.
+// The body of req needs to be rewindable via req.GetBody for retrying.
+func (c *Client) Do(req *http.Request, scope string) (*http.Response, error) {
+	host := req.URL.Host
+	key := host + " " + scope
+	c.mu.Lock()
+	auth := c.auth[key]
+	c.mu.Unlock()
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	auth, err = c.authorize(host, scope, challenge)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.auth == nil {
+		c.auth = make(map[string]string, 0)
+	}
+	c.auth[key] = auth
+	c.mu.Unlock()
+	if req.Body != nil {
+		if req.GetBody == nil {
+			return nil, fmt.Errorf("cannot retry %s %s after authorization", req.Method, req.URL)
+		}
+		if req.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	req.Header.Set("Authorization", auth)
+	return c.HTTPClient.Do(req)
+}
+
+// authorize returns the Authorization header value for the challenge.
+func (c *Client) authorize(host, scope, challenge string) (string, error) {
+	var username, password string
+	if c.Credentials != nil {
+		username, password = c.Credentials(host)
+	}
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if username == "" {
+			return "", fmt.Errorf("no credentials for %s", host)
+		}
+		req := &http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(username, password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+		token, err := c.fetchToken(params, scope, username, password)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	}
+	return "", fmt.Errorf("unsupported authorization challenge from %s: %q", host, challenge)
+}
+
+func (c *Client) fetchToken(params map[string]string, scope, username, password string) (string, error) {
+	realm, ok := params["realm"]
+	if !ok {
+		return "", fmt.Errorf("no realm in the bearer challenge")
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if service, ok := params["service"]; ok {
+		q.Set("service", service)
+	}
+	// multiple scopes are separated by spaces
+	for _, sc := range strings.Fields(scope) {
+		q.Add("scope", sc)
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if username != "" {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", newStatusError(resp)
+	}
+	var tr struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&tr); err != nil {
+		return "", err
+	}
+	if tr.Token != "" {
+		return tr.Token, nil
+	}
+	if tr.AccessToken != "" {
+		return tr.AccessToken, nil
+	}
+	return "", fmt.Errorf("no token returned from %s", realm)
+}
+
+// parseChallenge parses `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func parseChallenge(s string) (string, map[string]string) {
+	params := make(map[string]string, 0)
+	s = strings.TrimSpace(s)
+	i := strings.Index(s, " ")
+	if i < 0 {
+		return s, params
+	}
+	scheme, rest := s[:i], s[i+1:]
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		k := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var v string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				v, rest = rest[1:], ""
+			} else {
+				v, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				v, rest = rest, ""
+			} else {
+				v, rest = rest[:end], rest[end+1:]
+			}
+		}
+		params[k] = v
+	}
+	return scheme, params
+}
+
+// GetManifest fetches the manifest (or the index) specified by object (tag or digest).
+func (c *Client) GetManifest(ref *Reference, object string) (*spec.Descriptor, []byte, error) {
+	req, err := http.NewRequest("GET", c.URL(ref, "manifests", object), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	resp, err := c.Do(req, PullScope(ref))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, newStatusError(resp)
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(b) > maxManifestSize {
+		return nil, nil, fmt.Errorf("manifest %s for %s is too large", object, ref)
+	}
+	desc := &spec.Descriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	if d, err := digest.Parse(object); err == nil && d != desc.Digest {
+		return nil, nil, fmt.Errorf("expected manifest %s, got %s", d, desc.Digest)
+	}
+	return desc, b, nil
+}
+
+// GetBlob fetches n bytes of the blob from the offset off.
+// If n <= 0, the blob is fetched until the end.
+// Returns the body and the size of the whole blob (-1 if unknown).
+func (c *Client) GetBlob(ref *Reference, d digest.Digest, off, n int64) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequest("GET", c.URL(ref, "blobs", d.String()), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if r := RangeHeader(off, n); r != "" {
+		req.Header.Set("Range", r)
+	}
+	resp, err := c.Do(req, PullScope(ref))
+	if err != nil {
+		return nil, 0, err
+	}
+	return RangeResponseBody(resp, off, n)
+}
+
+// RangeHeader returns the value of the Range header for n bytes from off.
+// If n <= 0, the range is until the end.
+// Returns an empty string if no Range header is needed.
+func RangeHeader(off, n int64) string {
+	if n > 0 {
+		return fmt.Sprintf("bytes=%d-%d", off, off+n-1)
+	}
+	if off > 0 {
+		return fmt.Sprintf("bytes=%d-", off)
+	}
+	return ""
+}
+
+// RangeResponseBody returns the body of the response for the request with RangeHeader(off, n),
+// and the size of the whole content (-1 if unknown).
+// Servers that do not support Range are also supported.
+// The response body is closed on error.
+func RangeResponseBody(resp *http.Response, off, n int64) (io.ReadCloser, int64, error) {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		size := resp.ContentLength
+		if off > 0 {
+			// Range is ignored by the server
+			if _, err := io.CopyN(ioutil.Discard, resp.Body, off); err != nil {
+				resp.Body.Close()
+				return nil, 0, err
+			}
+		}
+		if n > 0 {
+			return &limitedReadCloser{Reader: io.LimitReader(resp.Body, n), Closer: resp.Body}, size, nil
+		}
+		return resp.Body, size, nil
+	case http.StatusPartialContent:
+		return resp.Body, contentRangeSize(resp.Header.Get("Content-Range")), nil
+	}
+	defer resp.Body.Close()
+	return nil, 0, newStatusError(resp)
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// contentRangeSize parses "bytes 42-100/1000" and returns 1000.
+// Returns -1 if unknown.
+func contentRangeSize(s string) int64 {
+	size := int64(-1)
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		if _, err := fmt.Sscanf(s[i+1:], "%d", &size); err != nil {
+			return -1
+		}
+	}
+	return size
+}
@@ -0,0 +1,53 @@
+package registry
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dockerHubAuthKey is the key for Docker Hub in ~/.docker/config.json.
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// DockerConfigCredentials returns the credentials for host stored in
+// $DOCKER_CONFIG/config.json (defaults to ~/.docker/config.json).
+// Only the "auths" entries are supported; credential helpers are ignored.
+func DockerConfigCredentials(host string) (string, string) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return "", ""
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(b, &config); err != nil {
+		return "", ""
+	}
+	keys := []string{host, "https://" + host, "http://" + host}
+	if host == DefaultHost {
+		keys = append(keys, dockerHubAuthKey)
+	}
+	for _, k := range keys {
+		a, ok := config.Auths[k]
+		if !ok {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return "", ""
+		}
+		if i := strings.Index(string(decoded), ":"); i >= 0 {
+			return string(decoded[:i]), string(decoded[i+1:])
+		}
+	}
+	return "", ""
+}
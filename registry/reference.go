@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	DefaultHost = "registry-1.docker.io"
+	DefaultTag  = "latest"
+)
+
+// Reference is a reference to an image in a registry, e.g. "registry.example.com/foo:tag".
+type Reference struct {
+	Host string
+	Name string
+	// Tag defaults to DefaultTag unless Digest is set.
+	// When both are set (e.g. "name:tag@sha256:..."), Digest is used for pulling, as in Object.
+	Tag    string
+	Digest digest.Digest
+}
+
+// ParseReference parses s in the form of "[host/]name[:tag|@digest]".
+// When host is omitted, Docker Hub is used.
+func ParseReference(s string) (*Reference, error) {
+	if s == "" {
+		return nil, fmt.Errorf("empty reference")
+	}
+	ref := &Reference{}
+	if i := strings.Index(s, "@"); i >= 0 {
+		d, err := digest.Parse(s[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid reference %q: %v", s, err)
+		}
+		ref.Digest = d
+		s = s[:i]
+	}
+	// the tag separator must be after the last slash, as the host can contain a port
+	if i := strings.LastIndex(s, ":"); i > strings.LastIndex(s, "/") {
+		ref.Tag = s[i+1:]
+		s = s[:i]
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = DefaultTag
+	}
+	if i := strings.Index(s, "/"); i >= 0 && isHost(s[:i]) {
+		ref.Host, ref.Name = s[:i], s[i+1:]
+	} else {
+		ref.Host, ref.Name = DefaultHost, s
+		if !strings.Contains(s, "/") {
+			ref.Name = "library/" + s
+		}
+	}
+	if ref.Name == "" || ref.Name != strings.ToLower(ref.Name) {
+		return nil, fmt.Errorf("invalid reference name %q", ref.Name)
+	}
+	return ref, nil
+}
+
+func isHost(s string) bool {
+	return strings.ContainsAny(s, ".:") || s == "localhost"
+}
+
+// Object returns the digest if set, otherwise the tag.
+func (ref *Reference) Object() string {
+	if ref.Digest != "" {
+		return ref.Digest.String()
+	}
+	return ref.Tag
+}
+
+func (ref *Reference) String() string {
+	s := ref.Host + "/" + ref.Name
+	if ref.Tag != "" {
+		s += ":" + ref.Tag
+	}
+	if ref.Digest != "" {
+		s += "@" + ref.Digest.String()
+	}
+	return s
+}
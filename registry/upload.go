@@ -0,0 +1,197 @@
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// DefaultChunkSize is the default size of the chunks for chunked uploads.
+const DefaultChunkSize = 32 << 20
+
+// MountScope returns the token scope for pushing ref with cross-repository blob mounts from the repository from.
+func MountScope(ref *Reference, from string) string {
+	return PushScope(ref) + " repository:" + from + ":pull"
+}
+
+// BlobExists returns true if the repository of ref already has the blob.
+func (c *Client) BlobExists(ref *Reference, d digest.Digest, scope string) (bool, error) {
+	req, err := http.NewRequest("HEAD", c.URL(ref, "blobs", d.String()), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.Do(req, scope)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, newStatusError(resp)
+}
+
+// MountBlob mounts the blob from the repository from on the same registry.
+// Returns false if the registry declined mounting, e.g. when the blob does not exist in from.
+// scope should be MountScope(ref, from).
+func (c *Client) MountBlob(ref *Reference, d digest.Digest, from string, scope string) (bool, error) {
+	q := url.Values{}
+	q.Set("mount", d.String())
+	q.Set("from", from)
+	req, err := http.NewRequest("POST", c.URL(ref, "blobs", "uploads/")+"?"+q.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.Do(req, scope)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusAccepted:
+		// the registry started a new upload session instead of mounting.
+		// The session is abandoned.
+		return false, nil
+	}
+	return false, newStatusError(resp)
+}
+
+// UploadBlob uploads the blob read from r.
+// The blob is uploaded monolithically if size <= chunkSize, otherwise in chunks.
+// chunkSize defaults to DefaultChunkSize.
+func (c *Client) UploadBlob(ref *Reference, d digest.Digest, r io.ReaderAt, size, chunkSize int64) error {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	scope := PushScope(ref)
+	loc, err := c.startUpload(ref, scope)
+	if err != nil {
+		return err
+	}
+	off := int64(0)
+	if size > chunkSize {
+		for ; off < size; off += chunkSize {
+			n := chunkSize
+			if size-off < n {
+				n = size - off
+			}
+			if loc, err = c.uploadChunk(loc, r, off, n, scope); err != nil {
+				return err
+			}
+		}
+	}
+	// the last PUT contains the rest of the blob (the whole blob for monolithic uploads)
+	u, err := url.Parse(loc)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	q.Set("digest", d.String())
+	u.RawQuery = q.Encode()
+	req, err := newSectionRequest("PUT", u.String(), r, off, size-off)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req, scope)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return newStatusError(resp)
+	}
+	return nil
+}
+
+// startUpload returns the upload location.
+func (c *Client) startUpload(ref *Reference, scope string) (string, error) {
+	req, err := http.NewRequest("POST", c.URL(ref, "blobs", "uploads/"), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.Do(req, scope)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return "", newStatusError(resp)
+	}
+	return location(resp)
+}
+
+// uploadChunk uploads the chunk, and returns the next upload location.
+func (c *Client) uploadChunk(loc string, r io.ReaderAt, off, n int64, scope string) (string, error) {
+	req, err := newSectionRequest("PATCH", loc, r, off, n)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", off, off+n-1))
+	resp, err := c.Do(req, scope)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return "", newStatusError(resp)
+	}
+	return location(resp)
+}
+
+// location returns the absolute URL of the Location header.
+func location(resp *http.Response) (string, error) {
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return "", fmt.Errorf("no Location header for %s %s", resp.Request.Method, resp.Request.URL)
+	}
+	u, err := resp.Request.URL.Parse(loc)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// newSectionRequest creates a request with the body read from r, which can be rewound for retries.
+func newSectionRequest(method, u string, r io.ReaderAt, off, n int64) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, io.NewSectionReader(r, off, n))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = n
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.NewSectionReader(r, off, n)), nil
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if n == 0 {
+		req.Body = http.NoBody
+	}
+	return req, nil
+}
+
+// PutManifest uploads the manifest (or the index) as object (tag or digest).
+func (c *Client) PutManifest(ref *Reference, object, mediaType string, b []byte) error {
+	req, err := http.NewRequest("PUT", c.URL(ref, "manifests", object), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := c.Do(req, PushScope(ref))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return newStatusError(resp)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+// Package tartoc provides the sidecar table of contents of a tar layer,
+// so that the entries of the layer can be listed without reading the whole layer.
+package tartoc
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// Annotation is the annotation of a tar layer descriptor.
+	// The value is the digest of the TOC blob.
+	Annotation = "filegrain.tar.toc"
+
+	// MediaType is the media type of the TOC blob.
+	MediaType = "application/vnd.filegrain.tartoc.v1+json"
+
+	Version = 1
+)
+
+// TOC is the table of contents of a tar layer.
+type TOC struct {
+	Version int `json:"version"`
+	// Entries are in the order of the tar stream.
+	Entries []Entry `json:"entries"`
+}
+
+// Entry is an entry of the tar stream.
+type Entry struct {
+	Name     string `json:"name"`
+	Typeflag byte   `json:"type"`
+	Linkname string `json:"linkname,omitempty"`
+	Mode     int64  `json:"mode"`
+	Uid      int    `json:"uid,omitempty"`
+	Gid      int    `json:"gid,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	// ModTime is the Unix time in nanoseconds.
+	ModTime  int64 `json:"mtime,omitempty"`
+	Devmajor int64 `json:"devmajor,omitempty"`
+	Devminor int64 `json:"devminor,omitempty"`
+	// PAXRecords contains the xattrs, e.g. "SCHILY.xattr.user.foo".
+	PAXRecords map[string]string `json:"pax,omitempty"`
+	// Offset is the offset of the content in the uncompressed tar stream.
+	Offset int64 `json:"offset"`
+}
+
+// NewTOC returns an empty TOC.
+func NewTOC() *TOC {
+	return &TOC{Version: Version}
+}
+
+// Unmarshal decodes the TOC.
+func Unmarshal(b []byte) (*TOC, error) {
+	var toc TOC
+	if err := json.Unmarshal(b, &toc); err != nil {
+		return nil, err
+	}
+	if toc.Version != Version {
+		return nil, fmt.Errorf("unsupported tar TOC version: %d", toc.Version)
+	}
+	return &toc, nil
+}
+
+// Add appends the entry for hdr, whose content begins at offset in the uncompressed tar stream.
+func (toc *TOC) Add(hdr *tar.Header, offset int64) {
+	e := Entry{
+		Name:       hdr.Name,
+		Typeflag:   hdr.Typeflag,
+		Linkname:   hdr.Linkname,
+		Mode:       hdr.Mode,
+		Uid:        hdr.Uid,
+		Gid:        hdr.Gid,
+		Size:       hdr.Size,
+		Devmajor:   hdr.Devmajor,
+		Devminor:   hdr.Devminor,
+		PAXRecords: hdr.PAXRecords,
+		Offset:     offset,
+	}
+	if !hdr.ModTime.IsZero() {
+		e.ModTime = hdr.ModTime.UnixNano()
+	}
+	toc.Entries = append(toc.Entries, e)
+}
+
+// Header returns the tar header of the entry.
+func (e *Entry) Header() *tar.Header {
+	hdr := &tar.Header{
+		Name:       e.Name,
+		Typeflag:   e.Typeflag,
+		Linkname:   e.Linkname,
+		Mode:       e.Mode,
+		Uid:        e.Uid,
+		Gid:        e.Gid,
+		Size:       e.Size,
+		Devmajor:   e.Devmajor,
+		Devminor:   e.Devminor,
+		PAXRecords: e.PAXRecords,
+	}
+	if e.ModTime != 0 {
+		hdr.ModTime = time.Unix(0, e.ModTime)
+	}
+	return hdr
+}
@@ -0,0 +1,259 @@
+// Package verify checks the integrity of a local image.
+package verify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	continuitypb "github.com/containerd/continuity/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/cdc"
+	"github.com/AkihiroSuda/filegrain/continuityutil"
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/layerutil"
+	"github.com/AkihiroSuda/filegrain/puller"
+	"github.com/AkihiroSuda/filegrain/registry"
+	"github.com/AkihiroSuda/filegrain/walker"
+)
+
+// Kind is the kind of a problem.
+type Kind string
+
+const (
+	// Missing means that the referenced blob does not exist.
+	Missing Kind = "missing"
+	// Corrupt means that the content of the blob does not match the digest.
+	Corrupt Kind = "corrupt"
+	// SizeMismatch means that the size of the blob does not match the descriptor or the continuity resource.
+	SizeMismatch Kind = "size-mismatch"
+	// MediaTypeMismatch means that the media type of the descriptor is unknown,
+	// or does not match the mediaType field of the blob.
+	MediaTypeMismatch Kind = "media-type-mismatch"
+	// Unreadable means that the blobs referenced from the manifest could not be enumerated.
+	Unreadable Kind = "unreadable"
+	// Orphaned means that the blob is not referenced from the index. Orphaned blobs can be deleted with gc.
+	Orphaned Kind = "orphaned"
+)
+
+// Problem is a problem found in the image.
+type Problem struct {
+	Kind      Kind          `json:"kind"`
+	Digest    digest.Digest `json:"digest"`
+	MediaType string        `json:"mediaType,omitempty"`
+	Message   string        `json:"message,omitempty"`
+}
+
+func (p Problem) String() string {
+	s := fmt.Sprintf("%s %s", p.Kind, p.Digest)
+	if p.MediaType != "" {
+		s += fmt.Sprintf(" (%s)", p.MediaType)
+	}
+	if p.Message != "" {
+		s += ": " + p.Message
+	}
+	return s
+}
+
+// Report is the result of Verify.
+type Report struct {
+	// Verified is the number of the referenced blobs that were checked.
+	Verified int       `json:"verified"`
+	Problems []Problem `json:"problems"`
+}
+
+type Options struct {
+	// RefName limits the verification to the manifest with the ref name.
+	// Orphaned blobs are not reported when RefName is set.
+	RefName string
+}
+
+// Verify re-hashes the blobs referenced from the index of img, and checks the sizes and the media types.
+// The sizes of the chunked files in the continuity manifests are checked against the chunk maps.
+// The error is returned only when the verification could not be performed, e.g. img lacks index.json.
+func Verify(img string, opts Options) (*Report, error) {
+	idx, err := image.ReadIndex(img)
+	if err != nil {
+		return nil, err
+	}
+	manifests := idx.Manifests
+	if opts.RefName != "" {
+		manifests = nil
+		for _, m := range idx.Manifests {
+			if m.Annotations[image.RefNameAnnotation] == opts.RefName {
+				manifests = append(manifests, m)
+			}
+		}
+		if len(manifests) == 0 {
+			return nil, fmt.Errorf("ref name %q not found in %s", opts.RefName, img)
+		}
+	}
+	v := &verifier{
+		img:    img,
+		report: &Report{Problems: []Problem{}},
+		seen:   make(map[digest.Digest]struct{}, 0),
+	}
+	for _, m := range manifests {
+		// walk the manifests one by one, so that an unreadable manifest does not hide the others
+		if err := walker.Walk(puller.NewLocalPuller(), img, []spec.Descriptor{m}, v.verify); err != nil {
+			v.addProblem(Unreadable, m, err.Error())
+		}
+	}
+	if opts.RefName == "" {
+		blobs, err := image.ListBlobs(img)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range blobs {
+			if _, ok := v.seen[d]; !ok {
+				v.addProblem(Orphaned, spec.Descriptor{Digest: d}, "")
+			}
+		}
+	}
+	return v.report, nil
+}
+
+type verifier struct {
+	img    string
+	report *Report
+	// seen is shared across the walks of the manifests, so that the shared blobs are verified only once
+	seen map[digest.Digest]struct{}
+}
+
+func (v *verifier) addProblem(kind Kind, desc spec.Descriptor, msg string) {
+	v.report.Problems = append(v.report.Problems, Problem{
+		Kind:      kind,
+		Digest:    desc.Digest,
+		MediaType: desc.MediaType,
+		Message:   msg,
+	})
+}
+
+// verify implements walker.WalkFunc.
+// walker.SkipBlob is returned for the broken blobs, so that the walker does not parse them.
+func (v *verifier) verify(desc spec.Descriptor) error {
+	if _, ok := v.seen[desc.Digest]; ok {
+		return walker.SkipBlob
+	}
+	v.seen[desc.Digest] = struct{}{}
+	v.report.Verified++
+	r, err := image.GetBlobReader(v.img, desc.Digest)
+	if err != nil {
+		if os.IsNotExist(err) {
+			v.addProblem(Missing, desc, "")
+		} else {
+			v.addProblem(Corrupt, desc, err.Error())
+		}
+		return walker.SkipBlob
+	}
+	defer r.Close()
+	verifier := desc.Digest.Verifier()
+	n, err := io.Copy(verifier, r)
+	if err != nil {
+		v.addProblem(Corrupt, desc, err.Error())
+		return walker.SkipBlob
+	}
+	if !verifier.Verified() {
+		v.addProblem(Corrupt, desc, "digest mismatch")
+		return walker.SkipBlob
+	}
+	if desc.Size != 0 && desc.Size != n {
+		v.addProblem(SizeMismatch, desc, fmt.Sprintf("expected %d bytes, got %d bytes", desc.Size, n))
+	}
+	if desc.MediaType != "" && !knownMediaType(desc.MediaType) {
+		v.addProblem(MediaTypeMismatch, desc, "unknown media type")
+	}
+	switch desc.MediaType {
+	case spec.MediaTypeImageIndex, spec.MediaTypeImageManifest,
+		registry.MediaTypeDockerManifestList, registry.MediaTypeDockerManifest:
+		return v.verifyJSONMediaType(desc)
+	case continuityutil.MediaTypeManifestV0Protobuf:
+		return v.verifyContinuityManifest(desc)
+	}
+	return nil
+}
+
+func knownMediaType(mediaType string) bool {
+	switch mediaType {
+	case spec.MediaTypeImageIndex, spec.MediaTypeImageManifest,
+		registry.MediaTypeDockerManifestList, registry.MediaTypeDockerManifest,
+		spec.MediaTypeImageConfig, registry.MediaTypeDockerConfig,
+		continuityutil.MediaTypeManifestV0Protobuf:
+		return true
+	}
+	_, err := layerutil.LayerCompression(mediaType)
+	return err == nil
+}
+
+// verifyJSONMediaType checks the mediaType field of the manifest or the index, if the field is set.
+func (v *verifier) verifyJSONMediaType(desc spec.Descriptor) error {
+	b, err := image.ReadBlob(v.img, desc.Digest)
+	if err != nil {
+		return err
+	}
+	var x struct {
+		MediaType string `json:"mediaType,omitempty"`
+	}
+	if err := json.Unmarshal(b, &x); err != nil {
+		v.addProblem(Corrupt, desc, err.Error())
+		return walker.SkipBlob
+	}
+	if x.MediaType != "" && x.MediaType != desc.MediaType {
+		v.addProblem(MediaTypeMismatch, desc, fmt.Sprintf("the blob has mediaType %q", x.MediaType))
+	}
+	return nil
+}
+
+// verifyContinuityManifest checks that the sizes of the chunks sum up to the sizes of the files.
+// The sizes of the unchunked files are checked by the walker via the descriptors.
+func (v *verifier) verifyContinuityManifest(desc spec.Descriptor) error {
+	b, err := image.ReadBlob(v.img, desc.Digest)
+	if err != nil {
+		return err
+	}
+	var cm continuitypb.Manifest
+	if err := proto.Unmarshal(b, &cm); err != nil {
+		v.addProblem(Corrupt, desc, err.Error())
+		return walker.SkipBlob
+	}
+	s, ok := desc.Annotations[cdc.Annotation]
+	if !ok {
+		return nil
+	}
+	chunkMapDigest, err := digest.Parse(s)
+	if err != nil {
+		v.addProblem(Corrupt, desc, fmt.Sprintf("invalid digest %q for annotation %s", s, cdc.Annotation))
+		return walker.SkipBlob
+	}
+	chunkMapBytes, err := image.ReadBlob(v.img, chunkMapDigest)
+	if err != nil {
+		// reported as a missing blob by the walker
+		return nil
+	}
+	chunkMap, err := cdc.Unmarshal(chunkMapBytes)
+	if err != nil {
+		v.addProblem(Corrupt, spec.Descriptor{Digest: chunkMapDigest}, err.Error())
+		return walker.SkipBlob
+	}
+	for _, res := range cm.Resource {
+		for _, ds := range res.Digest {
+			chunks, ok := chunkMap.Files[digest.Digest(ds)]
+			if !ok {
+				continue
+			}
+			var size int64
+			for _, c := range chunks {
+				size += c.Size
+			}
+			if size != int64(res.Size) {
+				v.addProblem(SizeMismatch, spec.Descriptor{Digest: digest.Digest(ds)},
+					fmt.Sprintf("%v: expected %d bytes, got %d bytes in chunks", res.Path, res.Size, size))
+			}
+		}
+	}
+	return nil
+}
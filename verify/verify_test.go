@@ -0,0 +1,88 @@
+package verify
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/AkihiroSuda/filegrain/builder"
+	"github.com/AkihiroSuda/filegrain/image"
+)
+
+func TestVerify(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filegrain-test-verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	rootfs, img := filepath.Join(tmpDir, "rootfs"), filepath.Join(tmpDir, "img")
+	if err := os.Mkdir(rootfs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"a", "b"} {
+		if err := ioutil.WriteFile(filepath.Join(rootfs, f), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := builder.NewBuilderWithRootFS(rootfs, builder.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Build(img, "latest"); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Verify(img, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 || report.Verified == 0 {
+		t.Fatalf("unexpected report for the intact image: %+v", report)
+	}
+
+	missing, corrupt := digest.FromString("a"), digest.FromString("b")
+	if err := image.DeleteBlob(img, missing); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(image.BlobPath(img, corrupt), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(image.BlobPath(img, corrupt), []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	orphaned, err := image.WriteBlob(img, []byte("orphaned"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err = Verify(img, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range report.Problems {
+		got = append(got, string(p.Kind)+" "+p.Digest.String())
+	}
+	sort.Strings(got)
+	expected := []string{
+		string(Corrupt) + " " + corrupt.String(),
+		string(Missing) + " " + missing.String(),
+		string(Orphaned) + " " + orphaned.String(),
+	}
+	sort.Strings(expected)
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+
+	// orphaned blobs are not reported for a tag
+	report, err = Verify(img, Options{RefName: "latest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 2 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+}
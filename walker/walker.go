@@ -0,0 +1,242 @@
+// Package walker enumerates the blobs referenced from an image.
+package walker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	continuitypb "github.com/containerd/continuity/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/opencontainers/go-digest"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/blobcompress"
+	"github.com/AkihiroSuda/filegrain/cdc"
+	"github.com/AkihiroSuda/filegrain/continuityutil"
+	"github.com/AkihiroSuda/filegrain/gzindex"
+	"github.com/AkihiroSuda/filegrain/mtime"
+	"github.com/AkihiroSuda/filegrain/profile"
+	"github.com/AkihiroSuda/filegrain/puller"
+	"github.com/AkihiroSuda/filegrain/registry"
+	"github.com/AkihiroSuda/filegrain/tartoc"
+)
+
+// SidecarAnnotations are the annotations whose values are the digests of sidecar blobs.
+// The annotations are looked up in the descriptors and in the image manifests.
+var SidecarAnnotations = []string{
+	blobcompress.Annotation,
+	cdc.Annotation,
+	gzindex.IndexAnnotation,
+	mtime.Annotation,
+	profile.Annotation,
+	tartoc.Annotation,
+}
+
+// WalkFunc is called for every blob.
+// desc.Size is zero if unknown. desc.MediaType is empty for file content blobs and sidecar blobs.
+// If WalkFunc returns SkipBlob, the blobs referenced from the blob are not walked.
+type WalkFunc func(desc spec.Descriptor) error
+
+// SkipBlob is used as a return value from WalkFunc, e.g. for a blob that cannot be read.
+var SkipBlob = errors.New("skip this blob")
+
+type walker struct {
+	puller puller.Puller
+	img    string
+	fn     WalkFunc
+	seen   map[digest.Digest]struct{}
+}
+
+// Walk calls fn for the blobs referenced from the manifests (typically from the index of img),
+// including the manifests themselves.
+// Each blob is visited only once, and a parent is visited before its children.
+// The manifests, the continuity manifests, and the nested indexes are pulled from img via p.
+// They are verified if p is a puller.DescriptorPuller, e.g. puller.NewVerifyingPuller.
+func Walk(p puller.Puller, img string, manifests []spec.Descriptor, fn WalkFunc) error {
+	w := &walker{
+		puller: p,
+		img:    img,
+		fn:     fn,
+		seen:   make(map[digest.Digest]struct{}, 0),
+	}
+	for _, m := range manifests {
+		if err := w.walk(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *walker) walk(desc spec.Descriptor) error {
+	if _, ok := w.seen[desc.Digest]; ok {
+		return nil
+	}
+	w.seen[desc.Digest] = struct{}{}
+	if err := w.fn(desc); err != nil {
+		if err == SkipBlob {
+			return nil
+		}
+		return err
+	}
+	if err := w.walkSidecars(desc.Annotations); err != nil {
+		return err
+	}
+	switch desc.MediaType {
+	case spec.MediaTypeImageIndex, registry.MediaTypeDockerManifestList:
+		var idx spec.Index
+		if err := w.readJSON(desc, &idx); err != nil {
+			return err
+		}
+		for _, m := range idx.Manifests {
+			if err := w.walk(m); err != nil {
+				return err
+			}
+		}
+	case spec.MediaTypeImageManifest, registry.MediaTypeDockerManifest:
+		var m spec.Manifest
+		if err := w.readJSON(desc, &m); err != nil {
+			return err
+		}
+		if err := w.walkSidecars(m.Annotations); err != nil {
+			return err
+		}
+		if err := w.walk(m.Config); err != nil {
+			return err
+		}
+		for _, l := range m.Layers {
+			if err := w.walk(l); err != nil {
+				return err
+			}
+		}
+	case continuityutil.MediaTypeManifestV0Protobuf:
+		b, err := w.read(desc)
+		if err != nil {
+			return err
+		}
+		var cm continuitypb.Manifest
+		if err := proto.Unmarshal(b, &cm); err != nil {
+			return fmt.Errorf("error while parsing continuity manifest %s: %v", desc.Digest, err)
+		}
+		chunkMap, err := w.readChunkMap(desc)
+		if err != nil {
+			return err
+		}
+		compressionMap, err := w.readCompressionMap(desc)
+		if err != nil {
+			return err
+		}
+		for _, res := range cm.Resource {
+			for _, s := range res.Digest {
+				d, err := digest.Parse(s)
+				if err != nil {
+					return fmt.Errorf("invalid digest %q for %v: %v", s, res.Path, err)
+				}
+				// chunked files are stored as the chunk blobs, without the blob of the whole content
+				if chunks, ok := chunkMap.Files[d]; ok {
+					for _, c := range chunks {
+						if err := w.walkContent(compressionMap, c.Digest, c.Size); err != nil {
+							return err
+						}
+					}
+					continue
+				}
+				if err := w.walkContent(compressionMap, d, int64(res.Size)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// walkContent walks the blob for the content.
+// Compressed contents are stored as the compressed blobs, without the uncompressed blobs.
+func (w *walker) walkContent(compressionMap *blobcompress.Map, d digest.Digest, size int64) error {
+	if b := compressionMap.Lookup(d); b != nil {
+		return w.walk(spec.Descriptor{Digest: b.Digest, Size: b.Size})
+	}
+	return w.walk(spec.Descriptor{Digest: d, Size: size})
+}
+
+func (w *walker) walkSidecars(annotations map[string]string) error {
+	for _, k := range SidecarAnnotations {
+		s, ok := annotations[k]
+		if !ok {
+			continue
+		}
+		d, err := digest.Parse(s)
+		if err != nil {
+			return fmt.Errorf("invalid digest %q for annotation %s: %v", s, k, err)
+		}
+		if err := w.walk(spec.Descriptor{Digest: d}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readChunkMap reads the chunk map of the continuity manifest.
+// Returns an empty map if the continuity manifest has no chunk map.
+func (w *walker) readChunkMap(desc spec.Descriptor) (*cdc.Map, error) {
+	s, ok := desc.Annotations[cdc.Annotation]
+	if !ok {
+		return cdc.NewMap(), nil
+	}
+	d, err := digest.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest %q for annotation %s: %v", s, cdc.Annotation, err)
+	}
+	b, err := w.read(spec.Descriptor{Digest: d})
+	if err != nil {
+		return nil, err
+	}
+	m, err := cdc.Unmarshal(b)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing chunk map %s: %v", d, err)
+	}
+	return m, nil
+}
+
+// readCompressionMap reads the compression map of the continuity manifest.
+// Returns nil if the continuity manifest has no compression map.
+func (w *walker) readCompressionMap(desc spec.Descriptor) (*blobcompress.Map, error) {
+	s, ok := desc.Annotations[blobcompress.Annotation]
+	if !ok {
+		return nil, nil
+	}
+	d, err := digest.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest %q for annotation %s: %v", s, blobcompress.Annotation, err)
+	}
+	b, err := w.read(spec.Descriptor{Digest: d})
+	if err != nil {
+		return nil, err
+	}
+	m, err := blobcompress.Unmarshal(b)
+	if err != nil {
+		return nil, fmt.Errorf("error while parsing compression map %s: %v", d, err)
+	}
+	return m, nil
+}
+
+func (w *walker) read(desc spec.Descriptor) ([]byte, error) {
+	r, err := puller.PullBlobWithDescriptor(w.puller, w.img, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func (w *walker) readJSON(desc spec.Descriptor, x interface{}) error {
+	b, err := w.read(desc)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, x); err != nil {
+		return fmt.Errorf("error while parsing %s: %v", desc.Digest, err)
+	}
+	return nil
+}
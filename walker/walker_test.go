@@ -0,0 +1,133 @@
+package walker
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	continuitypb "github.com/containerd/continuity/proto"
+	"github.com/golang/protobuf/proto"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	spec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/AkihiroSuda/filegrain/cdc"
+	"github.com/AkihiroSuda/filegrain/continuityutil"
+	"github.com/AkihiroSuda/filegrain/gzindex"
+	"github.com/AkihiroSuda/filegrain/image"
+	"github.com/AkihiroSuda/filegrain/image/imageutil"
+	"github.com/AkihiroSuda/filegrain/profile"
+	"github.com/AkihiroSuda/filegrain/puller"
+)
+
+func TestWalk(t *testing.T) {
+	img, err := ioutil.TempDir("", "filegrain-test-walker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(img)
+	if err := image.Init(img); err != nil {
+		t.Fatal(err)
+	}
+	var expected []digest.Digest
+	writeBlob := func(s string) digest.Digest {
+		d, err := image.WriteBlob(img, []byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, d)
+		return d
+	}
+	foo, bar := writeBlob("foo"), writeBlob("bar")
+	// the blob of the whole content of a chunked file is not stored
+	big := digest.FromString("big content")
+	chunkMap := cdc.NewMap()
+	chunkMap.Files[big] = []cdc.Chunk{
+		{Digest: writeBlob("big "), Size: 4},
+		{Digest: writeBlob("content"), Size: 7},
+	}
+	chunkMapDesc, err := imageutil.WriteJSONBlob(img, chunkMap, cdc.MediaType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, chunkMapDesc.Digest)
+	contM, err := proto.Marshal(&continuitypb.Manifest{
+		Resource: []*continuitypb.Resource{
+			{Path: []string{"/big"}, Mode: 0644, Size: 11, Digest: []string{big.String()}},
+			{Path: []string{"/foo"}, Mode: 0644, Size: 3, Digest: []string{foo.String()}},
+			{Path: []string{"/bar", "/bar2"}, Mode: 0644, Size: 3, Digest: []string{bar.String()}},
+			{Path: []string{"/foo2"}, Mode: 0644, Size: 3, Digest: []string{foo.String()}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	contMDigest := writeBlob(string(contM))
+	layer, gzIdx, prof := writeBlob("dummy tar.gz"), writeBlob("dummy gzindex"), writeBlob("dummy profile")
+	configDesc, err := imageutil.WriteJSONBlob(img, &spec.Image{}, spec.MediaTypeImageConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, configDesc.Digest)
+	manifestDesc, err := imageutil.WriteJSONBlob(img, &spec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    *configDesc,
+		Layers: []spec.Descriptor{
+			{
+				MediaType:   spec.MediaTypeImageLayerGzip,
+				Digest:      layer,
+				Annotations: map[string]string{gzindex.IndexAnnotation: gzIdx.String()},
+			},
+			{
+				MediaType:   continuityutil.MediaTypeManifestV0Protobuf,
+				Digest:      contMDigest,
+				Size:        int64(len(contM)),
+				Annotations: map[string]string{cdc.Annotation: chunkMapDesc.Digest.String()},
+			},
+		},
+		Annotations: map[string]string{profile.Annotation: prof.String()},
+	}, spec.MediaTypeImageManifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, manifestDesc.Digest)
+	manifestDesc.Annotations = map[string]string{image.RefNameAnnotation: "latest"}
+	if err := image.PutManifestDescriptorToIndex(img, manifestDesc); err != nil {
+		t.Fatal(err)
+	}
+	// a blob not referenced from the index
+	if _, err := image.WriteBlob(img, []byte("garbage")); err != nil {
+		t.Fatal(err)
+	}
+
+	p := puller.NewLocalPuller()
+	idx, err := p.PullIndex(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var visited []digest.Digest
+	if err := Walk(p, img, idx.Manifests, func(desc spec.Descriptor) error {
+		visited = append(visited, desc.Digest)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if visited[0] != manifestDesc.Digest {
+		t.Errorf("expected the manifest to be visited first, got %s", visited[0])
+	}
+	sortDigests(visited)
+	sortDigests(expected)
+	if len(visited) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, visited)
+	}
+	for i := range expected {
+		if visited[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, visited)
+		}
+	}
+}
+
+func sortDigests(ds []digest.Digest) {
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+}